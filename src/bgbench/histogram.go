@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// histogram 是HDR风格的延迟直方图: 按2的幂划分区间，每个区间再等分为subBuckets个桶,
+// 记录的值以微秒为单位，相对误差不超过1/subBuckets.
+type histogram struct {
+	counts []int64
+	total  int64
+	sum    int64
+	min    int64
+	max    int64
+}
+
+const (
+	subBucketBits = 7
+	subBuckets    = 1 << subBucketBits
+	// 可以记录的最大值约为2^36微秒(19小时)，更大的值记在最后一个桶中
+	histogramBits = 36
+	numBuckets    = (histogramBits - subBucketBits + 1) * subBuckets
+)
+
+func newHistogram() *histogram {
+	return &histogram{
+		counts: make([]int64, numBuckets),
+		min:    math.MaxInt64,
+	}
+}
+
+// bucketIndex 返回值v所在的桶
+func bucketIndex(v int64) int {
+	if v < subBuckets {
+		return int(v)
+	}
+	// v的最高位为第e位(e >= subBucketBits)，用紧随其后的subBucketBits位选择子桶
+	e := 63
+	for v>>uint(e)&1 == 0 {
+		e--
+	}
+	shift := uint(e - subBucketBits)
+	idx := (int(shift)+1)*subBuckets + int(v>>shift) - subBuckets
+	if idx >= numBuckets {
+		return numBuckets - 1
+	}
+	return idx
+}
+
+// bucketValue 返回桶idx中的最大值，用于计算分位数
+func bucketValue(idx int) int64 {
+	if idx < subBuckets {
+		return int64(idx)
+	}
+	shift := uint(idx/subBuckets - 1)
+	return (int64(idx%subBuckets+subBuckets)+1)<<shift - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+	v := int64(d / time.Microsecond)
+	if v < 0 {
+		v = 0
+	}
+	h.counts[bucketIndex(v)]++
+	h.total++
+	h.sum += v
+	if v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.total += o.total
+	h.sum += o.sum
+	if o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// quantile 返回q分位(0 < q <= 1)的值
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			v := bucketValue(i)
+			if v > h.max {
+				v = h.max
+			}
+			return time.Duration(v) * time.Microsecond
+		}
+	}
+	return time.Duration(h.max) * time.Microsecond
+}
+
+func (h *histogram) mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return time.Duration(h.sum/h.total) * time.Microsecond
+}
+
+func (h *histogram) minimum() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return time.Duration(h.min) * time.Microsecond
+}
+
+func (h *histogram) maximum() time.Duration {
+	return time.Duration(h.max) * time.Microsecond
+}
@@ -0,0 +1,255 @@
+/*
+bgbench drives a bgserver service with one kind of request and reports the
+throughput, the errors by retcode and the latency distribution.
+
+	bgbench -target 127.0.0.1:8080 -type SAY_HELLO_REQUEST \
+		-proto_path ../bgserver/message/proto -proto service1.1000.2000.proto \
+		-body 'person: 1 bless_message: "hi"' -conns 8 -qps 5000 -duration 30s -json result.json
+
+With -qps the requests are sent at a fixed rate (open loop) and the latency is
+measured from the time each request was scheduled, so that a stalled server is
+not hidden by the client slowing down. Without -qps, -concurrency workers send
+requests back to back (closed loop).
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"bgserver/discovery"
+	"bgserver/message"
+	"bgserver/message/dynamic"
+	pb "bgserver/message/proto/golang"
+	"bgserver/network"
+)
+
+var (
+	target      = flag.String("target", "127.0.0.1:8080", "host:port, a comma-separated list of them, or zk://zkhosts/path")
+	msgType     = flag.String("type", "", "the message type to send, by name (e.g. SAY_HELLO_REQUEST) or number")
+	body        = flag.String("body", "", "the body of the message, in the format given by -format")
+	format      = flag.String("format", "text", "the format of -body: text or json")
+	protoPath   = flag.String("proto_path", ".", "comma-separated directories to search for the -proto files")
+	protoFiles  = flag.String("proto", "", "comma-separated .proto files defining the messages, use server reflection if empty")
+	source      = flag.Uint("source", 0, "Head.source of the requests")
+	token       = flag.String("token", "", "authenticate with this token")
+	conns       = flag.Int("conns", 1, "the number of connections to open")
+	concurrency = flag.Int("concurrency", 0, "the number of workers sending requests, default to -conns; with -qps it bounds the requests in flight")
+	qps         = flag.Float64("qps", 0, "send requests at this fixed rate, closed loop if 0")
+	duration    = flag.Duration("duration", 10*time.Second, "how long to send requests")
+	timeout     = flag.Duration("timeout", 5*time.Second, "timeout of connecting and of every request")
+	jsonOut     = flag.String("json", "", "also write the result as JSON to this file, - for stdout")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "bgbench:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *msgType == "" {
+		return fmt.Errorf("-type is required")
+	}
+	if *conns <= 0 {
+		return fmt.Errorf("-conns must be positive")
+	}
+	if *concurrency <= 0 {
+		*concurrency = *conns
+	}
+
+	ccs := make([]*network.ClientConn, 0, *conns)
+	defer func() {
+		for _, cc := range ccs {
+			cc.Close()
+		}
+	}()
+	for i := 0; i < *conns; i++ {
+		cc, err := dial()
+		if err != nil {
+			return fmt.Errorf("failed to open connection %d: %v", i, err)
+		}
+		ccs = append(ccs, cc)
+	}
+
+	req, err := buildRequest(ccs[0])
+	if err != nil {
+		return err
+	}
+
+	b := &bench{
+		ccs:     ccs,
+		req:     req,
+		results: make(chan *workerResult, *concurrency),
+	}
+	res := b.run()
+	res.print(os.Stdout)
+	if *jsonOut != "" {
+		return res.writeJSON(*jsonOut)
+	}
+	return nil
+}
+
+func dial() (*network.ClientConn, error) {
+	opts := []network.DialOption{network.WithTimeout(*timeout)}
+	if discovery.IsZKTarget(*target) {
+		opts = append(opts, network.WithResolver(discovery.NewZKResolver(*timeout)))
+	}
+	if *token != "" {
+		opts = append(opts, network.WithAuthHandshaker(network.NewTokenClientHandshaker(uint32(*source), []byte(*token))))
+	}
+	return network.Dial(*target, opts...)
+}
+
+// buildRequest 按-type和-body构造压测使用的请求
+func buildRequest(cc *network.ClientConn) (*pb.BMessage, error) {
+	head := &pb.Head{Source: proto.Uint32(uint32(*source))}
+	var (
+		s   *dynamic.Schema
+		err error
+	)
+	if *protoFiles != "" {
+		s, err = dynamic.LoadLocalSchema(splitList(*protoPath), splitList(*protoFiles))
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		s, err = dynamic.LoadReflectionSchema(ctx, cc, head)
+		cancel()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the message definitions: %v", err)
+	}
+	mt, err := s.MessageType(*msgType)
+	if err != nil {
+		return nil, err
+	}
+	return s.NewRequest(head, mt, *body, *format)
+}
+
+// bench 为一次压测
+type bench struct {
+	ccs     []*network.ClientConn
+	req     *pb.BMessage
+	results chan *workerResult
+}
+
+// workerResult 为一个worker的统计，压测结束后汇总
+type workerResult struct {
+	latency  *histogram
+	retcodes map[string]int64 // 按retcode统计的请求数，没有收到响应的记为retcodeError
+	requests int64
+}
+
+// 没有收到响应(如超时、连接断开)的请求的retcode
+const retcodeError = "error"
+
+func (b *bench) run() *result {
+	deadline := time.Now().Add(*duration)
+	// 开环模式下由调度器按固定速率下发计划发送的时间，worker从计划时间开始计算延迟
+	var schedule chan time.Time
+	if *qps > 0 {
+		schedule = make(chan time.Time, *concurrency)
+		go b.schedule(schedule, deadline)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b.results <- b.work(b.ccs[i%len(b.ccs)], schedule, deadline)
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(b.results)
+
+	total := &workerResult{latency: newHistogram(), retcodes: make(map[string]int64)}
+	for r := range b.results {
+		total.latency.merge(r.latency)
+		for rc, n := range r.retcodes {
+			total.retcodes[rc] += n
+		}
+		total.requests += r.requests
+	}
+	return newResult(total, elapsed)
+}
+
+// schedule 按-qps的速率生成每个请求的计划发送时间，直到deadline
+func (b *bench) schedule(ch chan<- time.Time, deadline time.Time) {
+	defer close(ch)
+	interval := time.Duration(float64(time.Second) / *qps)
+	next := time.Now()
+	for next.Before(deadline) {
+		if d := time.Until(next); d > 0 {
+			time.Sleep(d)
+		}
+		// 所有worker都在等待响应时阻塞，积压的请求在worker空闲后立即发出
+		ch <- next
+		next = next.Add(interval)
+	}
+}
+
+func (b *bench) work(cc *network.ClientConn, schedule <-chan time.Time, deadline time.Time) *workerResult {
+	r := &workerResult{latency: newHistogram(), retcodes: make(map[string]int64)}
+	for {
+		var start time.Time
+		if schedule != nil {
+			t, ok := <-schedule
+			if !ok {
+				return r
+			}
+			start = t
+		} else {
+			start = time.Now()
+			if !start.Before(deadline) {
+				return r
+			}
+		}
+
+		// 每个请求使用新的session_no
+		req := &pb.BMessage{
+			Head: proto.Clone(b.req.GetHead()).(*pb.Head),
+			Body: b.req.GetBody(),
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		resp, err := cc.Invoke(ctx, req)
+		cancel()
+		r.latency.record(time.Since(start))
+		r.requests++
+		if err != nil {
+			r.retcodes[retcodeError]++
+		} else {
+			r.retcodes[strconv.Itoa(int(message.GetResponseCode(resp).GetRetcode()))]++
+		}
+	}
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+func writeFile(path string, data []byte) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// result 为压测的结果，以JSON输出以便比较多次压测
+type result struct {
+	Target      string           `json:"target"`
+	MessageType string           `json:"message_type"`
+	Mode        string           `json:"mode"` // open_loop或closed_loop
+	Conns       int              `json:"conns"`
+	Concurrency int              `json:"concurrency"`
+	TargetQPS   float64          `json:"target_qps,omitempty"`
+	Duration    float64          `json:"duration_seconds"`
+	Requests    int64            `json:"requests"`
+	Errors      int64            `json:"errors"` // retcode不为0或没有收到响应的请求数
+	Throughput  float64          `json:"throughput_qps"`
+	Retcodes    map[string]int64 `json:"retcodes"`
+	Latency     latencyResult    `json:"latency_ms"`
+}
+
+type latencyResult struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p999"`
+	Max  float64 `json:"max"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func newResult(total *workerResult, elapsed time.Duration) *result {
+	r := &result{
+		Target:      *target,
+		MessageType: *msgType,
+		Mode:        "closed_loop",
+		Conns:       *conns,
+		Concurrency: *concurrency,
+		Duration:    elapsed.Seconds(),
+		Requests:    total.requests,
+		Retcodes:    total.retcodes,
+		Latency: latencyResult{
+			Min:  ms(total.latency.minimum()),
+			Mean: ms(total.latency.mean()),
+			P50:  ms(total.latency.quantile(0.5)),
+			P90:  ms(total.latency.quantile(0.9)),
+			P99:  ms(total.latency.quantile(0.99)),
+			P999: ms(total.latency.quantile(0.999)),
+			Max:  ms(total.latency.maximum()),
+		},
+	}
+	if *qps > 0 {
+		r.Mode = "open_loop"
+		r.TargetQPS = *qps
+	}
+	if elapsed > 0 {
+		r.Throughput = float64(total.requests) / elapsed.Seconds()
+	}
+	for rc, n := range total.retcodes {
+		if rc != "0" {
+			r.Errors += n
+		}
+	}
+	return r
+}
+
+func (r *result) print(w io.Writer) {
+	fmt.Fprintf(w, "target:       %s\n", r.Target)
+	fmt.Fprintf(w, "message type: %s\n", r.MessageType)
+	if r.TargetQPS > 0 {
+		fmt.Fprintf(w, "mode:         open loop at %.0f qps, %d connections, at most %d in flight\n", r.TargetQPS, r.Conns, r.Concurrency)
+	} else {
+		fmt.Fprintf(w, "mode:         closed loop, %d connections, %d workers\n", r.Conns, r.Concurrency)
+	}
+	fmt.Fprintf(w, "duration:     %.2fs\n", r.Duration)
+	fmt.Fprintf(w, "requests:     %d (%.1f qps)\n", r.Requests, r.Throughput)
+	fmt.Fprintf(w, "errors:       %d\n", r.Errors)
+
+	rcs := make([]string, 0, len(r.Retcodes))
+	for rc := range r.Retcodes {
+		rcs = append(rcs, rc)
+	}
+	sort.Strings(rcs)
+	for _, rc := range rcs {
+		fmt.Fprintf(w, "  retcode %-8s %d\n", rc+":", r.Retcodes[rc])
+	}
+
+	l := r.Latency
+	fmt.Fprintf(w, "latency (ms): min %.3f  mean %.3f  max %.3f\n", l.Min, l.Mean, l.Max)
+	fmt.Fprintf(w, "  p50 %.3f  p90 %.3f  p99 %.3f  p999 %.3f\n", l.P50, l.P90, l.P99, l.P999)
+}
+
+func (r *result) writeJSON(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(b, '\n'))
+}
@@ -0,0 +1,136 @@
+/*
+bgcheck checks the message type and error code ranges declared by all the .proto
+files in a directory. Every service must declare BEGINNING_ID and ENDING_ID in its
+MessageType enum, its message types, Body extensions and error codes must be in its
+ranges, the ranges of different services must not overlap, and a file named like
+service1.1000.2000.proto must declare the range [1000, 2000).
+
+	bgcheck -dir src/bgserver/message/proto
+
+It needs protoc in PATH and exits with a non-zero status if any check fails.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"bgserver/message/msgrange"
+)
+
+var (
+	dir = flag.String("dir", ".", "the directory of the .proto files to check")
+)
+
+func main() {
+	flag.Parse()
+	problems, err := check(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bgcheck:", err)
+		os.Exit(2)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// check 返回dir中所有.proto文件的问题
+func check(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.proto"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .proto file in %s", dir)
+	}
+	for i, f := range files {
+		files[i] = filepath.Base(f)
+	}
+	set, err := compile(dir, files)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	registry := msgrange.NewRangeRegistry()
+	inDir := make(map[string]bool)
+	for _, f := range files {
+		inDir[f] = true
+	}
+	for _, fd := range set.GetFile() {
+		if !inDir[fd.GetName()] {
+			continue
+		}
+		spec, err := msgrange.ServiceSpecFromFile(fd)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if spec == nil {
+			continue
+		}
+		if err := registry.Register(spec); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", fd.GetName(), err))
+		}
+		if p := checkFileName(fd.GetName(), spec); p != "" {
+			problems = append(problems, p)
+		}
+	}
+	return problems, nil
+}
+
+// checkFileName 检查形如name.begin.end.proto的文件名与声明的消息类型范围是否一致
+func checkFileName(name string, spec *msgrange.ServiceSpec) string {
+	parts := strings.Split(strings.TrimSuffix(name, ".proto"), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	begin, err1 := strconv.Atoi(parts[1])
+	end, err2 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil {
+		return ""
+	}
+	if int32(begin) != spec.MessageTypes.Begin || int32(end) != spec.MessageTypes.End {
+		return fmt.Sprintf("%s: the file name says [%d, %d) but MessageType declares %v",
+			name, begin, end, spec.MessageTypes)
+	}
+	return ""
+}
+
+// compile 调用protoc将files编译为FileDescriptorSet
+func compile(dir string, files []string) (*dpb.FileDescriptorSet, error) {
+	out, err := ioutil.TempFile("", "bgcheck")
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	args := append([]string{"-I", dir, "--include_imports", "--descriptor_set_out=" + out.Name()}, files...)
+	cmd := exec.Command("protoc", args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("protoc failed: %v", err)
+	}
+	b, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		return nil, err
+	}
+	set := new(dpb.FileDescriptorSet)
+	if err := proto.Unmarshal(b, set); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
@@ -0,0 +1,155 @@
+/*
+bgcli sends an arbitrary BMessage to a bgserver service and prints the response.
+
+	bgcli -target 127.0.0.1:8080 -type SAY_HELLO_REQUEST \
+		-proto_path ../bgserver/message/proto -proto service1.1000.2000.proto \
+		-body 'person: 1 bless_message: "hi"'
+
+The body is in the protobuf text format, or JSON with -format json. Without
+-proto the message definitions are fetched from the server by reflection,
+which requires the server to be started with network.Reflection().
+
+	bgcli -target zk://172.16.130.1:2181/services/service1 -ping 10
+
+sends 10 heartbeats and reports the round-trip times.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"bgserver/discovery"
+	"bgserver/message/dynamic"
+	pb "bgserver/message/proto/golang"
+	"bgserver/network"
+)
+
+var (
+	target     = flag.String("target", "127.0.0.1:8080", "host:port, a comma-separated list of them, or zk://zkhosts/path")
+	msgType    = flag.String("type", "", "the message type to send, by name (e.g. SAY_HELLO_REQUEST) or number")
+	body       = flag.String("body", "", "the body of the message, in the format given by -format; read from stdin if it is -")
+	format     = flag.String("format", "text", "the format of -body and of the printed response: text or json")
+	protoPath  = flag.String("proto_path", ".", "comma-separated directories to search for the -proto files")
+	protoFiles = flag.String("proto", "", "comma-separated .proto files defining the messages, use server reflection if empty")
+	source     = flag.Uint("source", 0, "Head.source of the message")
+	dest       = flag.Uint("dest", 0, "Head.dest of the message")
+	token      = flag.String("token", "", "authenticate with this token")
+	hmacKey    = flag.String("hmac_key", "", "authenticate with this HMAC key")
+	timeout    = flag.Duration("timeout", 5*time.Second, "timeout of connecting and of every call")
+	ping       = flag.Int("ping", 0, "send this many heartbeats and report the round-trip times instead of sending -type")
+	interval   = flag.Duration("interval", time.Second, "the interval between heartbeats")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "bgcli:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *format != dynamic.FormatText && *format != dynamic.FormatJSON {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if *ping <= 0 && *msgType == "" {
+		return fmt.Errorf("either -type or -ping is required")
+	}
+	cc, err := dial()
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	head := &pb.Head{
+		Source: proto.Uint32(uint32(*source)),
+		Dest:   proto.Uint32(uint32(*dest)),
+	}
+	if *ping > 0 {
+		return pingLoop(cc, head)
+	}
+	return call(cc, head)
+}
+
+func dial() (*network.ClientConn, error) {
+	opts := []network.DialOption{network.WithTimeout(*timeout)}
+	if discovery.IsZKTarget(*target) {
+		opts = append(opts, network.WithResolver(discovery.NewZKResolver(*timeout)))
+	}
+	switch {
+	case *token != "":
+		opts = append(opts, network.WithAuthHandshaker(network.NewTokenClientHandshaker(uint32(*source), []byte(*token))))
+	case *hmacKey != "":
+		opts = append(opts, network.WithAuthHandshaker(network.NewHMACClientHandshaker(uint32(*source), []byte(*hmacKey))))
+	}
+	return network.Dial(*target, opts...)
+}
+
+// call 按-type和-body构造请求，发送后打印响应
+func call(cc *network.ClientConn, head *pb.Head) error {
+	var (
+		s   *dynamic.Schema
+		err error
+	)
+	if *protoFiles != "" {
+		s, err = dynamic.LoadLocalSchema(splitList(*protoPath), splitList(*protoFiles))
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		s, err = dynamic.LoadReflectionSchema(ctx, cc, head)
+		cancel()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load the message definitions: %v", err)
+	}
+
+	mt, err := s.MessageType(*msgType)
+	if err != nil {
+		return err
+	}
+	text := *body
+	if text == "-" {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		text = string(b)
+	}
+	req, err := s.NewRequest(head, mt, text, *format)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	start := time.Now()
+	resp, err := cc.Invoke(ctx, req)
+	if err != nil {
+		return err
+	}
+	rtt := time.Since(start)
+	out, err := s.FormatResponse(resp, *format)
+	if err != nil {
+		return err
+	}
+	fmt.Print(out)
+	fmt.Fprintf(os.Stderr, "took %v\n", rtt)
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
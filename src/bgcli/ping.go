@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"bgserver/message"
+	pb "bgserver/message/proto/golang"
+	"bgserver/network"
+)
+
+// pingLoop 每隔-interval发送一次心跳，共发送-ping次，最后打印往返时间的统计
+func pingLoop(cc *network.ClientConn, head *pb.Head) error {
+	var (
+		received      int
+		min, max, sum time.Duration
+	)
+	for seq := 1; seq <= *ping; seq++ {
+		if seq > 1 {
+			time.Sleep(*interval)
+		}
+		req := &pb.BMessage{
+			Head: proto.Clone(head).(*pb.Head),
+			Body: &pb.Body{
+				HeartBeatRequest: &pb.HeartBeatRequest{
+					Payload: [][]byte{[]byte(fmt.Sprint(seq))},
+				},
+			},
+		}
+		req.Head.MessageType = proto.Int32(int32(pb.MessageType_HEART_BEAT_REQUEST))
+
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		start := time.Now()
+		resp, err := cc.Invoke(ctx, req)
+		rtt := time.Since(start)
+		cancel()
+		if err != nil {
+			fmt.Printf("seq=%d error: %v\n", seq, err)
+			continue
+		}
+		if rc := message.GetResponseCode(resp); rc.GetRetcode() != 0 {
+			fmt.Printf("seq=%d rtt=%v retcode=%d %s\n", seq, rtt, rc.GetRetcode(), rc.GetErrorMessage())
+		} else {
+			fmt.Printf("seq=%d rtt=%v\n", seq, rtt)
+		}
+		received++
+		sum += rtt
+		if min == 0 || rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+	}
+
+	fmt.Printf("--- %s ---\n", *target)
+	fmt.Printf("%d heartbeats sent, %d answered, %.1f%% lost\n",
+		*ping, received, float64(*ping-received)*100/float64(*ping))
+	if received > 0 {
+		fmt.Printf("rtt min/avg/max = %v/%v/%v\n", min, sum/time.Duration(received), max)
+	}
+	if received == 0 {
+		return fmt.Errorf("no heartbeat is answered")
+	}
+	return nil
+}
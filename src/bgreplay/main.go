@@ -0,0 +1,200 @@
+/*
+bgreplay resends the requests recorded in capture files (see network.NewCapture)
+to a bgserver service and compares the responses with the recorded ones.
+
+	bgreplay -target 127.0.0.1:9090 -speed 10 capture.bin capture.bin.20161201-150405.gz
+
+With -side server (the default) the capture is assumed to be taken by a server:
+the inbound frames are the requests and the outbound frames the responses. With
+-side client it is the other way around. The requests are sent at the recorded
+pace multiplied by -speed, or back to back with -speed 0. A response differing
+from the recorded one in its message type, retcode or body is printed, and the
+exit status is 1 if any differs.
+*/
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"bgserver/discovery"
+	"bgserver/message"
+	pb "bgserver/message/proto/golang"
+	"bgserver/network"
+)
+
+var (
+	target     = flag.String("target", "127.0.0.1:8080", "host:port, a comma-separated list of them, or zk://zkhosts/path")
+	side       = flag.String("side", "server", "the side that took the capture: server or client")
+	speed      = flag.Float64("speed", 1, "replay at this multiple of the recorded pace, as fast as possible if 0")
+	connID     = flag.Uint64("conn", 0, "replay only the requests of this connection id, all if 0")
+	heartbeats = flag.Bool("heartbeats", false, "also replay the heartbeats")
+	source     = flag.Uint("source", 0, "authenticate as this Head.source with -token or -hmac_key")
+	token      = flag.String("token", "", "authenticate with this token")
+	hmacKey    = flag.String("hmac_key", "", "authenticate with this HMAC key")
+	timeout    = flag.Duration("timeout", 5*time.Second, "timeout of connecting and of every request")
+	verbose    = flag.Bool("v", false, "also print the matching responses")
+	maxFrame   = flag.Int("max_frame_size", 0, "largest frame payload to read from the captures and the target, 16MiB if 0")
+)
+
+func main() {
+	flag.Parse()
+	ok, err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bgreplay:", err)
+		os.Exit(2)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func run() (bool, error) {
+	if flag.NArg() == 0 {
+		return false, fmt.Errorf("no capture file given")
+	}
+	reqDir, respDir := network.CaptureIn, network.CaptureOut
+	switch *side {
+	case "server":
+	case "client":
+		reqDir, respDir = respDir, reqDir
+	default:
+		return false, fmt.Errorf("unknown side %q", *side)
+	}
+	calls, err := load(flag.Args(), reqDir, respDir)
+	if err != nil {
+		return false, err
+	}
+	if len(calls) == 0 {
+		return false, fmt.Errorf("no request to replay")
+	}
+
+	cc, err := dial()
+	if err != nil {
+		return false, err
+	}
+	defer cc.Close()
+	r := replay(cc, calls)
+	r.print(os.Stdout)
+	return r.mismatched == 0 && r.failed == 0, nil
+}
+
+func dial() (*network.ClientConn, error) {
+	opts := []network.DialOption{network.WithTimeout(*timeout), network.WithMaxFrameSize(*maxFrame)}
+	if discovery.IsZKTarget(*target) {
+		opts = append(opts, network.WithResolver(discovery.NewZKResolver(*timeout)))
+	}
+	switch {
+	case *token != "":
+		opts = append(opts, network.WithAuthHandshaker(network.NewTokenClientHandshaker(uint32(*source), []byte(*token))))
+	case *hmacKey != "":
+		opts = append(opts, network.WithAuthHandshaker(network.NewHMACClientHandshaker(uint32(*source), []byte(*hmacKey))))
+	}
+	return network.Dial(*target, opts...)
+}
+
+// call 为捕获中的一次请求及其响应，没有捕获到响应时resp为nil
+type call struct {
+	at     time.Time
+	connID uint64
+	req    *pb.BMessage
+	resp   *pb.BMessage
+}
+
+type callKey struct {
+	connID    uint64
+	sessionNo string
+}
+
+// load 读取所有捕获文件，按时间顺序返回其中的请求，并以连接编号和session_no找到对应的响应
+func load(files []string, reqDir, respDir network.CaptureDirection) ([]*call, error) {
+	var recs []*network.CaptureRecord
+	for _, name := range files {
+		err := readCapture(name, func(rec *network.CaptureRecord) error {
+			if *connID == 0 || rec.ConnID == *connID {
+				recs = append(recs, rec)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 切分出的旧文件可能不按时间顺序给出
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].Time.Before(recs[j].Time) })
+
+	codec := message.NewProtoCodec()
+	var calls []*call
+	pending := make(map[callKey]*call)
+	for _, rec := range recs {
+		m, err := network.DecodeFrame(codec, rec.Frame)
+		if err != nil {
+			return nil, fmt.Errorf("conn %d at %v: %v", rec.ConnID, rec.Time.Format(time.RFC3339Nano), err)
+		}
+		key := callKey{rec.ConnID, m.GetHead().GetSessionNo()}
+		switch rec.Direction {
+		case reqDir:
+			if !replayable(m.GetHead().GetMessageType()) {
+				continue
+			}
+			c := &call{at: rec.Time, connID: rec.ConnID, req: m}
+			calls = append(calls, c)
+			pending[key] = c
+		case respDir:
+			if c, ok := pending[key]; ok {
+				c.resp = m
+				delete(pending, key)
+			}
+		}
+	}
+	return calls, nil
+}
+
+// replayable 返回消息类型为mt的请求是否回放. 握手由回放使用的连接自己完成.
+func replayable(mt int32) bool {
+	switch pb.MessageType(mt) {
+	case pb.MessageType_HANDSHAKE_REQUEST:
+		return false
+	case pb.MessageType_HEART_BEAT_REQUEST:
+		return *heartbeats
+	}
+	return true
+}
+
+// readCapture 依次对捕获文件name中的每条记录调用f，文件名以.gz结尾时先解压
+func readCapture(name string, f func(*network.CaptureRecord) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	cr := network.NewCaptureReader(r)
+	cr.SetMaxFrameSize(*maxFrame)
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if err := f(rec); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"bgserver/message"
+	pb "bgserver/message/proto/golang"
+	"bgserver/network"
+)
+
+// result 为一次回放的结果
+type result struct {
+	mu         sync.Mutex
+	total      int
+	matched    int
+	mismatched int
+	unrecorded int // 捕获中没有响应，无法比较
+	failed     int // 发送失败或超时
+	elapsed    time.Duration
+}
+
+// replay 按捕获中的节奏发送所有请求，请求之间不等待响应
+func replay(cc *network.ClientConn, calls []*call) *result {
+	r := &result{total: len(calls)}
+	var wg sync.WaitGroup
+	start := time.Now()
+	first := calls[0].at
+	for _, c := range calls {
+		if *speed > 0 {
+			due := start.Add(time.Duration(float64(c.at.Sub(first)) / *speed))
+			if d := time.Until(due); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		wg.Add(1)
+		go func(c *call) {
+			defer wg.Done()
+			resp, err := send(cc, c)
+			r.check(c, resp, err)
+		}(c)
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+	return r
+}
+
+// send 发送c中的请求的副本. 清除session_no使其由Invoke重新生成，
+// 避免来自不同连接的相同session_no在同一个ClientConn上冲突. 指定了-source时
+// 用它替换捕获中的source，否则server会因与鉴权的source不一致而拒绝请求.
+func send(cc *network.ClientConn, c *call) (*pb.BMessage, error) {
+	req := proto.Clone(c.req).(*pb.BMessage)
+	req.Head.SessionNo = nil
+	if *source != 0 {
+		req.Head.Source = proto.Uint32(uint32(*source))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	return cc.Invoke(ctx, req)
+}
+
+// check 比较回放得到的响应和捕获的响应
+func (r *result) check(c *call, resp *pb.BMessage, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name := pb.MessageType(c.req.GetHead().GetMessageType())
+	switch {
+	case err != nil:
+		r.failed++
+		fmt.Printf("FAIL %v (conn %d, session %s at %v): %v\n",
+			name, c.connID, c.req.GetHead().GetSessionNo(), c.at.Format(time.RFC3339Nano), err)
+	case c.resp == nil:
+		r.unrecorded++
+	case message.SameResponse(c.resp, resp):
+		r.matched++
+		if *verbose {
+			fmt.Printf("OK   %v (conn %d, session %s)\n", name, c.connID, c.req.GetHead().GetSessionNo())
+		}
+	default:
+		r.mismatched++
+		fmt.Printf("DIFF %v (conn %d, session %s at %v)\n  recorded: %s\n  replayed: %s\n",
+			name, c.connID, c.req.GetHead().GetSessionNo(), c.at.Format(time.RFC3339Nano),
+			describe(c.resp), describe(resp))
+	}
+}
+
+func describe(m *pb.BMessage) string {
+	return fmt.Sprintf("type=%v rc={%s} body={%s}", pb.MessageType(m.GetHead().GetMessageType()),
+		proto.CompactTextString(message.GetResponseCode(m)), proto.CompactTextString(m.GetBody()))
+}
+
+func (r *result) print(w io.Writer) {
+	fmt.Fprintf(w, "replayed %d requests in %v: %d matched, %d differed, %d without a recorded response, %d failed\n",
+		r.total, r.elapsed, r.matched, r.mismatched, r.unrecorded, r.failed)
+}
@@ -1,24 +1,15 @@
-package message
+package common
 
 import (
-    "bytes"
+	"bytes"
+	"compress/flate"
 	"compress/gzip"
-	"encoding/binary"
+	"compress/zlib"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"math"
-	"math/rand"
-	"os"
-	"time"
-)
-
-
-type payloadFormat uint
-
-const (
-    compressionNone payloadFormat = iota // no compression
-	compressionMade
+	"sort"
+	"sync"
 )
 
 // Compressor defines the interface used to compress a message.
@@ -27,16 +18,35 @@ type Compressor interface {
 	Type() string		// Type returns the compression algorithm the Compressor uses.
 }
 
-// NewGZIPCompressor creates a Compressor based on GZIP.
+// NewGZIPCompressor creates a Compressor based on GZIP with the default compression level.
 func NewGZIPCompressor() Compressor {
-	return &gzipCompressor{}
+	c, _ := NewGZIPCompressorWithLevel(gzip.DefaultCompression)
+	return c
+}
+
+// NewGZIPCompressorWithLevel creates a Compressor based on GZIP with the given
+// compression level, from gzip.HuffmanOnly to gzip.BestCompression.
+// The gzip.Writers are reused across messages.
+func NewGZIPCompressorWithLevel(level int) (Compressor, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("bgserver: invalid gzip compression level %d", level)
+	}
+	return &gzipCompressor{level: level}, nil
 }
 
 type gzipCompressor struct {
+	level int
+	pool  sync.Pool // *gzip.Writer
 }
 
 func (c *gzipCompressor) Do(w io.Writer, p []byte) error {
-	z := gzip.NewWriter(w)
+	z, ok := c.pool.Get().(*gzip.Writer)
+	if ok {
+		z.Reset(w)
+	} else {
+		z, _ = gzip.NewWriterLevel(w, c.level)
+	}
+	defer c.pool.Put(z)
 	if _, err := z.Write(p); err != nil {
 		return err
 	}
@@ -49,8 +59,10 @@ func (c *gzipCompressor) Type() string {
 
 // Decompressor defines the interface used to decompress a message.
 type Decompressor interface {
-	// Do reads the data from r and uncompress them.
-	Do(r io.Reader) ([]byte, error)
+	// Do reads the data from r and uncompress them. It stops and returns
+	// ErrDecompressedTooLarge once the uncompressed data exceed maxSize bytes;
+	// maxSize <= 0 means no limit and is only for trusted data.
+	Do(r io.Reader, maxSize int) ([]byte, error)
 	// Type returns the compression algorithm the Decompressor uses.
 	Type() string
 }
@@ -59,19 +71,315 @@ type gzipDecompressor struct {
 }
 
 // NewGZIPDecompressor creates a Decompressor based on GZIP.
+// The gzip.Readers are reused across messages.
 func NewGZIPDecompressor() Decompressor {
 	return &gzipDecompressor{}
 }
 
-func (d *gzipDecompressor) Do(r io.Reader) ([]byte, error) {
-	z, err := gzip.NewReader(r)
-	if err != nil {
-		return nil, err
+var gzipReaderPool sync.Pool // *gzip.Reader
+
+func (d *gzipDecompressor) Do(r io.Reader, maxSize int) ([]byte, error) {
+	z, ok := gzipReaderPool.Get().(*gzip.Reader)
+	if ok {
+		if err := z.Reset(r); err != nil {
+			gzipReaderPool.Put(z)
+			return nil, err
+		}
+	} else {
+		var err error
+		if z, err = gzip.NewReader(r); err != nil {
+			return nil, err
+		}
 	}
-	defer z.Close()
-	return ioutil.ReadAll(z)
+	defer gzipReaderPool.Put(z)
+	return readAllLimited(z, maxSize)
 }
 
 func (d *gzipDecompressor) Type() string {
 	return "gzip"
 }
+
+// NewDeflateCompressor creates a Compressor based on raw DEFLATE with the default compression level.
+func NewDeflateCompressor() Compressor {
+	c, _ := NewDeflateCompressorWithLevel(flate.DefaultCompression)
+	return c
+}
+
+// NewDeflateCompressorWithLevel creates a Compressor based on raw DEFLATE with the
+// given compression level, from flate.HuffmanOnly to flate.BestCompression.
+// The flate.Writers are reused across messages.
+func NewDeflateCompressorWithLevel(level int) (Compressor, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("bgserver: invalid deflate compression level %d", level)
+	}
+	return &deflateCompressor{level: level}, nil
+}
+
+type deflateCompressor struct {
+	level int
+	pool  sync.Pool // *flate.Writer
+}
+
+func (c *deflateCompressor) Do(w io.Writer, p []byte) error {
+	z, ok := c.pool.Get().(*flate.Writer)
+	if ok {
+		z.Reset(w)
+	} else {
+		var err error
+		if z, err = flate.NewWriter(w, c.level); err != nil {
+			return err
+		}
+	}
+	defer c.pool.Put(z)
+	if _, err := z.Write(p); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+func (c *deflateCompressor) Type() string {
+	return "deflate"
+}
+
+// NewDeflateDecompressor creates a Decompressor based on raw DEFLATE.
+// The flate readers are reused across messages.
+func NewDeflateDecompressor() Decompressor {
+	return &deflateDecompressor{}
+}
+
+type deflateDecompressor struct {
+}
+
+var flateReaderPool sync.Pool // io.ReadCloser implementing flate.Resetter
+
+func (d *deflateDecompressor) Do(r io.Reader, maxSize int) ([]byte, error) {
+	z, ok := flateReaderPool.Get().(io.ReadCloser)
+	if ok {
+		if err := z.(flate.Resetter).Reset(r, nil); err != nil {
+			flateReaderPool.Put(z)
+			return nil, err
+		}
+	} else {
+		z = flate.NewReader(r)
+	}
+	defer flateReaderPool.Put(z)
+	return readAllLimited(z, maxSize)
+}
+
+func (d *deflateDecompressor) Type() string {
+	return "deflate"
+}
+
+// NewZlibCompressor creates a Compressor based on ZLIB with the default compression level.
+func NewZlibCompressor() Compressor {
+	c, _ := NewZlibCompressorWithLevel(zlib.DefaultCompression)
+	return c
+}
+
+// NewZlibCompressorWithLevel creates a Compressor based on ZLIB with the given
+// compression level, from zlib.HuffmanOnly to zlib.BestCompression.
+// The zlib.Writers are reused across messages.
+func NewZlibCompressorWithLevel(level int) (Compressor, error) {
+	if level < zlib.HuffmanOnly || level > zlib.BestCompression {
+		return nil, fmt.Errorf("bgserver: invalid zlib compression level %d", level)
+	}
+	return &zlibCompressor{level: level}, nil
+}
+
+type zlibCompressor struct {
+	level int
+	pool  sync.Pool // *zlib.Writer
+}
+
+func (c *zlibCompressor) Do(w io.Writer, p []byte) error {
+	z, ok := c.pool.Get().(*zlib.Writer)
+	if ok {
+		z.Reset(w)
+	} else {
+		var err error
+		if z, err = zlib.NewWriterLevel(w, c.level); err != nil {
+			return err
+		}
+	}
+	defer c.pool.Put(z)
+	if _, err := z.Write(p); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+func (c *zlibCompressor) Type() string {
+	return "zlib"
+}
+
+// NewZlibDecompressor creates a Decompressor based on ZLIB.
+// The zlib readers are reused across messages.
+func NewZlibDecompressor() Decompressor {
+	return &zlibDecompressor{}
+}
+
+type zlibDecompressor struct {
+}
+
+var zlibReaderPool sync.Pool // io.ReadCloser implementing zlib.Resetter
+
+func (d *zlibDecompressor) Do(r io.Reader, maxSize int) ([]byte, error) {
+	z, ok := zlibReaderPool.Get().(io.ReadCloser)
+	if ok {
+		if err := z.(zlib.Resetter).Reset(r, nil); err != nil {
+			zlibReaderPool.Put(z)
+			return nil, err
+		}
+	} else {
+		var err error
+		if z, err = zlib.NewReader(r); err != nil {
+			return nil, err
+		}
+	}
+	defer zlibReaderPool.Put(z)
+	return readAllLimited(z, maxSize)
+}
+
+func (d *zlibDecompressor) Type() string {
+	return "zlib"
+}
+
+// DefaultMaxDecompressedSize 为一条消息解压后的默认大小上限
+const DefaultMaxDecompressedSize = 16 << 20
+
+var ErrDecompressedTooLarge = errors.New("bgserver: the decompressed message exceeds the size limit")
+
+// 解压时使用的缓冲区，超过maxPooledBufferSize的缓冲区不放回池中，避免长期占用内存
+const maxPooledBufferSize = 1 << 20
+
+var decompressBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// readAllLimited 将r中的数据读入池化的缓冲区，读到的数据超过maxSize字节时立即停止并
+// 返回ErrDecompressedTooLarge. 返回的切片为新分配的，与缓冲区无关.
+func readAllLimited(r io.Reader, maxSize int) ([]byte, error) {
+	buf := decompressBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBufferSize {
+			decompressBufferPool.Put(buf)
+		}
+	}()
+	if maxSize > 0 {
+		// 多读一个字节以区分恰好达到上限和超过上限
+		r = io.LimitReader(r, int64(maxSize)+1)
+	}
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && buf.Len() > maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// 压缩算法的编号，写在帧头flags字节的低4位，0表示没有压缩.
+// gzip的编号为1，与旧版本只表示"已压缩"的标记兼容.
+const (
+	CompressionNone    uint8 = 0
+	CompressionGzip    uint8 = 1
+	CompressionDeflate uint8 = 2
+	CompressionZlib    uint8 = 3
+	CompressionLZ      uint8 = 4
+
+	MaxCompressionID uint8 = 15
+)
+
+// compression 为注册的一种压缩算法
+type compression struct {
+	id uint8
+	cp Compressor
+	dc Decompressor
+}
+
+var (
+	compressionMu     sync.RWMutex
+	compressionByName = make(map[string]*compression)
+	compressionByID   = make(map[uint8]*compression)
+)
+
+func init() {
+	RegisterCompression(CompressionGzip, NewGZIPCompressor(), NewGZIPDecompressor())
+	RegisterCompression(CompressionDeflate, NewDeflateCompressor(), NewDeflateDecompressor())
+	RegisterCompression(CompressionZlib, NewZlibCompressor(), NewZlibDecompressor())
+	RegisterCompression(CompressionLZ, NewLZCompressor(), NewLZDecompressor())
+}
+
+// RegisterCompression registers a compression algorithm under the id written in
+// the frame flags. cp and dc must have the same Type, which is the name advertised
+// to the peer. Registering an algorithm again replaces it; it panics if id is out
+// of range or already used by another algorithm.
+func RegisterCompression(id uint8, cp Compressor, dc Decompressor) {
+	if id == CompressionNone || id > MaxCompressionID {
+		panic(fmt.Sprintf("bgserver: invalid compression id %d", id))
+	}
+	if cp.Type() != dc.Type() {
+		panic(fmt.Sprintf("bgserver: compressor %q and decompressor %q do not match", cp.Type(), dc.Type()))
+	}
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	if c, ok := compressionByID[id]; ok && c.cp.Type() != cp.Type() {
+		panic(fmt.Sprintf("bgserver: compression id %d is used by %q", id, c.cp.Type()))
+	}
+	if c, ok := compressionByName[cp.Type()]; ok {
+		delete(compressionByID, c.id)
+	}
+	c := &compression{id: id, cp: cp, dc: dc}
+	compressionByName[cp.Type()] = c
+	compressionByID[id] = c
+}
+
+// CompressionID returns the id of the registered compression algorithm name.
+func CompressionID(name string) (uint8, bool) {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+	if c, ok := compressionByName[name]; ok {
+		return c.id, true
+	}
+	return 0, false
+}
+
+// GetCompressor returns the Compressor of the registered compression algorithm name.
+func GetCompressor(name string) Compressor {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+	if c, ok := compressionByName[name]; ok {
+		return c.cp
+	}
+	return nil
+}
+
+// GetDecompressor returns the Decompressor of the registered compression algorithm name.
+func GetDecompressor(name string) Decompressor {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+	if c, ok := compressionByName[name]; ok {
+		return c.dc
+	}
+	return nil
+}
+
+// RegisteredCompressions returns the names of all the registered compression
+// algorithms, ordered by their ids.
+func RegisteredCompressions() []string {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+	cs := make([]*compression, 0, len(compressionByID))
+	for _, c := range compressionByID {
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].id < cs[j].id })
+	names := make([]string, len(cs))
+	for i, c := range cs {
+		names[i] = c.cp.Type()
+	}
+	return names
+}
@@ -0,0 +1,226 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// testPayload 为可压缩的消息体，与线上常见的重复字段相近
+var testPayload = []byte(strings.Repeat(`{"ip":"172.16.130.1","port":8080,"weight":100}`, 64))
+
+func TestCompressionRoundTrip(t *testing.T) {
+	pairs := []struct {
+		cp Compressor
+		dc Decompressor
+	}{
+		{NewGZIPCompressor(), NewGZIPDecompressor()},
+		{NewDeflateCompressor(), NewDeflateDecompressor()},
+		{NewZlibCompressor(), NewZlibDecompressor()},
+	}
+	for _, p := range pairs {
+		// 多次压缩和解压，覆盖从池中取出并Reset的writer和reader
+		for i := 0; i < 3; i++ {
+			var buf bytes.Buffer
+			if err := p.cp.Do(&buf, testPayload); err != nil {
+				t.Fatalf("%s: compress: %v", p.cp.Type(), err)
+			}
+			if buf.Len() >= len(testPayload) {
+				t.Errorf("%s: compressed size %d is not smaller than %d", p.cp.Type(), buf.Len(), len(testPayload))
+			}
+			compressed := buf.Bytes()
+			got, err := p.dc.Do(bytes.NewReader(compressed), 0)
+			if err != nil {
+				t.Fatalf("%s: decompress: %v", p.dc.Type(), err)
+			}
+			if !bytes.Equal(got, testPayload) {
+				t.Fatalf("%s: round trip changed the data", p.cp.Type())
+			}
+			if _, err := p.dc.Do(bytes.NewReader(compressed), len(testPayload)-1); err != ErrDecompressedTooLarge {
+				t.Errorf("%s: decompress over the limit: got %v, want ErrDecompressedTooLarge", p.dc.Type(), err)
+			}
+			if _, err := p.dc.Do(bytes.NewReader(compressed), len(testPayload)); err != nil {
+				t.Errorf("%s: decompress at the limit: %v", p.dc.Type(), err)
+			}
+		}
+	}
+}
+
+// 解压后远超上限的数据(解压炸弹)在达到上限后即返回错误，不会被全部解压到内存中
+func TestDecompressionBomb(t *testing.T) {
+	const maxSize = 1 << 20
+	bomb := make([]byte, 16*maxSize)
+	for _, name := range RegisteredCompressions() {
+		var buf bytes.Buffer
+		if err := GetCompressor(name).Do(&buf, bomb); err != nil {
+			t.Fatalf("%s: compress: %v", name, err)
+		}
+		if buf.Len() >= maxSize {
+			t.Fatalf("%s: the bomb is compressed to %d bytes", name, buf.Len())
+		}
+		r := &countingReader{r: bytes.NewReader(buf.Bytes())}
+		if _, err := GetDecompressor(name).Do(r, maxSize); err != ErrDecompressedTooLarge {
+			t.Errorf("%s: got %v, want ErrDecompressedTooLarge", name, err)
+		}
+		// 流式的算法在解压到上限时停止读取
+		if name != "lz" && r.n >= buf.Len() {
+			t.Errorf("%s: read all %d compressed bytes", name, r.n)
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestCompressionLevel(t *testing.T) {
+	constructors := []struct {
+		name     string
+		new      func(int) (Compressor, error)
+		min, max int
+	}{
+		{"gzip", NewGZIPCompressorWithLevel, gzip.HuffmanOnly, gzip.BestCompression},
+		{"deflate", NewDeflateCompressorWithLevel, flate.HuffmanOnly, flate.BestCompression},
+		{"zlib", NewZlibCompressorWithLevel, zlib.HuffmanOnly, zlib.BestCompression},
+	}
+	for _, c := range constructors {
+		for level := c.min; level <= c.max; level++ {
+			if _, err := c.new(level); err != nil {
+				t.Errorf("%s: level %d: %v", c.name, level, err)
+			}
+		}
+		for _, level := range []int{c.min - 1, c.max + 1} {
+			if _, err := c.new(level); err == nil {
+				t.Errorf("%s: level %d is accepted", c.name, level)
+			}
+		}
+	}
+}
+
+// 不复用writer的压缩，作为池化压缩的对照
+func benchmarkUnpooled(b *testing.B, newWriter func(io.Writer) (io.WriteCloser, error)) {
+	b.SetBytes(int64(len(testPayload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		z, err := newWriter(ioutil.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+		z.Write(testPayload)
+		z.Close()
+	}
+}
+
+func benchmarkPooled(b *testing.B, cp Compressor) {
+	b.SetBytes(int64(len(testPayload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := cp.Do(ioutil.Discard, testPayload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGZIPCompressUnpooled(b *testing.B) {
+	benchmarkUnpooled(b, func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	})
+}
+
+func BenchmarkGZIPCompressPooled(b *testing.B) {
+	benchmarkPooled(b, NewGZIPCompressor())
+}
+
+func BenchmarkDeflateCompressUnpooled(b *testing.B) {
+	benchmarkUnpooled(b, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, flate.DefaultCompression)
+	})
+}
+
+func BenchmarkDeflateCompressPooled(b *testing.B) {
+	benchmarkPooled(b, NewDeflateCompressor())
+}
+
+func BenchmarkZlibCompressUnpooled(b *testing.B) {
+	benchmarkUnpooled(b, func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriterLevel(w, zlib.DefaultCompression)
+	})
+}
+
+func BenchmarkZlibCompressPooled(b *testing.B) {
+	benchmarkPooled(b, NewZlibCompressor())
+}
+
+// compressed 返回testPayload用cp压缩后的数据
+func compressed(b *testing.B, cp Compressor) []byte {
+	var buf bytes.Buffer
+	if err := cp.Do(&buf, testPayload); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func benchmarkDecompressUnpooled(b *testing.B, data []byte, newReader func(io.Reader) (io.ReadCloser, error)) {
+	b.SetBytes(int64(len(testPayload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		z, err := newReader(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(z); err != nil {
+			b.Fatal(err)
+		}
+		z.Close()
+	}
+}
+
+func benchmarkDecompressPooled(b *testing.B, data []byte, dc Decompressor) {
+	b.SetBytes(int64(len(testPayload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := dc.Do(bytes.NewReader(data), DefaultMaxDecompressedSize); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGZIPDecompressUnpooled(b *testing.B) {
+	benchmarkDecompressUnpooled(b, compressed(b, NewGZIPCompressor()), func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	})
+}
+
+func BenchmarkGZIPDecompressPooled(b *testing.B) {
+	benchmarkDecompressPooled(b, compressed(b, NewGZIPCompressor()), NewGZIPDecompressor())
+}
+
+func BenchmarkDeflateDecompressUnpooled(b *testing.B) {
+	benchmarkDecompressUnpooled(b, compressed(b, NewDeflateCompressor()), func(r io.Reader) (io.ReadCloser, error) {
+		return flate.NewReader(r), nil
+	})
+}
+
+func BenchmarkDeflateDecompressPooled(b *testing.B) {
+	benchmarkDecompressPooled(b, compressed(b, NewDeflateCompressor()), NewDeflateDecompressor())
+}
+
+func BenchmarkZlibDecompressUnpooled(b *testing.B) {
+	benchmarkDecompressUnpooled(b, compressed(b, NewZlibCompressor()), zlib.NewReader)
+}
+
+func BenchmarkZlibDecompressPooled(b *testing.B) {
+	benchmarkDecompressPooled(b, compressed(b, NewZlibCompressor()), NewZlibDecompressor())
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Level 为日志级别
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", l)
+	}
+}
+
+// ParseLevel 将debug、info、warn、error解析为对应的日志级别
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", s)
+}
+
+// Entry 为一条日志
+type Entry struct {
+	Time   time.Time
+	Level  Level
+	Msg    string
+	Fields []interface{} // 交替出现的key和value
+}
+
+func newEntry(level Level, msg string, fields, keysAndValues []interface{}) *Entry {
+	all := make([]interface{}, 0, len(fields)+len(keysAndValues)+1)
+	all = append(all, fields...)
+	all = append(all, keysAndValues...)
+	// 键值对不完整时补上一个空值，避免丢失最后一个key
+	if len(all)%2 != 0 {
+		all = append(all, nil)
+	}
+	return &Entry{
+		Time:   time.Now(),
+		Level:  level,
+		Msg:    msg,
+		Fields: all,
+	}
+}
+
+// Formatter 将一条日志格式化为一行输出(包含换行符)
+type Formatter interface {
+	Format(e *Entry) []byte
+}
+
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// TextFormatter 输出形如 `2016-12-01T10:00:00.000+08:00 INFO msg key=value` 的文本
+type TextFormatter struct{}
+
+func (TextFormatter) Format(e *Entry) []byte {
+	var b bytes.Buffer
+	b.WriteString(e.Time.Format(logTimeFormat))
+	b.WriteByte(' ')
+	b.WriteString(strings.ToUpper(e.Level.String()))
+	b.WriteByte(' ')
+	b.WriteString(e.Msg)
+	for i := 0; i < len(e.Fields); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(e.Fields[i]))
+		b.WriteByte('=')
+		v := fmt.Sprint(e.Fields[i+1])
+		if strings.ContainsAny(v, " \t\"=") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// JSONFormatter 每条日志输出一个JSON对象，包含time、level、msg以及所有的字段
+type JSONFormatter struct{}
+
+func (JSONFormatter) Format(e *Entry) []byte {
+	m := make(map[string]interface{}, len(e.Fields)/2+3)
+	for i := 0; i < len(e.Fields); i += 2 {
+		v := e.Fields[i+1]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		m[fmt.Sprint(e.Fields[i])] = v
+	}
+	m["time"] = e.Time.Format(logTimeFormat)
+	m["level"] = e.Level.String()
+	m["msg"] = e.Msg
+	b, err := json.Marshal(m)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{
+			"time":  m["time"],
+			"level": m["level"],
+			"msg":   e.Msg,
+			"error": "failed to marshal fields: " + err.Error(),
+		})
+	}
+	return append(b, '\n')
+}
+
+type loggerKey struct{}
+
+// NewLoggerContext returns a new context carrying l.
+func NewLoggerContext(ctx context.Context, l *LevelLogger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFromContext returns the logger in ctx, or the default LevelLogger if there is none.
+func LoggerFromContext(ctx context.Context) *LevelLogger {
+	if l, ok := ctx.Value(loggerKey{}).(*LevelLogger); ok {
+		return l
+	}
+	return std
+}
@@ -1,17 +1,23 @@
-/* 
-Use golang's standard logger by default.
-Access is not mutex-protected: do not modify except in init() functions.
+/*
+Leveled, structured logging for bgserver.
+
+By default everything is written in text format to stderr at InfoLevel.
+The Print* and Fatal* functions are kept for compatibility: Print* logs at
+InfoLevel and Fatal* logs at ErrorLevel before exiting. All the functions
+here, including SetLogger and SetLevel, are safe to call from any goroutine.
 */
 
 package common
 
 import (
-	"log"
+	"fmt"
+	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
-var logger Logger = log.New(os.Stderr, "", log.LstdFlags)
-
+// Logger is the minimal logger interface accepted by SetLogger.
 type Logger interface {
 	Fatal(args ...interface{})
 	Fatalf(format string, args ...interface{})
@@ -22,38 +28,218 @@ type Logger interface {
 	Println(args ...interface{})
 }
 
-// SetLogger sets the logger that is used in bgserver. 
-// Call only from init() functions.
+// LevelLogger 是带日志级别和键值对字段的logger.
+// 通过With创建的子logger携带父logger的所有字段，并与父logger共享输出和日志级别.
+type LevelLogger struct {
+	out    *logOutput
+	level  *int32
+	fields []interface{}
+}
+
+// logOutput 为一组LevelLogger共享的输出
+type logOutput struct {
+	mu        sync.Mutex
+	w         io.Writer
+	formatter Formatter
+}
+
+// NewLevelLogger creates a LevelLogger writing entries at or above level to w.
+func NewLevelLogger(w io.Writer, f Formatter, level Level) *LevelLogger {
+	lv := int32(level)
+	return &LevelLogger{
+		out:   &logOutput{w: w, formatter: f},
+		level: &lv,
+	}
+}
+
+// With returns a child logger that adds the key-value pairs to every entry.
+func (l *LevelLogger) With(keysAndValues ...interface{}) *LevelLogger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keysAndValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keysAndValues...)
+	return &LevelLogger{
+		out:    l.out,
+		level:  l.level,
+		fields: fields,
+	}
+}
+
+// SetLevel changes the level of the logger, its parent and all its children.
+func (l *LevelLogger) SetLevel(level Level) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+// Level returns the current level of the logger.
+func (l *LevelLogger) Level() Level {
+	return Level(atomic.LoadInt32(l.level))
+}
+
+// Enabled reports whether entries at level are written.
+func (l *LevelLogger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// SetOutput changes the writer of the logger, its parent and all its children.
+func (l *LevelLogger) SetOutput(w io.Writer) {
+	l.out.mu.Lock()
+	l.out.w = w
+	l.out.mu.Unlock()
+}
+
+// SetFormatter changes the formatter of the logger, its parent and all its children.
+func (l *LevelLogger) SetFormatter(f Formatter) {
+	l.out.mu.Lock()
+	l.out.formatter = f
+	l.out.mu.Unlock()
+}
+
+func (l *LevelLogger) log(level Level, msg string, keysAndValues []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	e := newEntry(level, msg, l.fields, keysAndValues)
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(l.out.formatter.Format(e))
+}
+
+// Debug logs msg at DebugLevel with the given key-value pairs.
+func (l *LevelLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log(DebugLevel, msg, keysAndValues)
+}
+
+// Info logs msg at InfoLevel with the given key-value pairs.
+func (l *LevelLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(InfoLevel, msg, keysAndValues)
+}
+
+// Warn logs msg at WarnLevel with the given key-value pairs.
+func (l *LevelLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log(WarnLevel, msg, keysAndValues)
+}
+
+// Error logs msg at ErrorLevel with the given key-value pairs.
+func (l *LevelLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.log(ErrorLevel, msg, keysAndValues)
+}
+
+// The following methods make LevelLogger a Logger.
+
+func (l *LevelLogger) Fatal(args ...interface{}) {
+	l.log(ErrorLevel, fmt.Sprint(args...), nil)
+	os.Exit(1)
+}
+
+func (l *LevelLogger) Fatalf(format string, args ...interface{}) {
+	l.log(ErrorLevel, fmt.Sprintf(format, args...), nil)
+	os.Exit(1)
+}
+
+func (l *LevelLogger) Fatalln(args ...interface{}) {
+	l.log(ErrorLevel, sprintln(args...), nil)
+	os.Exit(1)
+}
+
+func (l *LevelLogger) Print(args ...interface{}) {
+	l.log(InfoLevel, fmt.Sprint(args...), nil)
+}
+
+func (l *LevelLogger) Printf(format string, args ...interface{}) {
+	l.log(InfoLevel, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *LevelLogger) Println(args ...interface{}) {
+	l.log(InfoLevel, sprintln(args...), nil)
+}
+
+// sprintln 与fmt.Sprintln相同，但去掉末尾的换行符
+func sprintln(args ...interface{}) string {
+	s := fmt.Sprintln(args...)
+	return s[:len(s)-1]
+}
+
+var (
+	std = NewLevelLogger(os.Stderr, TextFormatter{}, InfoLevel)
+
+	loggerMu sync.RWMutex
+	logger   Logger = std
+)
+
+// L returns the default LevelLogger of bgserver.
+func L() *LevelLogger {
+	return std
+}
+
+// SetLogger sets the logger used by the Print* and Fatal* functions.
+// The leveled functions such as Info keep using the default LevelLogger.
 func SetLogger(l Logger) {
+	loggerMu.Lock()
 	logger = l
+	loggerMu.Unlock()
+}
+
+func getLogger() Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	return logger
+}
+
+// SetLevel changes the level of the default LevelLogger and all its children.
+func SetLevel(level Level) {
+	std.SetLevel(level)
+}
+
+// With returns a child of the default LevelLogger carrying the key-value pairs.
+func With(keysAndValues ...interface{}) *LevelLogger {
+	return std.With(keysAndValues...)
+}
+
+// Debug logs to the default LevelLogger at DebugLevel.
+func Debug(msg string, keysAndValues ...interface{}) {
+	std.log(DebugLevel, msg, keysAndValues)
+}
+
+// Info logs to the default LevelLogger at InfoLevel.
+func Info(msg string, keysAndValues ...interface{}) {
+	std.log(InfoLevel, msg, keysAndValues)
+}
+
+// Warn logs to the default LevelLogger at WarnLevel.
+func Warn(msg string, keysAndValues ...interface{}) {
+	std.log(WarnLevel, msg, keysAndValues)
+}
+
+// Error logs to the default LevelLogger at ErrorLevel.
+func Error(msg string, keysAndValues ...interface{}) {
+	std.log(ErrorLevel, msg, keysAndValues)
 }
 
 // Fatal is equivalent to Print() followed by a call to os.Exit() with a non-zero exit code.
 func Fatal(args ...interface{}) {
-	logger.Fatal(args...)
+	getLogger().Fatal(args...)
 }
 
 // Fatalf is equivalent to Printf() followed by a call to os.Exit() with a non-zero exit code.
 func Fatalf(format string, args ...interface{}) {
-	logger.Fatalf(format, args...)
+	getLogger().Fatalf(format, args...)
 }
 
 // Fatalln is equivalent to Println() followed by a call to os.Exit()) with a non-zero exit code.
 func Fatalln(args ...interface{}) {
-	logger.Fatalln(args...)
+	getLogger().Fatalln(args...)
 }
 
 // Print prints to the logger. Arguments are handled in the manner of fmt.Print.
 func Print(args ...interface{}) {
-	logger.Print(args...)
+	getLogger().Print(args...)
 }
 
 // Printf prints to the logger. Arguments are handled in the manner of fmt.Printf.
 func Printf(format string, args ...interface{}) {
-	logger.Printf(format, args...)
+	getLogger().Printf(format, args...)
 }
 
 // Println prints to the logger. Arguments are handled in the manner of fmt.Println.
 func Println(args ...interface{}) {
-	logger.Println(args...)
+	getLogger().Println(args...)
 }
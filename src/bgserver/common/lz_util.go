@@ -0,0 +1,155 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// lz 为一种简单的LZ77风格的块压缩算法，压缩率不如gzip，但速度快得多，适合对延迟敏感的消息.
+//
+// 压缩后的格式为：解压后长度的uvarint，然后是一串token:
+//   - tag < 0x80: 其后tag+1个字节为字面量
+//   - tag >= 0x80: 复制已解压数据中距末尾offset处的(tag&0x7f)+4个字节，offset为其后2个字节(小端)
+const (
+	lzMinMatch   = 4
+	lzMaxMatch   = lzMinMatch + 0x7f
+	lzMaxLiteral = 0x80
+	lzMaxOffset  = 1<<16 - 1
+	lzHashBits   = 14
+
+	// 每3个字节的复制token最多产生lzMaxMatch个字节，据此检查声明的解压后长度
+	lzMaxRatio = lzMaxMatch/3 + 1
+)
+
+var errLZCorrupt = errors.New("bgserver: corrupt lz input")
+
+// NewLZCompressor creates a Compressor based on a fast LZ77-style block format.
+func NewLZCompressor() Compressor {
+	return &lzCompressor{}
+}
+
+type lzCompressor struct {
+}
+
+func (c *lzCompressor) Do(w io.Writer, p []byte) error {
+	_, err := w.Write(lzEncode(nil, p))
+	return err
+}
+
+func (c *lzCompressor) Type() string {
+	return "lz"
+}
+
+// NewLZDecompressor creates a Decompressor for the data compressed by NewLZCompressor.
+func NewLZDecompressor() Decompressor {
+	return &lzDecompressor{}
+}
+
+type lzDecompressor struct {
+}
+
+func (d *lzDecompressor) Do(r io.Reader, maxSize int) ([]byte, error) {
+	// 每lzMaxLiteral个字面量多一个tag，因此压缩后的数据同样有上限
+	limit := maxSize
+	if maxSize > 0 {
+		limit += maxSize/lzMaxLiteral + 1 + binary.MaxVarintLen64
+	}
+	src, err := readAllLimited(r, limit)
+	if err != nil {
+		return nil, err
+	}
+	return lzDecode(src, maxSize)
+}
+
+func (d *lzDecompressor) Type() string {
+	return "lz"
+}
+
+// lzEncode 将src压缩后追加到dst
+func lzEncode(dst, src []byte) []byte {
+	var b [binary.MaxVarintLen64]byte
+	dst = append(dst, b[:binary.PutUvarint(b[:], uint64(len(src)))]...)
+
+	var table [1 << lzHashBits]int32 // 4字节序列的哈希 -> 最近出现的位置+1，0表示没有
+	lit := 0                         // 尚未输出的字面量的起始位置
+	i := 0
+	for i+lzMinMatch <= len(src) {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := (v * 2654435761) >> (32 - lzHashBits)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > lzMaxOffset || binary.LittleEndian.Uint32(src[cand:]) != v {
+			i++
+			continue
+		}
+		n := lzMinMatch
+		for i+n < len(src) && n < lzMaxMatch && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = lzAppendLiterals(dst, src[lit:i])
+		off := i - cand
+		dst = append(dst, 0x80|byte(n-lzMinMatch), byte(off), byte(off>>8))
+		i += n
+		lit = i
+	}
+	return lzAppendLiterals(dst, src[lit:])
+}
+
+func lzAppendLiterals(dst, lit []byte) []byte {
+	for len(lit) > 0 {
+		n := len(lit)
+		if n > lzMaxLiteral {
+			n = lzMaxLiteral
+		}
+		dst = append(dst, byte(n-1))
+		dst = append(dst, lit[:n]...)
+		lit = lit[n:]
+	}
+	return dst
+}
+
+// lzDecode 解压lzEncode的输出，解压后的长度超过maxSize时返回ErrDecompressedTooLarge
+func lzDecode(src []byte, maxSize int) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > uint64(len(src))*lzMaxRatio {
+		return nil, errLZCorrupt
+	}
+	if maxSize > 0 && n > uint64(maxSize) {
+		return nil, ErrDecompressedTooLarge
+	}
+	src = src[k:]
+	dst := make([]byte, 0, int(n))
+	for len(src) > 0 {
+		tag := src[0]
+		if tag < 0x80 {
+			l := int(tag) + 1
+			if len(src) < 1+l {
+				return nil, errLZCorrupt
+			}
+			dst = append(dst, src[1:1+l]...)
+			src = src[1+l:]
+		} else {
+			if len(src) < 3 {
+				return nil, errLZCorrupt
+			}
+			l := int(tag&0x7f) + lzMinMatch
+			off := int(src[1]) | int(src[2])<<8
+			if off == 0 || off > len(dst) {
+				return nil, errLZCorrupt
+			}
+			// 源和目标可能重叠，逐字节复制
+			for j := 0; j < l; j++ {
+				dst = append(dst, dst[len(dst)-off])
+			}
+			src = src[3:]
+		}
+		if uint64(len(dst)) > n {
+			return nil, errLZCorrupt
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errLZCorrupt
+	}
+	return dst, nil
+}
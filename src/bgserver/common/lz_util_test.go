@@ -0,0 +1,127 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// randomBytes 返回不可压缩的数据
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func TestLZRoundTrip(t *testing.T) {
+	inputs := map[string][]byte{
+		"empty":                {},
+		"one byte":             {'a'},
+		"shorter than a match": []byte("abc"),
+		"payload":              testPayload,
+		"run":                  bytes.Repeat([]byte{'a'}, 1000), // 与自身重叠的复制
+		"long literals":        randomBytes(lzMaxLiteral*3 + 7),
+		"incompressible":       randomBytes(64 << 10),
+		// 重复出现的距离超过lzMaxOffset，不能被复制
+		"far repeat": append(append(randomBytes(100), randomBytes(lzMaxOffset+1)...), randomBytes(100)...),
+		"mixed":      []byte(strings.Repeat("header;", 10) + string(randomBytes(300)) + strings.Repeat("footer;", 10)),
+	}
+	cp, dc := NewLZCompressor(), NewLZDecompressor()
+	for name, in := range inputs {
+		var buf bytes.Buffer
+		if err := cp.Do(&buf, in); err != nil {
+			t.Fatalf("%s: compress: %v", name, err)
+		}
+		// 不可压缩的数据只多出每lzMaxLiteral个字节一个tag和长度的varint
+		if max := len(in) + len(in)/lzMaxLiteral + 1 + binary.MaxVarintLen64; buf.Len() > max {
+			t.Errorf("%s: compressed size %d exceeds %d", name, buf.Len(), max)
+		}
+		got, err := dc.Do(bytes.NewReader(buf.Bytes()), len(in))
+		if err != nil {
+			t.Fatalf("%s: decompress: %v", name, err)
+		}
+		if !bytes.Equal(got, in) {
+			t.Fatalf("%s: round trip changed the data", name)
+		}
+	}
+}
+
+func TestLZCompresses(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewLZCompressor().Do(&buf, testPayload); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= len(testPayload)/4 {
+		t.Errorf("compressed size %d of %d bytes of repeated data", buf.Len(), len(testPayload))
+	}
+}
+
+func TestLZDecompressTooLarge(t *testing.T) {
+	src := lzEncode(nil, testPayload)
+	dc := NewLZDecompressor()
+	if _, err := dc.Do(bytes.NewReader(src), len(testPayload)-1); err != ErrDecompressedTooLarge {
+		t.Errorf("got %v, want ErrDecompressedTooLarge", err)
+	}
+	if _, err := dc.Do(bytes.NewReader(src), len(testPayload)); err != nil {
+		t.Errorf("decompress at the limit: %v", err)
+	}
+}
+
+func TestLZCorrupt(t *testing.T) {
+	tests := []struct {
+		name string
+		src  []byte
+	}{
+		{"empty", nil},
+		{"bad length varint", []byte{0xff, 0xff}},
+		{"length beyond the ratio", []byte{0xff, 0xff, 0x3f, 0x00, 'a'}},
+		{"missing data", []byte{5}},
+		{"short literal", []byte{5, 4, 'a', 'b'}},
+		{"short copy", []byte{8, 3, 'a', 'b', 'c', 'd', 0x80, 4}},
+		{"zero offset", []byte{8, 3, 'a', 'b', 'c', 'd', 0x80, 0, 0}},
+		{"offset before the start", []byte{8, 3, 'a', 'b', 'c', 'd', 0x80, 5, 0}},
+		{"longer than declared", []byte{2, 3, 'a', 'b', 'c', 'd'}},
+		{"shorter than declared", []byte{6, 3, 'a', 'b', 'c', 'd'}},
+	}
+	for _, tt := range tests {
+		if _, err := lzDecode(tt.src, 0); err != errLZCorrupt {
+			t.Errorf("%s: got %v, want errLZCorrupt", tt.name, err)
+		}
+	}
+}
+
+func TestLZTruncated(t *testing.T) {
+	in := append(append([]byte(nil), testPayload...), randomBytes(500)...)
+	src := lzEncode(nil, in)
+	for n := 0; n < len(src); n++ {
+		if _, err := lzDecode(src[:n], 0); err == nil {
+			t.Fatalf("truncated to %d of %d bytes: no error", n, len(src))
+		}
+	}
+}
+
+// 随机修改压缩后的数据，解压只能返回错误或其它数据，不能panic或超出声明的长度
+func TestLZRandomCorruption(t *testing.T) {
+	src := lzEncode(nil, testPayload)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		b := append([]byte(nil), src...)
+		for j := 0; j < 1+r.Intn(4); j++ {
+			b[r.Intn(len(b))] = byte(r.Intn(256))
+		}
+		n, _ := binary.Uvarint(b)
+		if got, err := lzDecode(b, 0); err == nil && uint64(len(got)) != n {
+			t.Fatalf("decoded %d bytes, declared %d", len(got), n)
+		}
+	}
+}
+
+func BenchmarkLZCompress(b *testing.B) {
+	benchmarkPooled(b, NewLZCompressor())
+}
+
+func BenchmarkLZDecompress(b *testing.B) {
+	benchmarkDecompressPooled(b, compressed(b, NewLZCompressor()), NewLZDecompressor())
+}
@@ -0,0 +1,332 @@
+package common
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RotateOptions 描述日志文件的切分和清理策略
+type RotateOptions struct {
+	// MaxSize 为单个文件的最大字节数，超过后切分，0表示不按大小切分
+	MaxSize int64
+	// Interval 为按时间切分的周期(以UTC时间对齐，如24*time.Hour在每天0点切分)，0表示不按时间切分
+	Interval time.Duration
+	// MaxBackups 为保留的旧文件个数，0表示全部保留
+	MaxBackups int
+	// Compress 表示是否用gzip压缩切分出的旧文件
+	Compress bool
+	// Perm 为新建文件的权限，0表示0644. 旧文件压缩后保持同样的权限.
+	Perm os.FileMode
+}
+
+// 旧文件名中的时间格式，如 bgserver.log.20161201-150405
+const rotateTimeFormat = "20060102-150405"
+
+// backupSuffix 匹配旧文件名在path之后的部分: 时间戳、同一秒内切分时的序号和压缩后的.gz
+var backupSuffix = regexp.MustCompile(`^\.(\d{8}-\d{6})(?:\.(\d+))?(?:\.gz)?$`)
+
+// RotatingFile 是按大小和时间切分的日志文件，可通过LevelLogger.SetOutput作为日志的输出.
+// 进程收到SIGHUP时会重新打开文件，以配合外部的logrotate使用.
+type RotatingFile struct {
+	path string
+	opts RotateOptions
+
+	mu       sync.Mutex
+	f        *os.File // 切分或重新打开失败时为nil，在下一次写入时重试
+	closed   bool
+	size     int64
+	openTime time.Time
+
+	sighup  chan os.Signal
+	done    chan struct{}
+	wg      sync.WaitGroup // 等待后台的压缩和清理完成
+	cleanMu sync.Mutex     // 依次进行压缩和清理，避免删除正在压缩的文件
+}
+
+// NewRotatingFile opens (or creates) the log file at path for appending.
+func NewRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	r := &RotatingFile{
+		path:   path,
+		opts:   opts,
+		sighup: make(chan os.Signal, 1),
+		done:   make(chan struct{}),
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	signal.Notify(r.sighup, syscall.SIGHUP)
+	go r.watchSignal()
+	return r, nil
+}
+
+// open 打开path，调用时需持有r.mu或尚未对外可见
+func (r *RotatingFile) open() error {
+	perm := r.opts.Perm
+	if perm == 0 {
+		perm = 0644
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	r.openTime = time.Now()
+	return nil
+}
+
+// Write implements io.Writer. It rotates the file before writing if needed.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.ensureOpen(); err != nil {
+		return 0, err
+	}
+	if r.shouldRotate(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// ensureOpen 在之前的切分或重新打开失败后重新打开文件，调用时需持有r.mu
+func (r *RotatingFile) ensureOpen() error {
+	if r.closed {
+		return os.ErrClosed
+	}
+	if r.f != nil {
+		return nil
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) shouldRotate(n int64) bool {
+	if r.opts.MaxSize > 0 && r.size > 0 && r.size+n > r.opts.MaxSize {
+		return true
+	}
+	if d := r.opts.Interval; d > 0 && !time.Now().Truncate(d).Equal(r.openTime.Truncate(d)) {
+		return true
+	}
+	return false
+}
+
+// Rotate closes the current file, renames it with a timestamp suffix and opens a new one.
+func (r *RotatingFile) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.ensureOpen(); err != nil {
+		return err
+	}
+	return r.rotate()
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	backup := r.backupName(time.Now())
+	if err := os.Rename(r.path, backup); err != nil && !os.IsNotExist(err) {
+		// 未改名时继续写原来的文件
+		if err2 := r.open(); err2 != nil {
+			Error("failed to reopen the log file", "file", r.path, "error", err2)
+		}
+		return err
+	}
+	if err := r.open(); err != nil {
+		// r.f保持为nil，下一次写入时重试
+		return err
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.compressAndClean(backup)
+	}()
+	return nil
+}
+
+// backupName 返回旧文件的名字，同一秒内多次切分时加上序号以免覆盖
+func (r *RotatingFile) backupName(t time.Time) string {
+	name := r.path + "." + t.Format(rotateTimeFormat)
+	candidate := name
+	for i := 1; ; i++ {
+		_, err1 := os.Stat(candidate)
+		_, err2 := os.Stat(candidate + ".gz")
+		if os.IsNotExist(err1) && os.IsNotExist(err2) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s.%d", name, i)
+	}
+}
+
+// compressAndClean 压缩刚切分出的旧文件，并删除超出MaxBackups的旧文件.
+// 多次切分的压缩和清理依次进行.
+func (r *RotatingFile) compressAndClean(backup string) {
+	r.cleanMu.Lock()
+	defer r.cleanMu.Unlock()
+	if r.opts.Compress {
+		// 排在前面的清理可能已经删除了backup
+		if err := compressFile(backup); err != nil && !os.IsNotExist(err) {
+			Error("failed to compress the rotated log file", "file", backup, "error", err)
+		}
+	}
+	if r.opts.MaxBackups <= 0 {
+		return
+	}
+	backups, err := r.backups()
+	if err != nil {
+		Error("failed to list the old log files", "file", r.path, "error", err)
+		return
+	}
+	for len(backups) > r.opts.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			Error("failed to remove the old log file", "file", backups[0], "error", err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// backups 返回path切分出的所有旧文件，按切分的先后排序. 只匹配backupName产生的文件名，
+// 同一目录下的其它文件(如bgserver.log.bak)不会被删除.
+func (r *RotatingFile) backups() ([]string, error) {
+	dir, base := filepath.Split(r.path)
+	infos, err := ioutil.ReadDir(filepath.Clean(dir + "."))
+	if err != nil {
+		return nil, err
+	}
+	type backup struct {
+		name string
+		ts   string
+		seq  int
+	}
+	var bs []backup
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, base) {
+			continue
+		}
+		m := backupSuffix.FindStringSubmatch(name[len(base):])
+		if m == nil {
+			continue
+		}
+		seq, _ := strconv.Atoi(m[2])
+		bs = append(bs, backup{name: filepath.Join(dir, name), ts: m[1], seq: seq})
+	}
+	sort.Slice(bs, func(i, j int) bool {
+		if bs[i].ts != bs[j].ts {
+			return bs[i].ts < bs[j].ts
+		}
+		return bs[i].seq < bs[j].seq
+	})
+	names := make([]string, len(bs))
+	for i, b := range bs {
+		names[i] = b.name
+	}
+	return names, nil
+}
+
+// compressFile 将path以gzip流式压缩为path.gz，成功后删除path
+func compressFile(path string) error {
+	if strings.HasSuffix(path, ".gz") {
+		return nil
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	if _, err := io.Copy(zw, src); err != nil {
+		f.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Reopen closes and reopens the file at the same path. It is called on SIGHUP
+// after an external tool such as logrotate has moved the file away.
+func (r *RotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return os.ErrClosed
+	}
+	if r.f != nil {
+		if err := r.f.Close(); err != nil {
+			return err
+		}
+		r.f = nil
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) watchSignal() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.sighup:
+			if err := r.Reopen(); err != nil {
+				Error("failed to reopen the log file", "file", r.path, "error", err)
+			}
+		}
+	}
+}
+
+// Close closes the file and waits for the pending compressions.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	signal.Stop(r.sighup)
+	close(r.done)
+	var err error
+	if r.f != nil {
+		err = r.f.Close()
+		r.f = nil
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	return err
+}
@@ -0,0 +1,30 @@
+package common
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// ServiceNode 为服务实例注册在zookeeper节点上的数据，由zkutil写入，由discovery读取
+type ServiceNode struct {
+	Ip               *string `protobuf:"bytes,1,opt,name=ip" json:"ip,omitempty"`
+	Port             *uint32 `protobuf:"varint,2,opt,name=port" json:"port,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (s *ServiceNode) Reset()         { *s = ServiceNode{} }
+func (s *ServiceNode) String() string { return proto.CompactTextString(s) }
+func (*ServiceNode) ProtoMessage()    {}
+
+func (s *ServiceNode) GetIp() string {
+	if s != nil && s.Ip != nil {
+		return *s.Ip
+	}
+	return ""
+}
+
+func (s *ServiceNode) GetPort() uint32 {
+	if s != nil && s.Port != nil {
+		return *s.Port
+	}
+	return 0
+}
@@ -0,0 +1,99 @@
+/*
+Package discovery resolves the instances of a bgserver service registered in zookeeper.
+
+A service instance registers an ephemeral child node under the path of its service,
+whose data is a serialized common.ServiceNode, as written by zkutil.Register. A target
+of the form zk://host1:2181,host2:2181/path/of/service resolves into the addresses
+of all the instances under /path/of/service.
+*/
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/samuel/go-zookeeper/zk"
+
+	"bgserver/common"
+	"bgserver/network"
+)
+
+// ZKScheme 为zookeeper服务发现的target前缀
+const ZKScheme = "zk://"
+
+var (
+	ErrNoInstance = errors.New("no instance is registered")
+)
+
+// IsZKTarget reports whether target is of the form zk://hosts/path.
+func IsZKTarget(target string) bool {
+	return strings.HasPrefix(target, ZKScheme)
+}
+
+// ParseZKTarget 将zk://host1:2181,host2:2181/path解析为zookeeper集群地址和服务路径
+func ParseZKTarget(target string) (hosts []string, path string, err error) {
+	if !IsZKTarget(target) {
+		return nil, "", fmt.Errorf("discovery: %q is not a zk target", target)
+	}
+	rest := strings.TrimPrefix(target, ZKScheme)
+	slash := strings.Index(rest, "/")
+	if slash <= 0 || slash == len(rest)-1 {
+		return nil, "", fmt.Errorf("discovery: invalid zk target %q, want zk://hosts/path", target)
+	}
+	for _, h := range strings.Split(rest[:slash], ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts, strings.TrimSuffix(rest[slash:], "/"), nil
+}
+
+// zkResolver 从zookeeper中读取服务的所有实例
+type zkResolver struct {
+	timeout time.Duration
+}
+
+// NewZKResolver returns a network.Resolver for zk:// targets, to be used with
+// network.WithResolver. timeout bounds the zookeeper session.
+func NewZKResolver(timeout time.Duration) network.Resolver {
+	return &zkResolver{timeout: timeout}
+}
+
+func (r *zkResolver) Resolve(target string) ([]string, error) {
+	hosts, path, err := ParseZKTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := zk.Connect(hosts, r.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: failed to connect to zookeeper %v: %v", hosts, err)
+	}
+	defer conn.Close()
+
+	children, _, err := conn.Children(path)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: failed to list %s: %v", path, err)
+	}
+	var addrs []string
+	for _, child := range children {
+		data, _, err := conn.Get(path + "/" + child)
+		if err != nil {
+			// 实例可能在列出子节点后下线
+			continue
+		}
+		node := &common.ServiceNode{}
+		if err := proto.Unmarshal(data, node); err != nil || node.GetIp() == "" {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(node.GetIp(), strconv.Itoa(int(node.GetPort()))))
+	}
+	if len(addrs) == 0 {
+		return nil, ErrNoInstance
+	}
+	return addrs, nil
+}
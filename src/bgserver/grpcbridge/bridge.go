@@ -0,0 +1,216 @@
+/*
+Package grpcbridge connects bgserver message types and gRPC unary methods, so that
+the two stacks can call each other while services migrate from one to the other.
+
+Expose serves bgserver handlers as the methods of a gRPC service:
+
+	grpcbridge.Expose(gs, s, "binggo.service1.Service1", map[string]int32{
+		"SayHello": int32(service1.MessageType_SAY_HELLO_REQUEST),
+	}, authenticate)
+
+The Head.source of the requests comes from the Authenticator, which usually maps
+the peer certificate or a verified token to a source. SourceFromMetadata takes the
+source sent by Forward as is and is only meant for trusted peers.
+
+Forward handles a bgserver message type by calling a gRPC backend:
+
+	grpcbridge.Forward(s, int32(service1.MessageType_SAY_HELLO_REQUEST), conn, "/binggo.service1.Service1/SayHello")
+
+The request and response of a method are the Body extensions of the request
+message type and of the response message type (the request type plus 1), so the
+gRPC messages must be wire compatible with them. A retcode that is not 0 becomes a
+gRPC error and vice versa, see ToGRPCStatus and FromGRPCError.
+*/
+package grpcbridge
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"bgserver/message"
+	pb "bgserver/message/proto/golang"
+	"bgserver/network"
+	"bgserver/status"
+)
+
+// SourceMetadataKey 为gRPC请求中携带bgserver消息头source的metadata
+const SourceMetadataKey = "bgserver-source"
+
+// AuthMethodGRPC 为通过Expose的Authenticator鉴权的AuthInfo.Method
+const AuthMethodGRPC = "grpc"
+
+// Authenticator returns the authenticated source of the peer of a gRPC request,
+// 0 if the peer has no source. The request is rejected with codes.Unauthenticated
+// if it returns an error.
+type Authenticator func(ctx context.Context) (uint32, error)
+
+// SourceFromMetadata is an Authenticator that trusts the source sent in the
+// SourceMetadataKey metadata, such as by ForwardHandler. Any client can claim any
+// source with it, so it must only be used when all the peers are trusted, for
+// example behind mutual TLS within the same deployment.
+func SourceFromMetadata(ctx context.Context) (uint32, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return 0, nil
+	}
+	for _, v := range md.Get(SourceMetadataKey) {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s metadata %q", SourceMetadataKey, v)
+		}
+		return uint32(n), nil
+	}
+	return 0, nil
+}
+
+// bodyExtension 返回消息类型mt对应的消息体扩展字段
+func bodyExtension(mt int32) (*proto.ExtensionDesc, error) {
+	desc, ok := proto.RegisteredExtensions(&pb.Body{})[mt]
+	if !ok {
+		return nil, fmt.Errorf("grpcbridge: no Body extension for message type %d", mt)
+	}
+	if _, ok := desc.ExtensionType.(proto.Message); !ok {
+		return nil, fmt.Errorf("grpcbridge: the Body extension %s of message type %d is not a message", desc.Name, mt)
+	}
+	return desc, nil
+}
+
+// newMessage 返回扩展字段desc的消息类型的一个新实例
+func newMessage(desc *proto.ExtensionDesc) proto.Message {
+	return reflect.New(reflect.TypeOf(desc.ExtensionType).Elem()).Interface().(proto.Message)
+}
+
+// Expose registers on gs a gRPC service named service, whose unary methods are
+// handled by the handlers of s: methods maps a method name to the request message
+// type. The Head.source of the requests is the source returned by auth, which is
+// also put into the context of the handlers as an AuthInfo (see
+// network.AuthInfoFromContext). It must be called after the handlers are
+// registered on s and before gs serves.
+func Expose(gs *grpc.Server, s *network.Server, service string, methods map[string]int32, auth Authenticator) error {
+	if auth == nil {
+		return errors.New("grpcbridge: no Authenticator")
+	}
+	desc := &grpc.ServiceDesc{
+		ServiceName: service,
+		HandlerType: (*interface{})(nil),
+	}
+	for name, mt := range methods {
+		h, ok := s.Handler(mt)
+		if !ok {
+			return fmt.Errorf("grpcbridge: no handler for message type %d", mt)
+		}
+		reqExt, err := bodyExtension(mt)
+		if err != nil {
+			return err
+		}
+		respExt, err := bodyExtension(mt + 1)
+		if err != nil {
+			return err
+		}
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: name,
+			Handler:    exposeMethod("/"+service+"/"+name, mt, s.MaxVersion(), h, auth, reqExt, respExt),
+		})
+	}
+	gs.RegisterService(desc, struct{}{})
+	return nil
+}
+
+func exposeMethod(fullMethod string, mt int32, version uint32, h network.Handler, auth Authenticator, reqExt, respExt *proto.ExtensionDesc) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	call := func(ctx context.Context, in interface{}) (interface{}, error) {
+		source, err := auth(ctx)
+		if err != nil {
+			return nil, ToGRPCStatus(status.New(int32(pb.ErrorCode_EC_UNAUTHENTICATED), err.Error())).Err()
+		}
+		ctx = network.NewContextWithAuthInfo(ctx, &network.AuthInfo{Source: source, Method: AuthMethodGRPC})
+		// 与从连接上收到的请求一样带有版本和session_no，处理函数和拦截器(如日志、去重)依赖它们
+		req := &pb.BMessage{
+			Head: &pb.Head{
+				Version:     proto.Uint32(version),
+				SessionNo:   proto.String(network.NewSessionNo()),
+				MessageType: proto.Int32(mt),
+				Source:      proto.Uint32(source),
+			},
+			Body: &pb.Body{},
+		}
+		if err := proto.SetExtension(req.Body, reqExt, in); err != nil {
+			return nil, ToGRPCStatus(status.Convert(err)).Err()
+		}
+		resp, err := h(ctx, req)
+		if err != nil {
+			return nil, ToGRPCStatus(status.Convert(err)).Err()
+		}
+		if resp == nil {
+			return nil, ToGRPCStatus(status.New(int32(pb.ErrorCode_EC_INTERNAL), "no response")).Err()
+		}
+		// gRPC的错误响应不带消息体，返回码不为0时只返回错误
+		if st := status.FromResponseCode(message.GetResponseCode(resp)); st != nil {
+			return nil, ToGRPCStatus(st).Err()
+		}
+		out, err := proto.GetExtension(resp.GetBody(), respExt)
+		if err != nil {
+			return nil, ToGRPCStatus(status.Newf(int32(pb.ErrorCode_EC_INTERNAL), "invalid response: %v", err)).Err()
+		}
+		return out, nil
+	}
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := newMessage(reqExt)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return call(ctx, in)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}
+		return interceptor(ctx, in, info, call)
+	}
+}
+
+// ForwardHandler returns a Handler that handles the request message type mt by
+// calling the gRPC method fullMethod (such as "/helloworld.Greeter/SayHello") on
+// conn. The Head.source of the request is sent as the SourceMetadataKey metadata
+// for a backend that trusts it (see SourceFromMetadata), and a gRPC error is answered with the retcode given by FromGRPCError.
+func ForwardHandler(mt int32, conn *grpc.ClientConn, fullMethod string) (network.Handler, error) {
+	reqExt, err := bodyExtension(mt)
+	if err != nil {
+		return nil, err
+	}
+	respExt, err := bodyExtension(mt + 1)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+		in, err := proto.GetExtension(req.GetBody(), reqExt)
+		if err != nil {
+			return nil, status.Errorf(int32(pb.ErrorCode_EC_INTERNAL), "invalid request: %v", err)
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, SourceMetadataKey, strconv.FormatUint(uint64(req.GetHead().GetSource()), 10))
+		out := newMessage(respExt)
+		if err := conn.Invoke(ctx, fullMethod, in, out); err != nil {
+			return nil, FromGRPCError(err)
+		}
+		body := &pb.Body{}
+		if err := proto.SetExtension(body, respExt, out); err != nil {
+			return nil, err
+		}
+		return &pb.BMessage{Head: message.NewResponseHead(req.GetHead()), Body: body}, nil
+	}, nil
+}
+
+// Forward registers on s a handler of the request message type mt that calls the
+// gRPC method fullMethod on conn, see ForwardHandler.
+func Forward(s *network.Server, mt int32, conn *grpc.ClientConn, fullMethod string) error {
+	h, err := ForwardHandler(mt, conn, fullMethod)
+	if err != nil {
+		return err
+	}
+	s.Handle(mt, h)
+	return nil
+}
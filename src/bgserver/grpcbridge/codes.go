@@ -0,0 +1,119 @@
+package grpcbridge
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	pb "bgserver/message/proto/golang"
+	"bgserver/status"
+)
+
+// 框架错误码与gRPC状态码的对应. 业务错误码没有对应的gRPC状态码，作为codes.Unknown，
+// 其返回码由gRPC状态中的ResponseCode detail带过桥，再回到bgserver时原样恢复.
+// 反向只映射含义完全相同的状态码，如FailedPrecondition不一定是版本不支持，其它状态码都作为EC_INTERNAL.
+var retcodeToGRPC = map[pb.ErrorCode]codes.Code{
+	pb.ErrorCode_EC_OK:                   codes.OK,
+	pb.ErrorCode_EC_UNAUTHENTICATED:      codes.Unauthenticated,
+	pb.ErrorCode_EC_SOURCE_MISMATCH:      codes.PermissionDenied,
+	pb.ErrorCode_EC_UNKNOWN_MESSAGE_TYPE: codes.Unimplemented,
+	pb.ErrorCode_EC_INTERNAL:             codes.Internal,
+	pb.ErrorCode_EC_UNSUPPORTED_VERSION:  codes.FailedPrecondition,
+	pb.ErrorCode_EC_NOT_FOUND:            codes.NotFound,
+	pb.ErrorCode_EC_DUPLICATE_LOGIN:      codes.AlreadyExists,
+	pb.ErrorCode_EC_PERMISSION_DENIED:    codes.PermissionDenied,
+	pb.ErrorCode_EC_INVALID_ARGUMENT:     codes.InvalidArgument,
+}
+
+var grpcToRetcode = map[codes.Code]pb.ErrorCode{
+	codes.OK:               pb.ErrorCode_EC_OK,
+	codes.Unauthenticated:  pb.ErrorCode_EC_UNAUTHENTICATED,
+	codes.PermissionDenied: pb.ErrorCode_EC_PERMISSION_DENIED,
+	codes.Unimplemented:    pb.ErrorCode_EC_UNKNOWN_MESSAGE_TYPE,
+	codes.NotFound:         pb.ErrorCode_EC_NOT_FOUND,
+	codes.Internal:         pb.ErrorCode_EC_INTERNAL,
+	codes.InvalidArgument:  pb.ErrorCode_EC_INVALID_ARGUMENT,
+}
+
+// GRPCCode returns the gRPC status code of a retcode: the corresponding code for
+// the framework error codes in binggo.proto, and codes.Unknown for the others.
+func GRPCCode(retcode int32) codes.Code {
+	if c, ok := retcodeToGRPC[pb.ErrorCode(retcode)]; ok {
+		return c
+	}
+	return codes.Unknown
+}
+
+// Retcode returns the retcode of a gRPC status code, EC_INTERNAL if no framework
+// error code has the same meaning.
+func Retcode(c codes.Code) int32 {
+	if rc, ok := grpcToRetcode[c]; ok {
+		return int32(rc)
+	}
+	return int32(pb.ErrorCode_EC_INTERNAL)
+}
+
+// typeURLPrefix 为gRPC状态中detail的类型URL前缀
+const typeURLPrefix = "type.googleapis.com/"
+
+// ToGRPCStatus converts a Status to a gRPC status. The details of st are kept,
+// and a binggo.ResponseCode detail carries the original retcode.
+func ToGRPCStatus(st *status.Status) *grpcstatus.Status {
+	rc := st.Proto()
+	p := &spb.Status{
+		Code:    int32(GRPCCode(st.Code())),
+		Message: st.Message(),
+	}
+	b, err := proto.Marshal(&pb.ResponseCode{Retcode: rc.Retcode, ErrorMessage: rc.ErrorMessage})
+	if err == nil {
+		p.Details = append(p.Details, &anypb.Any{TypeUrl: typeURLPrefix + proto.MessageName(rc), Value: b})
+	}
+	for _, d := range rc.GetDetails() {
+		p.Details = append(p.Details, &anypb.Any{TypeUrl: typeURLPrefix + d.GetType(), Value: d.GetValue()})
+	}
+	return grpcstatus.FromProto(p)
+}
+
+// FromGRPCError converts an error returned by a gRPC call to a Status. The retcode
+// is taken from a binggo.ResponseCode detail if present, which is the case for the
+// errors converted by ToGRPCStatus, otherwise from the gRPC status code. The error
+// message keeps the gRPC status code, so that the codes without a counterpart,
+// which all become EC_INTERNAL, can still be told apart.
+func FromGRPCError(err error) *status.Status {
+	gs, ok := grpcstatus.FromError(err)
+	if !ok {
+		return status.New(int32(pb.ErrorCode_EC_INTERNAL), err.Error())
+	}
+	p := gs.Proto()
+	code := Retcode(gs.Code())
+	msg := fmt.Sprintf("grpc: %v: %s", gs.Code(), gs.Message())
+	var details []*pb.ErrorDetail
+	rcName := proto.MessageName(&pb.ResponseCode{})
+	for _, d := range p.GetDetails() {
+		name := d.GetTypeUrl()
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			name = name[i+1:]
+		}
+		if name == rcName {
+			rc := new(pb.ResponseCode)
+			if proto.Unmarshal(d.GetValue(), rc) == nil {
+				code, msg = rc.GetRetcode(), rc.GetErrorMessage()
+			}
+			continue
+		}
+		details = append(details, &pb.ErrorDetail{Type: proto.String(name), Value: d.GetValue()})
+	}
+	if code == 0 {
+		code = int32(pb.ErrorCode_EC_INTERNAL)
+	}
+	return status.FromResponseCode(&pb.ResponseCode{
+		Retcode:      proto.Int32(code),
+		ErrorMessage: proto.String(msg),
+		Details:      details,
+	})
+}
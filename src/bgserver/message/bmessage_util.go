@@ -0,0 +1,112 @@
+package message
+
+import (
+	"github.com/golang/protobuf/proto"
+
+	pb "bgserver/message/proto/golang"
+	"bgserver/status"
+)
+
+// GetBodyField 返回消息体中与消息头message_type对应的字段.
+// 按照约定，消息体字段(或扩展字段)的编号与其消息类型的取值相同，
+// 例如HEART_BEAT_RESPONSE = 2对应heart_beat_response = 2.
+// 若消息体中没有该字段则返回nil.
+func GetBodyField(msg *pb.BMessage) interface{} {
+	body := msg.GetBody()
+	if body == nil {
+		return nil
+	}
+	mt := msg.GetHead().GetMessageType()
+	switch pb.MessageType(mt) {
+	case pb.MessageType_HEART_BEAT_REQUEST:
+		return body.GetHeartBeatRequest()
+	case pb.MessageType_HEART_BEAT_RESPONSE:
+		return body.GetHeartBeatResponse()
+	case pb.MessageType_HANDSHAKE_REQUEST:
+		return body.GetHandshakeRequest()
+	case pb.MessageType_HANDSHAKE_RESPONSE:
+		return body.GetHandshakeResponse()
+	case pb.MessageType_ADMIN_REQUEST:
+		return body.GetAdminRequest()
+	case pb.MessageType_ADMIN_RESPONSE:
+		return body.GetAdminResponse()
+	case pb.MessageType_REFLECTION_REQUEST:
+		return body.GetReflectionRequest()
+	case pb.MessageType_REFLECTION_RESPONSE:
+		return body.GetReflectionResponse()
+	case pb.MessageType_SUBSCRIBE_REQUEST:
+		return body.GetSubscribeRequest()
+	case pb.MessageType_SUBSCRIBE_RESPONSE:
+		return body.GetSubscribeResponse()
+	case pb.MessageType_PUSH_MESSAGE:
+		return body.GetPushMessage()
+	}
+
+	desc, ok := proto.RegisteredExtensions(body)[mt]
+	if !ok || !proto.HasExtension(body, desc) {
+		return nil
+	}
+	field, err := proto.GetExtension(body, desc)
+	if err != nil {
+		return nil
+	}
+	return field
+}
+
+// GetResponseCode 返回响应消息中的返回码. 消息头中的框架错误优先，
+// 否则响应消息体需包含名为rc的ResponseCode字段，都没有时返回nil.
+func GetResponseCode(msg *pb.BMessage) *pb.ResponseCode {
+	if rc := msg.GetHead().GetRc(); rc != nil {
+		return rc
+	}
+	if r, ok := GetBodyField(msg).(interface {
+		GetRc() *pb.ResponseCode
+	}); ok {
+		return r.GetRc()
+	}
+	return nil
+}
+
+// CheckResponse 检查响应的返回码，不为0时返回*status.Status，
+// 可以用errors.Is与生成代码中的ErrorCode比较. 没有返回码的响应视为成功.
+func CheckResponse(msg *pb.BMessage) error {
+	if s := status.FromResponseCode(GetResponseCode(msg)); s != nil {
+		return s
+	}
+	return nil
+}
+
+// SameResponse 比较两个响应的消息类型、返回码和消息体. 消息头中的其它字段
+// (如session_no、trace)每次都会不同，不参与比较.
+func SameResponse(a, b *pb.BMessage) bool {
+	return a.GetHead().GetMessageType() == b.GetHead().GetMessageType() &&
+		proto.Equal(GetResponseCode(a), GetResponseCode(b)) &&
+		proto.Equal(a.GetBody(), b.GetBody())
+}
+
+// NewResponseHead 根据请求的消息头构造响应的消息头.
+// 按照约定，响应的消息类型为请求的消息类型加1，会话号保持不变.
+func NewResponseHead(reqHead *pb.Head) *pb.Head {
+	return &pb.Head{
+		Version:     proto.Uint32(reqHead.GetVersion()),
+		SessionNo:   proto.String(reqHead.GetSessionNo()),
+		MessageType: proto.Int32(reqHead.GetMessageType() + 1),
+		Source:      proto.Uint32(reqHead.GetDest()),
+		Dest:        proto.Uint32(reqHead.GetSource()),
+	}
+}
+
+// NewErrorResponse 构造一个在消息头中携带框架错误的响应消息
+func NewErrorResponse(req *pb.BMessage, code int32, errMsg string) *pb.BMessage {
+	return NewStatusResponse(req, status.New(code, errMsg))
+}
+
+// NewStatusResponse 构造以st为消息头返回码的响应，st的details一并带回
+func NewStatusResponse(req *pb.BMessage, st *status.Status) *pb.BMessage {
+	head := NewResponseHead(req.GetHead())
+	head.Rc = st.Proto()
+	return &pb.BMessage{
+		Head: head,
+		Body: &pb.Body{},
+	}
+}
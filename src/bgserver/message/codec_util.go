@@ -1,17 +1,6 @@
 package message
 
 import (
-    "bytes"
-	"compress/gzip"
-	"encoding/binary"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"math"
-	"math/rand"
-	"os"
-	"time"
-
 	"github.com/golang/protobuf/proto"
 )
 
@@ -23,6 +12,11 @@ type Codec interface {
 }
 
 
+// NewProtoCodec creates a Codec based on protobuf.
+func NewProtoCodec() Codec {
+	return protoCodec{}
+}
+
 // protoCodec is a Codec implemetation with protobuf.
 type protoCodec struct{}
 
@@ -0,0 +1,125 @@
+package dynamic
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/encoding/protowire"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"bgserver/message"
+	pb "bgserver/message/proto/golang"
+)
+
+// 消息体的格式
+const (
+	FormatText = "text" // protobuf的文本格式
+	FormatJSON = "json"
+)
+
+// NewRequest 构造消息类型为mt的请求，text为消息体字段按format格式化的内容
+func (s *Schema) NewRequest(head *pb.Head, mt int32, text, format string) (*pb.BMessage, error) {
+	field, err := s.BodyField(mt)
+	if err != nil {
+		return nil, err
+	}
+	m := dynamicpb.NewMessage(field.Message())
+	switch format {
+	case FormatJSON:
+		err = protojson.Unmarshal([]byte(text), m)
+	default:
+		err = prototext.Unmarshal([]byte(text), m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid body of %s: %v", field.Message().FullName(), err)
+	}
+	b, err := protov2.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	// 编号为mt的字段即为消息体中与消息类型对应的字段，扩展字段在解码后以原始字节保留
+	raw := protowire.AppendTag(nil, protowire.Number(mt), protowire.BytesType)
+	raw = protowire.AppendBytes(raw, b)
+	req := &pb.BMessage{
+		Head: proto.Clone(head).(*pb.Head),
+		Body: &pb.Body{},
+	}
+	if err := proto.Unmarshal(raw, req.Body); err != nil {
+		return nil, err
+	}
+	req.Head.MessageType = proto.Int32(mt)
+	return req, nil
+}
+
+// FormatResponse 将响应的消息头和消息体字段按format格式化为文本
+func (s *Schema) FormatResponse(resp *pb.BMessage, format string) (string, error) {
+	var out bytes.Buffer
+	mt := resp.GetHead().GetMessageType()
+	if rc := resp.GetHead().GetRc(); rc != nil {
+		fmt.Fprintf(&out, "retcode: %d\nerror_message: %q\n", rc.GetRetcode(), rc.GetErrorMessage())
+		return out.String(), nil
+	}
+
+	raw, err := proto.Marshal(resp.GetBody())
+	if err != nil {
+		return "", err
+	}
+	fieldBytes, ok := findField(raw, protowire.Number(mt))
+	if !ok {
+		fmt.Fprintf(&out, "message_type: %d\n(the response has no body field)\n", mt)
+		return out.String(), nil
+	}
+	field, err := s.BodyField(mt)
+	if err != nil {
+		return "", err
+	}
+	m := dynamicpb.NewMessage(field.Message())
+	if err := protov2.Unmarshal(fieldBytes, m); err != nil {
+		return "", fmt.Errorf("invalid response body of %s: %v", field.Message().FullName(), err)
+	}
+
+	var b []byte
+	switch format {
+	case FormatJSON:
+		b, err = protojson.MarshalOptions{Multiline: true}.Marshal(m)
+	default:
+		b, err = prototext.MarshalOptions{Multiline: true}.Marshal(m)
+	}
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&out, "# %s (message_type %d, retcode %d)\n", field.Message().FullName(), mt, message.GetResponseCode(resp).GetRetcode())
+	out.Write(b)
+	if len(b) == 0 || b[len(b)-1] != '\n' {
+		out.WriteByte('\n')
+	}
+	return out.String(), nil
+}
+
+// findField 返回序列化的消息b中编号为num的length-delimited字段的内容
+func findField(b []byte, num protowire.Number) ([]byte, bool) {
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return nil, false
+		}
+		b = b[l:]
+		if n == num && typ == protowire.BytesType {
+			v, l := protowire.ConsumeBytes(b)
+			if l < 0 {
+				return nil, false
+			}
+			return v, true
+		}
+		l = protowire.ConsumeFieldValue(n, typ, b)
+		if l < 0 {
+			return nil, false
+		}
+		b = b[l:]
+	}
+	return nil, false
+}
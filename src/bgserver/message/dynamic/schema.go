@@ -0,0 +1,165 @@
+/*
+Package dynamic builds and decodes BMessages whose body fields are only known at
+run time, from local .proto files or from the reflection of a server.
+*/
+package dynamic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"bgserver/message"
+	pb "bgserver/message/proto/golang"
+)
+
+// 消息体的完整名字，业务服务通过扩展它来定义自己的消息
+const bodyMessageName = "binggo.Body"
+
+// Schema 保存消息类型和消息体字段的定义，来自本地的.proto文件或server的反射
+type Schema struct {
+	files *protoregistry.Files
+}
+
+// LoadLocalSchema 调用protoc将本地的.proto文件编译为FileDescriptorSet
+func LoadLocalSchema(protoPaths, protoFiles []string) (*Schema, error) {
+	out, err := ioutil.TempFile("", "bgschema")
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	args := []string{"--include_imports", "--descriptor_set_out=" + out.Name()}
+	for _, p := range protoPaths {
+		args = append(args, "-I", p)
+	}
+	args = append(args, protoFiles...)
+	cmd := exec.Command("protoc", args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("protoc failed: %v", err)
+	}
+	b, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		return nil, err
+	}
+	set := new(descriptorpb.FileDescriptorSet)
+	if err := proto.Unmarshal(b, set); err != nil {
+		return nil, err
+	}
+	return NewSchema(set)
+}
+
+// Invoker 发送请求并等待响应，如*network.ClientConn
+type Invoker interface {
+	Invoke(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error)
+}
+
+// LoadReflectionSchema 通过REFLECTION_REQUEST从server获取所有已注册消息类型的定义,
+// head为请求使用的消息头(message_type和session_no会被覆盖).
+func LoadReflectionSchema(ctx context.Context, cc Invoker, head *pb.Head) (*Schema, error) {
+	req := &pb.BMessage{
+		Head: proto.Clone(head).(*pb.Head),
+		Body: &pb.Body{ReflectionRequest: &pb.ReflectionRequest{}},
+	}
+	req.Head.MessageType = proto.Int32(int32(pb.MessageType_REFLECTION_REQUEST))
+	req.Head.SessionNo = nil
+	resp, err := cc.Invoke(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if rc := message.GetResponseCode(resp); rc.GetRetcode() != 0 {
+		return nil, fmt.Errorf("reflection failed: retcode %d: %s", rc.GetRetcode(), rc.GetErrorMessage())
+	}
+	set := new(descriptorpb.FileDescriptorSet)
+	for _, b := range resp.GetBody().GetReflectionResponse().GetFileDescriptors() {
+		fd := new(descriptorpb.FileDescriptorProto)
+		if err := proto.Unmarshal(b, fd); err != nil {
+			return nil, err
+		}
+		set.File = append(set.File, fd)
+	}
+	return NewSchema(set)
+}
+
+// NewSchema creates a Schema from a set of FileDescriptorProtos, which must include all the dependencies.
+func NewSchema(set *descriptorpb.FileDescriptorSet) (*Schema, error) {
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{files: files}, nil
+}
+
+// MessageType 将消息类型的名字(如SAY_HELLO_REQUEST或binggo.service1.SAY_HELLO_REQUEST)
+// 或数值解析为消息类型的取值
+func (s *Schema) MessageType(name string) (int32, error) {
+	if n, err := strconv.ParseInt(name, 10, 32); err == nil {
+		return int32(n), nil
+	}
+	var found []protoreflect.EnumValueDescriptor
+	s.files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		enums := fd.Enums()
+		for i := 0; i < enums.Len(); i++ {
+			if enums.Get(i).Name() != "MessageType" {
+				continue
+			}
+			values := enums.Get(i).Values()
+			for j := 0; j < values.Len(); j++ {
+				v := values.Get(j)
+				if string(v.Name()) == name || string(v.FullName()) == name {
+					found = append(found, v)
+				}
+			}
+		}
+		return true
+	})
+	switch len(found) {
+	case 0:
+		return 0, fmt.Errorf("unknown message type %q", name)
+	case 1:
+		return int32(found[0].Number()), nil
+	default:
+		return 0, fmt.Errorf("ambiguous message type %q, use the full name such as %s", name, found[0].FullName())
+	}
+}
+
+// BodyField 返回消息类型mt对应的消息体字段或扩展字段
+func (s *Schema) BodyField(mt int32) (protoreflect.FieldDescriptor, error) {
+	d, err := s.files.FindDescriptorByName(bodyMessageName)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not defined: %v", bodyMessageName, err)
+	}
+	if f := d.(protoreflect.MessageDescriptor).Fields().ByNumber(protoreflect.FieldNumber(mt)); f != nil {
+		return f, nil
+	}
+	var field protoreflect.FieldDescriptor
+	s.files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		exts := fd.Extensions()
+		for i := 0; i < exts.Len(); i++ {
+			x := exts.Get(i)
+			if x.ContainingMessage().FullName() == bodyMessageName && int32(x.Number()) == mt {
+				field = x
+				return false
+			}
+		}
+		return true
+	})
+	if field == nil {
+		return nil, fmt.Errorf("no body field is defined for message type %d", mt)
+	}
+	if field.Message() == nil {
+		return nil, fmt.Errorf("the body field %s of message type %d is not a message", field.FullName(), mt)
+	}
+	return field, nil
+}
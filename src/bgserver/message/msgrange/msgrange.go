@@ -0,0 +1,246 @@
+/*
+Package msgrange records the message type and error code ranges of the services,
+so that the ranges of different services do not overlap.
+
+It does not depend on the generated code of binggo.proto, so that protoc-gen-bgserver
+and bgcheck, which run before the code is generated, can use it, and the generated
+init functions can register their services in it.
+*/
+package msgrange
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	. "bgserver/common"
+)
+
+// Range 为左闭右开的区间[Begin, End)
+type Range struct {
+	Begin int32
+	End   int32
+}
+
+func (r Range) Contains(v int32) bool {
+	return v >= r.Begin && v < r.End
+}
+
+func (r Range) Overlaps(o Range) bool {
+	return r.Begin < o.End && o.Begin < r.End
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("[%d, %d)", r.Begin, r.End)
+}
+
+// 框架内置的消息类型和错误码所占用的范围，见binggo.proto
+const BuiltinService = "binggo"
+
+var (
+	BuiltinMessageTypes = Range{Begin: 1, End: 1000}
+	BuiltinErrorCodes   = Range{Begin: 0, End: 1000}
+)
+
+// ServiceSpec 声明一个服务占用的消息类型和错误码范围.
+// 按照约定，范围由.proto文件中MessageType枚举的BEGINNING_ID和ENDING_ID，
+// 以及ErrorCode枚举的EC_*_BEGIN和EC_*_END给出，如service1.1000.2000.proto.
+type ServiceSpec struct {
+	Name         string // 服务名，通常为.proto文件的包名，如binggo.service1
+	MessageTypes Range
+	ErrorCodes   Range
+
+	// 服务定义的消息类型和错误码(不含表示范围的取值)，必须落在对应的范围内
+	MessageTypeValues []int32
+	ErrorCodeValues   []int32
+}
+
+// RangeRegistry 记录所有服务的消息类型和错误码范围，保证各服务之间的范围不重叠
+type RangeRegistry struct {
+	mu       sync.RWMutex
+	services []*ServiceSpec
+}
+
+// NewRangeRegistry creates a RangeRegistry with only the builtin ranges of binggo registered.
+func NewRangeRegistry() *RangeRegistry {
+	return &RangeRegistry{
+		services: []*ServiceSpec{{
+			Name:         BuiltinService,
+			MessageTypes: BuiltinMessageTypes,
+			ErrorCodes:   BuiltinErrorCodes,
+		}},
+	}
+}
+
+// Register 检查并登记一个服务的范围. 范围为空、与已登记的服务重叠，
+// 或者消息类型、错误码超出服务自己声明的范围时返回错误.
+func (r *RangeRegistry) Register(spec *ServiceSpec) error {
+	if spec.Name == "" {
+		return fmt.Errorf("bgserver: the service has no name")
+	}
+	if spec.MessageTypes.Begin >= spec.MessageTypes.End {
+		return fmt.Errorf("bgserver: service %s declares an empty message type range %v", spec.Name, spec.MessageTypes)
+	}
+	if spec.ErrorCodes.Begin > spec.ErrorCodes.End {
+		return fmt.Errorf("bgserver: service %s declares an invalid error code range %v", spec.Name, spec.ErrorCodes)
+	}
+	for _, mt := range spec.MessageTypeValues {
+		if !spec.MessageTypes.Contains(mt) {
+			return fmt.Errorf("bgserver: message type %d of service %s is outside its range %v", mt, spec.Name, spec.MessageTypes)
+		}
+	}
+	for _, ec := range spec.ErrorCodeValues {
+		if !spec.ErrorCodes.Contains(ec) {
+			return fmt.Errorf("bgserver: error code %d of service %s is outside its range %v", ec, spec.Name, spec.ErrorCodes)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.services {
+		if s.Name == spec.Name {
+			return fmt.Errorf("bgserver: service %s is registered twice", spec.Name)
+		}
+		if s.MessageTypes.Overlaps(spec.MessageTypes) {
+			return fmt.Errorf("bgserver: message type range %v of service %s overlaps %v of service %s",
+				spec.MessageTypes, spec.Name, s.MessageTypes, s.Name)
+		}
+		if s.ErrorCodes.Overlaps(spec.ErrorCodes) {
+			return fmt.Errorf("bgserver: error code range %v of service %s overlaps %v of service %s",
+				spec.ErrorCodes, spec.Name, s.ErrorCodes, s.Name)
+		}
+	}
+	r.services = append(r.services, spec)
+	return nil
+}
+
+// Services returns all the registered services, ordered by their message type ranges.
+func (r *RangeRegistry) Services() []ServiceSpec {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	specs := make([]ServiceSpec, 0, len(r.services))
+	for _, s := range r.services {
+		specs = append(specs, *s)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].MessageTypes.Begin < specs[j].MessageTypes.Begin })
+	return specs
+}
+
+// LookupMessageType returns the service whose range contains the message type mt.
+func (r *RangeRegistry) LookupMessageType(mt int32) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, s := range r.services {
+		if s.MessageTypes.Contains(mt) {
+			return s.Name, true
+		}
+	}
+	return "", false
+}
+
+// LookupErrorCode returns the service whose range contains the error code ec.
+func (r *RangeRegistry) LookupErrorCode(ec int32) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, s := range r.services {
+		if s.ErrorCodes.Contains(ec) {
+			return s.Name, true
+		}
+	}
+	return "", false
+}
+
+var defaultRangeRegistry = NewRangeRegistry()
+
+// RegisterService 在进程默认的RangeRegistry中登记服务，通常在生成代码的init中调用
+func RegisterService(spec *ServiceSpec) error {
+	return defaultRangeRegistry.Register(spec)
+}
+
+// MustRegisterService 与RegisterService相同，但登记失败时退出进程，使冲突在启动时暴露
+func MustRegisterService(spec *ServiceSpec) {
+	if err := RegisterService(spec); err != nil {
+		Fatalf("%v", err)
+	}
+}
+
+// RegisteredServices returns the services registered in the default RangeRegistry.
+func RegisteredServices() []ServiceSpec {
+	return defaultRangeRegistry.Services()
+}
+
+// LookupMessageType returns the service registered in the default RangeRegistry whose
+// range contains the message type mt.
+func LookupMessageType(mt int32) (string, bool) {
+	return defaultRangeRegistry.LookupMessageType(mt)
+}
+
+// LookupErrorCode returns the service registered in the default RangeRegistry whose
+// range contains the error code ec.
+func LookupErrorCode(ec int32) (string, bool) {
+	return defaultRangeRegistry.LookupErrorCode(ec)
+}
+
+// 表示范围的枚举值的名字
+const (
+	messageTypeBeginName = "BEGINNING_ID"
+	messageTypeEndName   = "ENDING_ID"
+	errorCodeBeginSuffix = "_BEGIN"
+	errorCodeEndSuffix   = "_END"
+)
+
+// ServiceSpecFromFile 从.proto文件的MessageType、ErrorCode枚举和binggo.Body的扩展字段中
+// 读取服务的范围. 没有定义MessageType枚举的文件(如binggo.proto本身)返回nil.
+func ServiceSpecFromFile(fd *dpb.FileDescriptorProto) (*ServiceSpec, error) {
+	if fd.GetPackage() == BuiltinService {
+		return nil, nil
+	}
+	spec := &ServiceSpec{Name: fd.GetPackage()}
+	if spec.Name == "" {
+		spec.Name = fd.GetName()
+	}
+	var hasMessageTypes, hasBegin, hasEnd bool
+	for _, e := range fd.GetEnumType() {
+		switch e.GetName() {
+		case "MessageType":
+			hasMessageTypes = true
+			for _, v := range e.GetValue() {
+				switch v.GetName() {
+				case messageTypeBeginName:
+					spec.MessageTypes.Begin, hasBegin = v.GetNumber(), true
+				case messageTypeEndName:
+					spec.MessageTypes.End, hasEnd = v.GetNumber(), true
+				default:
+					spec.MessageTypeValues = append(spec.MessageTypeValues, v.GetNumber())
+				}
+			}
+		case "ErrorCode":
+			for _, v := range e.GetValue() {
+				switch {
+				case strings.HasSuffix(v.GetName(), errorCodeBeginSuffix):
+					spec.ErrorCodes.Begin = v.GetNumber()
+				case strings.HasSuffix(v.GetName(), errorCodeEndSuffix):
+					spec.ErrorCodes.End = v.GetNumber()
+				default:
+					spec.ErrorCodeValues = append(spec.ErrorCodeValues, v.GetNumber())
+				}
+			}
+		}
+	}
+	if !hasMessageTypes {
+		return nil, nil
+	}
+	if !hasBegin || !hasEnd {
+		return nil, fmt.Errorf("bgserver: %s: MessageType must declare %s and %s", fd.GetName(), messageTypeBeginName, messageTypeEndName)
+	}
+	// 扩展字段的编号即为消息类型，同样必须落在服务的范围内
+	for _, x := range fd.GetExtension() {
+		if x.GetExtendee() == ".binggo.Body" {
+			spec.MessageTypeValues = append(spec.MessageTypeValues, x.GetNumber())
+		}
+	}
+	return spec, nil
+}
@@ -1,29 +1,123 @@
 package message
 
 import (
-    "bytes"
-	"compress/gzip"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"math"
-	"math/rand"
-	"os"
-	"time"
 
 	. "bgserver/common"
 )
 
 
-// parser reads complelete messages from the underlying reader.
-type parser struct {
+type payloadFormat uint8
+
+// 帧头中flags字节的低4位为压缩算法的编号(见common.CompressionNone等).
+// flagChecksum只用于v2帧头，表示帧头后带有消息体的CRC32C，其余位保留.
+const (
+	compressionMask payloadFormat = 0x0f
+	flagChecksum    payloadFormat = 0x10
+)
+
+// compression 返回帧使用的压缩算法的编号
+func (pf payloadFormat) compression() uint8 {
+	return uint8(pf & compressionMask)
+}
+
+// 帧头的版本.
+//
+//	v1: flags(1) | length(4)
+//	v2: magic(2) | version(1) | flags(1) | length(4) | [crc32c(4)]
+//
+// v1帧头的flags不会超过0x0f，而v2帧头以0xb6开头，接收方据此逐帧区分两种帧头.
+// 一旦收到v2的帧，之后的帧都必须是v2的，以便发现错位的数据流.
+const (
+	FrameV1 uint8 = 1
+	FrameV2 uint8 = 2
+)
+
+var frameMagic = [2]byte{0xb6, 0x47}
+
+const (
+	frameV1HeaderLen = 5
+	frameV2HeaderLen = 8
+	checksumLen      = 4
+)
+
+var (
+	ErrBadFrameHeader = errors.New("bgserver: bad frame header")
+	ErrFrameChecksum  = errors.New("bgserver: frame checksum mismatch")
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// DefaultMaxFrameSize 为默认一帧消息体(压缩后)的大小上限. 帧头中的长度在分配内存前与之比较，
+// 避免错位的数据流或恶意的帧头使接收方分配多达4GB的内存.
+const DefaultMaxFrameSize = 16 << 20
+
+// MaxFrameHeaderLen 为帧头(包括校验和)的最大长度，一帧的总长度不超过它加上消息体的大小上限
+const MaxFrameHeaderLen = frameV2HeaderLen + checksumLen
+
+// FrameFormat 为发送的帧所使用的帧头格式
+type FrameFormat struct {
+	Version  uint8 // FrameV1或FrameV2，为0时视为FrameV1
+	Checksum bool  // 是否携带消息体的CRC32C，只有FrameV2支持
+}
+
+// FrameFormatOf 返回一个完整的帧所使用的帧头格式
+func FrameFormatOf(frame []byte) FrameFormat {
+	if len(frame) >= frameV2HeaderLen && frame[0] == frameMagic[0] {
+		return FrameFormat{Version: FrameV2, Checksum: payloadFormat(frame[3])&flagChecksum != 0}
+	}
+	return FrameFormat{Version: FrameV1}
+}
+
+// Parser reads complelete messages from the underlying reader.
+type Parser struct {
 	r io.Reader		// r is the underlying reader.
-	header [5]byte	// The header of a message.
-	// 其中第一个字节用于表示消息体是否被压缩了，后面四个字节标记消息体的长度
+	header [MaxFrameHeaderLen]byte	// The header of a message.
+	v2 bool		// 是否已经收到过v2的帧
+	observer func(header, payload []byte)	// 读到每一帧后调用
+	maxFrameSize int	// 一帧消息体的大小上限
+}
+
+// NewParser creates a Parser reading messages from r, whose frames are limited
+// to DefaultMaxFrameSize bytes.
+func NewParser(r io.Reader) *Parser {
+	return &Parser{r: r, maxFrameSize: DefaultMaxFrameSize}
+}
+
+// SetMaxFrameSize 设置一帧消息体的大小上限，n <= 0时使用DefaultMaxFrameSize.
+// 超过上限的帧在读取消息体前即返回ErrBadFrameHeader.
+func (p *Parser) SetMaxFrameSize(n int) {
+	if n <= 0 {
+		n = DefaultMaxFrameSize
+	}
+	p.maxFrameSize = n
+}
+
+// SetFrameObserver 设置读到每一个完整的帧后调用的函数，header和payload为帧头和消息体的原始字节，
+// 只在调用期间有效. 校验和不匹配的帧同样会被观察到.
+func (p *Parser) SetFrameObserver(f func(header, payload []byte)) {
+	p.observer = f
+}
+
+// readFull 读取帧的剩余部分，此时遇到EOF说明帧不完整
+func (p *Parser) readFull(b []byte) error {
+	if _, err := io.ReadFull(p.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
 }
 
-// recvMsg reads a complete message from the stream.
+// recvMsg reads a complete message from the stream, with either a v1 or a v2
+// frame header. The checksum of a v2 frame is verified if present.
 //
 // It returns the message and its payload (compression/encoding)
 // format. The caller owns the returned msg memory.
@@ -31,43 +125,76 @@ type parser struct {
 // If there is an error, possible values are:
 //   * io.EOF, when no messages remain
 //   * io.ErrUnexpectedEOF
-//   * of type transport.ConnectionError
-//   * of type transport.StreamError
-// No other error values or types must be returned, which also means
-// that the underlying io.Reader must not return an incompatible
-// error.
-func (p *parser) recvMsg() (pf payloadFormat, msg []byte, err error) {
-	if _, err := io.ReadFull(p.r, p.header[:]); err != nil {
+//   * ErrBadFrameHeader or ErrFrameChecksum, when the stream is corrupt
+//   * other errors returned by the underlying io.Reader
+func (p *Parser) recvMsg() (pf payloadFormat, msg []byte, err error) {
+	if _, err := io.ReadFull(p.r, p.header[:1]); err != nil {
 		return 0, nil, err
 	}
 
-	pf = payloadFormat(p.header[0])
-	length := binary.BigEndian.Uint32(p.header[1:])
+	var length uint32
+	var checksum []byte
+	var headerLen int
+	if p.header[0] == frameMagic[0] {
+		h := p.header[:frameV2HeaderLen]
+		if err := p.readFull(h[1:]); err != nil {
+			return 0, nil, err
+		}
+		if h[1] != frameMagic[1] {
+			return 0, nil, fmt.Errorf("%w: bad magic %#x%02x", ErrBadFrameHeader, h[0], h[1])
+		}
+		if h[2] != FrameV2 {
+			return 0, nil, fmt.Errorf("%w: unsupported frame version %d", ErrBadFrameHeader, h[2])
+		}
+		p.v2 = true
+		headerLen = frameV2HeaderLen
+		pf = payloadFormat(h[3])
+		length = binary.BigEndian.Uint32(h[4:])
+		if pf&flagChecksum != 0 {
+			checksum = p.header[frameV2HeaderLen:]
+			if err := p.readFull(checksum); err != nil {
+				return 0, nil, err
+			}
+			headerLen += checksumLen
+			pf &^= flagChecksum
+		}
+	} else {
+		if p.v2 || payloadFormat(p.header[0])&^compressionMask != 0 {
+			return 0, nil, fmt.Errorf("%w: unexpected first byte %#x", ErrBadFrameHeader, p.header[0])
+		}
+		h := p.header[:frameV1HeaderLen]
+		if err := p.readFull(h[1:]); err != nil {
+			return 0, nil, err
+		}
+		headerLen = frameV1HeaderLen
+		pf = payloadFormat(h[0])
+		length = binary.BigEndian.Uint32(h[1:])
+	}
 
-	if length == 0 {
-		return pf, nil, nil
+	if uint64(length) > uint64(p.maxFrameSize) {
+		return 0, nil, fmt.Errorf("%w: frame length %d exceeds the limit %d", ErrBadFrameHeader, length, p.maxFrameSize)
 	}
-	// TODO: garbage. reuse buffer after proto decoding instead of making it for each message:
-	msg = make([]byte, int(length))
-	if _, err := io.ReadFull(p.r, msg); err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
+	if length > 0 {
+		// TODO: garbage. reuse buffer after proto decoding instead of making it for each message:
+		msg = make([]byte, int(length))
+		if err := p.readFull(msg); err != nil {
+			return 0, nil, err
 		}
-		return 0, nil, err
+	}
+	if p.observer != nil {
+		p.observer(p.header[:headerLen], msg)
+	}
+	if checksum != nil && crc32.Checksum(msg, castagnoliTable) != binary.BigEndian.Uint32(checksum) {
+		return 0, nil, ErrFrameChecksum
 	}
 	return pf, msg, nil
 }
 
-func (p *parser) SendMsg(pf payloadFormat, msg []byte) (err error) {
-	// TODO
-}
-
-// encode serializes msg and prepends the message header. If msg is nil, it
+// Encode serializes msg and prepends the message header. If msg is nil, it
 // generates the message header of 0 message length.
 // 对需要发送的消息进行编码
-func encode(c Codec, msg interface{}, cp Compressor, cbuf *bytes.Buffer) ([]byte, error) {
+func Encode(c Codec, msg interface{}, cp Compressor, cbuf *bytes.Buffer) ([]byte, error) {
 	var b []byte
-	var length uint
 	if msg != nil {
 		var err error
 		// TODO(zhaoq): optimize to reduce memory alloc and copying.
@@ -75,73 +202,100 @@ func encode(c Codec, msg interface{}, cp Compressor, cbuf *bytes.Buffer) ([]byte
 		if err != nil {
 			return nil, err
 		}
-		if cp != nil {
-			if err := cp.Do(cbuf, b); err != nil {
-				return nil, err
-			}
-			b = cbuf.Bytes()
+	}
+	return EncodePayload(b, cp, cbuf)
+}
+
+// EncodePayload 压缩已编码的消息b并加上v1帧头，cp为nil时不压缩.
+// 压缩后的数据写入cbuf，调用者可以据此得到压缩后的大小.
+func EncodePayload(b []byte, cp Compressor, cbuf *bytes.Buffer) ([]byte, error) {
+	return EncodeFrame(b, cp, cbuf, FrameFormat{Version: FrameV1})
+}
+
+// EncodeFrame 与EncodePayload相同，但使用ff指定的帧头格式
+func EncodeFrame(b []byte, cp Compressor, cbuf *bytes.Buffer, ff FrameFormat) ([]byte, error) {
+	pf := payloadFormat(CompressionNone)
+	if cp != nil && b != nil {
+		id, ok := CompressionID(cp.Type())
+		if !ok {
+			return nil, fmt.Errorf("bgserver: compressor %q is not registered", cp.Type())
 		}
-		length = uint(len(b))
+		if err := cp.Do(cbuf, b); err != nil {
+			return nil, err
+		}
+		b = cbuf.Bytes()
+		pf = payloadFormat(id)
 	}
+	length := uint(len(b))
 	if length > math.MaxUint32 {
-		return nil, Errorf(codes.InvalidArgument, "grpc: message too large (%d bytes)", length)
+		return nil, fmt.Errorf("bgserver: message too large (%d bytes)", length)
 	}
 
-	const (
-		payloadLen = 1
-		sizeLen    = 4
-	)
-
-	var buf = make([]byte, payloadLen+sizeLen+len(b))
-
-	// Write payload format
-	if cp == nil {
-		buf[0] = byte(compressionNone)
-	} else {
-		buf[0] = byte(compressionMade)
+	if ff.Version != FrameV2 {
+		var buf = make([]byte, frameV1HeaderLen+len(b))
+		// Write payload format
+		buf[0] = byte(pf)
+		// Write length of b into buf
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+		// Copy encoded msg to buf
+		copy(buf[frameV1HeaderLen:], b)
+		return buf, nil
 	}
-	// Write length of b into buf
-	binary.BigEndian.PutUint32(buf[1:], uint32(length))
-	// Copy encoded msg to buf
-	copy(buf[5:], b)
 
+	headerLen := frameV2HeaderLen
+	if ff.Checksum {
+		headerLen += checksumLen
+		pf |= flagChecksum
+	}
+	var buf = make([]byte, headerLen+len(b))
+	copy(buf, frameMagic[:])
+	buf[2] = FrameV2
+	buf[3] = byte(pf)
+	binary.BigEndian.PutUint32(buf[4:], uint32(length))
+	if ff.Checksum {
+		binary.BigEndian.PutUint32(buf[frameV2HeaderLen:], crc32.Checksum(b, castagnoliTable))
+	}
+	copy(buf[headerLen:], b)
 	return buf, nil
 }
 
-func checkRecvPayload(pf payloadFormat, recvCompress string, dc Decompressor) error {
-	switch pf {
-	case compressionNone:
-	case compressionMade:
-		if recvCompress == "" {
-			return transport.StreamErrorf(codes.InvalidArgument, "grpc: invalid grpc-encoding %q with compression enabled", recvCompress)
-		}
-		if dc == nil || recvCompress != dc.Type() {
-			return transport.StreamErrorf(codes.InvalidArgument, "grpc: Decompressor is not installed for grpc-encoding %q", recvCompress)
-		}
-	default:
-		return transport.StreamErrorf(codes.InvalidArgument, "grpc: received unexpected payload format %d", pf)
+// checkRecvPayload 返回帧所用压缩算法的Decompressor，没有压缩时返回nil.
+// dcs为本端接受的压缩算法，以算法编号索引.
+func checkRecvPayload(pf payloadFormat, dcs map[uint8]Decompressor) (Decompressor, error) {
+	if pf&^compressionMask != 0 {
+		return nil, fmt.Errorf("bgserver: received unexpected payload format %d", pf)
 	}
-	return nil
+	id := pf.compression()
+	if id == CompressionNone {
+		return nil, nil
+	}
+	dc, ok := dcs[id]
+	if !ok {
+		return nil, fmt.Errorf("bgserver: Decompressor is not installed for compression %d", id)
+	}
+	return dc, nil
 }
 
-// 从网络中接收消息，提取消息并解码
-func recv(p *parser, c Codec, s *transport.Stream, dc Decompressor, m interface{}) error {
+// Recv 从网络中接收消息，提取消息并解码.
+// dcs为本端接受的压缩算法，以帧头中的算法编号索引. 消息解压后超过maxDecompressedSize字节时
+// 返回的错误满足errors.Is(err, ErrDecompressedTooLarge)，此时连接上的数据不再可信，应关闭连接.
+func Recv(p *Parser, c Codec, dcs map[uint8]Decompressor, maxDecompressedSize int, m interface{}) error {
 	pf, d, err := p.recvMsg()
 	if err != nil {
 		return err
 	}
-	if err := checkRecvPayload(pf, s.RecvCompress(), dc); err != nil {
+	dc, err := checkRecvPayload(pf, dcs)
+	if err != nil {
 		return err
 	}
-	if pf == compressionMade {
-		d, err = dc.Do(bytes.NewReader(d))
+	if dc != nil {
+		d, err = dc.Do(bytes.NewReader(d), maxDecompressedSize)
 		if err != nil {
-			return transport.StreamErrorf(codes.Internal, "grpc: failed to decompress the received message %v", err)
+			return fmt.Errorf("bgserver: failed to decompress the received message: %w", err)
 		}
 	}
 	if err := c.Unmarshal(d, m); err != nil {
-		return transport.StreamErrorf(codes.Internal, "grpc: failed to unmarshal the received message %v", err)
+		return fmt.Errorf("bgserver: failed to unmarshal the received message %v", err)
 	}
 	return nil
 }
-
@@ -0,0 +1,189 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	. "bgserver/common"
+)
+
+var testPayload = []byte(strings.Repeat("bgserver frame payload ", 32))
+
+func TestFrameRoundTrip(t *testing.T) {
+	formats := []FrameFormat{
+		{},
+		{Version: FrameV1},
+		{Version: FrameV2},
+		{Version: FrameV2, Checksum: true},
+	}
+	compressors := []Compressor{nil, NewGZIPCompressor()}
+	for _, ff := range formats {
+		for _, cp := range compressors {
+			var cbuf bytes.Buffer
+			frame, err := EncodeFrame(testPayload, cp, &cbuf, ff)
+			if err != nil {
+				t.Fatalf("%+v: encode: %v", ff, err)
+			}
+			want := FrameFormat{Version: FrameV1}
+			if ff.Version == FrameV2 {
+				want = ff
+			}
+			if got := FrameFormatOf(frame); got != want {
+				t.Errorf("%+v: FrameFormatOf = %+v, want %+v", ff, got, want)
+			}
+
+			// 连续两帧，确认第一帧之后的读取位置正确
+			p := NewParser(bytes.NewReader(append(append([]byte(nil), frame...), frame...)))
+			for i := 0; i < 2; i++ {
+				pf, msg, err := p.recvMsg()
+				if err != nil {
+					t.Fatalf("%+v: frame %d: %v", ff, i, err)
+				}
+				payload := testPayload
+				if cp != nil {
+					if id, _ := CompressionID(cp.Type()); pf.compression() != id {
+						t.Errorf("%+v: compression = %d, want %d", ff, pf.compression(), id)
+					}
+					payload, err = NewGZIPDecompressor().Do(bytes.NewReader(msg), 0)
+					if err != nil {
+						t.Fatalf("%+v: decompress: %v", ff, err)
+					}
+				} else if pf != payloadFormat(CompressionNone) {
+					t.Errorf("%+v: payload format = %d, want none", ff, pf)
+				}
+				if !bytes.Equal(payload, testPayload) {
+					t.Fatalf("%+v: round trip changed the payload", ff)
+				}
+			}
+			if _, _, err := p.recvMsg(); err != io.EOF {
+				t.Errorf("%+v: after the last frame got %v, want io.EOF", ff, err)
+			}
+		}
+	}
+}
+
+func TestFrameEmptyPayload(t *testing.T) {
+	for _, ff := range []FrameFormat{{Version: FrameV1}, {Version: FrameV2, Checksum: true}} {
+		frame, err := EncodeFrame(nil, nil, nil, ff)
+		if err != nil {
+			t.Fatalf("%+v: encode: %v", ff, err)
+		}
+		_, msg, err := NewParser(bytes.NewReader(frame)).recvMsg()
+		if err != nil || len(msg) != 0 {
+			t.Errorf("%+v: got %q, %v, want an empty message", ff, msg, err)
+		}
+	}
+}
+
+func encodeTestFrame(t *testing.T, ff FrameFormat) []byte {
+	frame, err := EncodeFrame(testPayload, nil, nil, ff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestRecvMsgErrors(t *testing.T) {
+	v1 := encodeTestFrame(t, FrameFormat{Version: FrameV1})
+	v2 := encodeTestFrame(t, FrameFormat{Version: FrameV2})
+	v2c := encodeTestFrame(t, FrameFormat{Version: FrameV2, Checksum: true})
+
+	tests := []struct {
+		name    string
+		stream  []byte
+		max     int
+		skip    int // 先正常读取的帧数
+		wantErr error
+	}{
+		{name: "empty stream", stream: nil, wantErr: io.EOF},
+		{name: "truncated v1 header", stream: v1[:3], wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated v2 header", stream: v2[:5], wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated checksum", stream: v2c[:frameV2HeaderLen+2], wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated v1 payload", stream: v1[:len(v1)-1], wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated v2 payload", stream: v2c[:len(v2c)-1], wantErr: io.ErrUnexpectedEOF},
+		{name: "bad magic", stream: modify(v2, func(b []byte) { b[1] = 0x00 }), wantErr: ErrBadFrameHeader},
+		{name: "unsupported version", stream: modify(v2, func(b []byte) { b[2] = 3 }), wantErr: ErrBadFrameHeader},
+		{name: "unknown v1 flags", stream: modify(v1, func(b []byte) { b[0] = 0x20 }), wantErr: ErrBadFrameHeader},
+		{name: "v1 after v2", stream: concat(v2, v1), skip: 1, wantErr: ErrBadFrameHeader},
+		{name: "v1 frame over the limit", stream: v1, max: len(testPayload) - 1, wantErr: ErrBadFrameHeader},
+		{name: "v2 frame over the limit", stream: v2c, max: len(testPayload) - 1, wantErr: ErrBadFrameHeader},
+		{name: "huge length", stream: modify(v2, func(b []byte) { copy(b[4:8], []byte{0xff, 0xff, 0xff, 0xff}) }), wantErr: ErrBadFrameHeader},
+		{name: "corrupt payload", stream: modify(v2c, func(b []byte) { b[len(b)-1] ^= 0xff }), wantErr: ErrFrameChecksum},
+		{name: "corrupt checksum", stream: modify(v2c, func(b []byte) { b[frameV2HeaderLen] ^= 0xff }), wantErr: ErrFrameChecksum},
+	}
+	for _, tt := range tests {
+		p := NewParser(bytes.NewReader(tt.stream))
+		p.SetMaxFrameSize(tt.max)
+		for i := 0; i < tt.skip; i++ {
+			if _, _, err := p.recvMsg(); err != nil {
+				t.Fatalf("%s: frame %d: %v", tt.name, i, err)
+			}
+		}
+		_, _, err := p.recvMsg()
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRecvMsgAtTheLimit(t *testing.T) {
+	p := NewParser(bytes.NewReader(encodeTestFrame(t, FrameFormat{Version: FrameV2, Checksum: true})))
+	p.SetMaxFrameSize(len(testPayload))
+	if _, _, err := p.recvMsg(); err != nil {
+		t.Fatalf("frame at the limit: %v", err)
+	}
+}
+
+func TestFrameObserver(t *testing.T) {
+	frame := encodeTestFrame(t, FrameFormat{Version: FrameV2, Checksum: true})
+	// 校验和不匹配的帧同样会被观察到
+	corrupt := modify(frame, func(b []byte) { b[len(b)-1] ^= 0xff })
+	p := NewParser(bytes.NewReader(concat(frame, corrupt)))
+	var observed [][]byte
+	p.SetFrameObserver(func(header, payload []byte) {
+		observed = append(observed, concat(header, payload))
+	})
+	if _, _, err := p.recvMsg(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.recvMsg(); err != ErrFrameChecksum {
+		t.Fatalf("got %v, want ErrFrameChecksum", err)
+	}
+	if len(observed) != 2 || !bytes.Equal(observed[0], frame) || !bytes.Equal(observed[1], corrupt) {
+		t.Errorf("observed frames differ from the stream")
+	}
+}
+
+func TestEncodeFrameUnregisteredCompressor(t *testing.T) {
+	var cbuf bytes.Buffer
+	if _, err := EncodeFrame(testPayload, unregisteredCompressor{}, &cbuf, FrameFormat{Version: FrameV2}); err == nil {
+		t.Error("encoded a frame with an unregistered compressor")
+	}
+}
+
+type unregisteredCompressor struct{}
+
+func (unregisteredCompressor) Do(w io.Writer, p []byte) error {
+	_, err := w.Write(p)
+	return err
+}
+
+func (unregisteredCompressor) Type() string { return "unregistered" }
+
+// modify 返回b的副本，并用f修改它
+func modify(b []byte, f func([]byte)) []byte {
+	b = append([]byte(nil), b...)
+	f(b)
+	return b
+}
+
+func concat(frames ...[]byte) []byte {
+	var b []byte
+	for _, f := range frames {
+		b = append(b, f...)
+	}
+	return b
+}
@@ -0,0 +1,98 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/descriptor"
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	. "bgserver/common"
+	pb "bgserver/message/proto/golang"
+)
+
+// BodyField 描述消息体中与某一消息类型对应的字段(或扩展字段)
+type BodyField struct {
+	Name     string // 字段的完整名字，如binggo.service1.say_hello_request
+	TypeName string // 字段的消息类型的完整名字，如binggo.service1.SayHelloRequest
+	Filename string // 定义该字段的.proto文件
+}
+
+// GetBodyFieldInfo 返回消息类型messageType对应的消息体字段，
+// 按照约定字段编号与消息类型相同，未定义该字段时返回false.
+func GetBodyFieldInfo(messageType int32) (*BodyField, bool) {
+	body := &pb.Body{}
+	if desc, ok := proto.RegisteredExtensions(body)[messageType]; ok {
+		m, ok := desc.ExtensionType.(proto.Message)
+		if !ok {
+			return nil, false
+		}
+		return &BodyField{
+			Name:     desc.Name,
+			TypeName: proto.MessageName(m),
+			Filename: desc.Filename,
+		}, true
+	}
+	fd, md := descriptor.ForMessage(body)
+	for _, f := range md.GetField() {
+		if f.GetNumber() == messageType {
+			return &BodyField{
+				Name:     fd.GetPackage() + "." + f.GetName(),
+				TypeName: strings.TrimPrefix(f.GetTypeName(), "."),
+				Filename: fd.GetName(),
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// LoadFileDescriptor 返回已注册的.proto文件的FileDescriptorProto
+func LoadFileDescriptor(filename string) (*dpb.FileDescriptorProto, error) {
+	gz := proto.FileDescriptor(filename)
+	if gz == nil {
+		return nil, fmt.Errorf("bgserver: file %q is not registered", filename)
+	}
+	// 编译进程序的描述符是可信的，不限制解压后的大小
+	b, err := NewGZIPDecompressor().Do(bytes.NewReader(gz), 0)
+	if err != nil {
+		return nil, err
+	}
+	fd := new(dpb.FileDescriptorProto)
+	if err := proto.Unmarshal(b, fd); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// LoadFileDescriptors 返回filenames及其依赖的所有.proto文件的FileDescriptorProto,
+// 每个文件只出现一次，且被依赖的文件排在前面.
+func LoadFileDescriptors(filenames ...string) ([]*dpb.FileDescriptorProto, error) {
+	var fds []*dpb.FileDescriptorProto
+	seen := make(map[string]bool)
+	var load func(name string) error
+	load = func(name string) error {
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		fd, err := LoadFileDescriptor(name)
+		if err != nil {
+			return err
+		}
+		for _, dep := range fd.GetDependency() {
+			if err := load(dep); err != nil {
+				return err
+			}
+		}
+		fds = append(fds, fd)
+		return nil
+	}
+	for _, name := range filenames {
+		if err := load(name); err != nil {
+			return nil, err
+		}
+	}
+	return fds, nil
+}
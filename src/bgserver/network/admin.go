@@ -0,0 +1,355 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	. "bgserver/common"
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
+	"bgserver/status"
+)
+
+var (
+	ErrConnNotFound = errors.New("the connection is not found")
+)
+
+// ConnInfo 为一条存活连接的状态，用于管理接口的展示
+type ConnInfo struct {
+	ID         uint64            `json:"id"`
+	RemoteAddr string            `json:"remote_addr"`
+	Source     uint32            `json:"source,omitempty"` // 经过鉴权或在会话注册表中绑定的对端身份，没有时为0
+	State      ConnectivityState `json:"state"`
+	InFlight   int64             `json:"in_flight"` // 正在处理(server)或等待响应(client)的请求数
+	ConnStats
+}
+
+func (ci *ConnInfo) toProto() *pb.ConnectionInfo {
+	return &pb.ConnectionInfo{
+		Id:               proto.Uint64(ci.ID),
+		RemoteAddr:       proto.String(ci.RemoteAddr),
+		Source:           proto.Uint32(ci.Source),
+		State:            proto.String(ci.State.String()),
+		ConnectTime:      proto.Int64(ci.ConnectTime.UnixNano() / int64(time.Millisecond)),
+		BytesIn:          proto.Uint64(ci.BytesIn),
+		BytesOut:         proto.Uint64(ci.BytesOut),
+		MsgsIn:           proto.Uint64(ci.MsgsIn),
+		MsgsOut:          proto.Uint64(ci.MsgsOut),
+		InFlight:         proto.Int64(ci.InFlight),
+		LastHeartbeatRtt: proto.Int64(int64(ci.LastHeartbeatRTT / time.Microsecond)),
+	}
+}
+
+// Connections returns the live connections of the server.
+func (s *Server) Connections() []ConnInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]ConnInfo, 0, len(s.conns))
+	for sc := range s.conns {
+		infos = append(infos, sc.info())
+	}
+	return infos
+}
+
+func (sc *serverConn) info() ConnInfo {
+	ci := ConnInfo{
+		ID:         sc.conn.ID(),
+		RemoteAddr: sc.conn.RemoteAddr().String(),
+		State:      Ready,
+		InFlight:   atomic.LoadInt64(&sc.inFlight),
+		ConnStats:  sc.conn.Stats(),
+	}
+	if sc.authInfo != nil {
+		ci.Source = sc.authInfo.Source
+	} else if sc.s.sessions != nil {
+		ci.Source, _ = sc.s.sessions.sourceOf(sc)
+	}
+	return ci
+}
+
+// CloseConnection force-closes the connection with the given id.
+// The requests being processed on it are abandoned.
+func (s *Server) CloseConnection(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sc := range s.conns {
+		if sc.conn.ID() == id {
+			sc.logger.Info("connection closed by admin")
+			return sc.conn.Close()
+		}
+	}
+	return ErrConnNotFound
+}
+
+// Connections returns the connections to all the backend instances of the
+// ClientConn, including those not connected at the moment (with a zero ID).
+func (cc *ClientConn) Connections() []ConnInfo {
+	infos := make([]ConnInfo, 0, len(cc.conns))
+	for _, ac := range cc.conns {
+		ac.mu.Lock()
+		ci := ConnInfo{
+			RemoteAddr: ac.addr,
+			State:      ac.state,
+			InFlight:   int64(len(ac.pending)),
+		}
+		if ac.conn != nil && ac.state == Ready {
+			ci.ID = ac.conn.ID()
+			ci.ConnStats = ac.conn.Stats()
+		}
+		ac.mu.Unlock()
+		infos = append(infos, ci)
+	}
+	return infos
+}
+
+// CloseConnection force-closes the connection with the given id. The pending
+// calls on it fail with ErrConnBroken and the next call reconnects.
+func (cc *ClientConn) CloseConnection(id uint64) error {
+	for _, ac := range cc.conns {
+		ac.mu.Lock()
+		c := ac.conn
+		ac.mu.Unlock()
+		if c != nil && c.ID() == id {
+			ac.logger.Info("connection closed by admin")
+			ac.connBroken(c)
+			return nil
+		}
+	}
+	return ErrConnNotFound
+}
+
+// connAdmin 为可以通过管理接口查看和关闭连接的对象，即Server和ClientConn
+type connAdmin interface {
+	Connections() []ConnInfo
+	CloseConnection(id uint64) error
+	CompressionStats() []CompressionStats
+}
+
+// newAdminHandler 提供以下HTTP接口:
+//
+//	GET  /connections          以JSON数组的形式返回所有存活的连接
+//	POST /connections/close?id=N  强制关闭编号为N的连接
+//	GET  /compression          以JSON数组的形式返回各消息类型的压缩统计
+func newAdminHandler(a connAdmin) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, a.Connections())
+	})
+	mux.HandleFunc("/compression", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, a.CompressionStats())
+	})
+	mux.HandleFunc("/connections/close", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		if err := a.CloseConnection(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "connection %d closed\n", id)
+	})
+	return mux
+}
+
+// writeJSON 以JSON的形式回复GET请求
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// AdminHandler returns an http.Handler serving the admin endpoints of the server:
+// GET /connections lists the live connections, POST /connections/close?id=N
+// force-closes one of them, GET /compression shows the compression statistics
+// and GET /sessions lists the bindings of the session registry.
+func (s *Server) AdminHandler() http.Handler {
+	mux := newAdminHandler(s)
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, s.Sessions())
+	})
+	return mux
+}
+
+// AdminHandler returns an http.Handler serving the admin endpoints of the ClientConn,
+// the same as Server.AdminHandler.
+func (cc *ClientConn) AdminHandler() http.Handler {
+	return newAdminHandler(cc)
+}
+
+// serveAdmin 在addr上启动管理接口的HTTP服务，返回的http.Server用于关闭该服务
+func serveAdmin(addr string, h http.Handler) (*http.Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: h}
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			Error("failed to serve the admin endpoints", "addr", addr, "error", err)
+		}
+	}()
+	return srv, nil
+}
+
+// AdminAddr returns a ServerOption that serves the admin endpoints over HTTP
+// on addr once the server starts serving. The endpoints are not authenticated,
+// addr should only be reachable from a trusted network.
+func AdminAddr(addr string) ServerOption {
+	return func(o *serverOptions) {
+		o.adminAddr = addr
+	}
+}
+
+// AdminMessage returns a ServerOption that makes the server answer ADMIN_REQUEST
+// messages, so that the connections can be managed through the bgserver protocol.
+// A request is only served if authorize accepts the identity of its connection,
+// which is nil without AuthHandshaker; the others get EC_PERMISSION_DENIED. A nil
+// authorize denies all the requests.
+func AdminMessage(authorize func(*AuthInfo) bool) ServerOption {
+	return func(o *serverOptions) {
+		o.adminMessage = true
+		o.adminAuthorize = authorize
+	}
+}
+
+// WithAdminAddr returns a DialOption that serves the admin endpoints of the
+// ClientConn over HTTP on addr until the ClientConn is closed.
+func WithAdminAddr(addr string) DialOption {
+	return func(o *dialOptions) {
+		o.adminAddr = addr
+	}
+}
+
+// WithHeartbeat returns a DialOption that sends a HEART_BEAT_REQUEST on every
+// connection each interval. The round-trip time is reported as LastHeartbeatRTT,
+// and a connection whose heartbeat is not answered within the interval is closed.
+func WithHeartbeat(interval time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.heartbeatInterval = interval
+	}
+}
+
+// handleAdmin 处理ADMIN_REQUEST消息
+func (s *Server) handleAdmin(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+	areq := req.GetBody().GetAdminRequest()
+	if areq == nil {
+		return nil, errors.New("the message has no admin_request")
+	}
+	ai, _ := AuthInfoFromContext(ctx)
+	if s.opts.adminAuthorize == nil || !s.opts.adminAuthorize(ai) {
+		LoggerFromContext(ctx).Warn("admin request denied", "command", areq.GetCommand())
+		return nil, status.Error(int32(pb.ErrorCode_EC_PERMISSION_DENIED), "admin request denied")
+	}
+	aresp := &pb.AdminResponse{
+		Rc: &pb.ResponseCode{Retcode: proto.Int32(int32(pb.ErrorCode_EC_OK))},
+	}
+	switch areq.GetCommand() {
+	case pb.AdminRequest_LIST_CONNECTIONS:
+		for _, ci := range s.Connections() {
+			aresp.Connections = append(aresp.Connections, ci.toProto())
+		}
+	case pb.AdminRequest_CLOSE_CONNECTION:
+		if err := s.CloseConnection(areq.GetConnId()); err != nil {
+			aresp.Rc = &pb.ResponseCode{
+				Retcode:      proto.Int32(int32(pb.ErrorCode_EC_NOT_FOUND)),
+				ErrorMessage: proto.String(err.Error()),
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown admin command %v", areq.GetCommand())
+	}
+	LoggerFromContext(ctx).Info("admin request", "command", areq.GetCommand(), "conn_id", areq.GetConnId())
+	return &pb.BMessage{
+		Head: NewResponseHead(req.GetHead()),
+		Body: &pb.Body{AdminResponse: aresp},
+	}, nil
+}
+
+// handleHeartBeat 是HEART_BEAT_REQUEST的默认处理函数，原样返回请求中的payload
+func handleHeartBeat(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+	return &pb.BMessage{
+		Head: NewResponseHead(req.GetHead()),
+		Body: &pb.Body{
+			HeartBeatResponse: &pb.HeartBeatResponse{
+				Rc:      &pb.ResponseCode{Retcode: proto.Int32(int32(pb.ErrorCode_EC_OK))},
+				Payload: req.GetBody().GetHeartBeatRequest().GetPayload(),
+			},
+		},
+	}, nil
+}
+
+// builtinHandler 返回未注册Handler的消息类型的内置处理函数
+func (s *Server) builtinHandler(messageType int32) (Handler, bool) {
+	switch pb.MessageType(messageType) {
+	case pb.MessageType_HEART_BEAT_REQUEST:
+		return handleHeartBeat, true
+	case pb.MessageType_ADMIN_REQUEST:
+		if s.opts.adminMessage {
+			return s.handleAdmin, true
+		}
+	case pb.MessageType_REFLECTION_REQUEST:
+		if s.opts.reflection {
+			return s.handleReflection, true
+		}
+	case pb.MessageType_SUBSCRIBE_REQUEST:
+		return s.handleSubscribe, true
+	}
+	return nil, false
+}
+
+// heartbeatLoop 定期在c上发送心跳，直到c被关闭或替换
+func (ac *addrConn) heartbeatLoop(c *Conn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ac.mu.Lock()
+		alive := ac.conn == c && ac.state == Ready
+		ac.mu.Unlock()
+		if !alive {
+			return
+		}
+		req := &pb.BMessage{
+			Head: &pb.Head{
+				Version:     proto.Uint32(c.Version()),
+				SessionNo:   proto.String(NewSessionNo()),
+				MessageType: proto.Int32(int32(pb.MessageType_HEART_BEAT_REQUEST)),
+				Source:      proto.Uint32(c.source),
+			},
+			Body: &pb.Body{HeartBeatRequest: &pb.HeartBeatRequest{}},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		start := time.Now()
+		resp, _, err := ac.invoke(ctx, req)
+		cancel()
+		if err == nil {
+			// 被server拒绝的心跳(如source不符)不能说明连接健康
+			err = CheckResponse(resp)
+		}
+		if err != nil {
+			ac.logger.Warn("heartbeat failed", "error", err)
+			ac.connBroken(c)
+			return
+		}
+		atomic.StoreInt64(&c.heartbeatRTT, int64(time.Since(start)))
+	}
+}
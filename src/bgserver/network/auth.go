@@ -0,0 +1,268 @@
+package network
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
+)
+
+var (
+	ErrAuthFailed = errors.New("authentication failed")
+)
+
+// 内置的鉴权方式
+const (
+	AuthMethodHMAC  = "hmac"
+	AuthMethodToken = "token"
+)
+
+// AuthInfo 为握手鉴权后得到的对端身份
+type AuthInfo struct {
+	Source uint32 // 对端经过鉴权的Head.source
+	Method string // 鉴权方式
+}
+
+// ServerHandshaker 在server接受连接后、处理任何应用消息前与client完成握手.
+type ServerHandshaker interface {
+	// ServerHandshake 在c上完成握手并返回client的身份，返回错误时连接会被关闭
+	ServerHandshake(c *Conn) (*AuthInfo, error)
+}
+
+// ClientHandshaker 在client建立连接后、发送任何应用消息前与server完成握手.
+type ClientHandshaker interface {
+	ClientHandshake(c *Conn) error
+}
+
+// AuthHandshaker returns a ServerOption that sets the handshaker used to
+// authenticate every accepted connection.
+func AuthHandshaker(h ServerHandshaker) ServerOption {
+	return func(o *serverOptions) {
+		o.handshaker = h
+	}
+}
+
+// WithAuthHandshaker returns a DialOption that sets the handshaker used to
+// authenticate every established connection.
+func WithAuthHandshaker(h ClientHandshaker) DialOption {
+	return func(o *dialOptions) {
+		o.handshaker = h
+	}
+}
+
+type authInfoKey struct{}
+
+// NewContextWithAuthInfo returns a new context carrying the authenticated identity of the peer.
+func NewContextWithAuthInfo(ctx context.Context, ai *AuthInfo) context.Context {
+	return context.WithValue(ctx, authInfoKey{}, ai)
+}
+
+// AuthInfoFromContext returns the authenticated identity of the peer in ctx, if any.
+func AuthInfoFromContext(ctx context.Context) (*AuthInfo, bool) {
+	ai, ok := ctx.Value(authInfoKey{}).(*AuthInfo)
+	return ai, ok
+}
+
+// NewHMACServerHandshaker 创建基于共享密钥的challenge/response鉴权:
+// server下发一个随机数，client返回用共享密钥对随机数和source计算的HMAC-SHA256.
+// keys返回某个source对应的共享密钥.
+func NewHMACServerHandshaker(keys func(source uint32) ([]byte, error)) ServerHandshaker {
+	return &hmacServerHandshaker{keys: keys}
+}
+
+// NewHMACClientHandshaker 创建与NewHMACServerHandshaker配对的client端握手
+func NewHMACClientHandshaker(source uint32, key []byte) ClientHandshaker {
+	return &hmacClientHandshaker{source: source, key: key}
+}
+
+// NewTokenServerHandshaker 创建基于token的鉴权，verify检查token是否属于该source
+func NewTokenServerHandshaker(verify func(source uint32, token []byte) error) ServerHandshaker {
+	return &tokenServerHandshaker{verify: verify}
+}
+
+// NewTokenClientHandshaker 创建与NewTokenServerHandshaker配对的client端握手
+func NewTokenClientHandshaker(source uint32, token []byte) ClientHandshaker {
+	return &tokenClientHandshaker{source: source, token: token}
+}
+
+type hmacServerHandshaker struct {
+	keys func(source uint32) ([]byte, error)
+}
+
+func (h *hmacServerHandshaker) ServerHandshake(c *Conn) (*AuthInfo, error) {
+	req, hreq, err := readHandshakeRequest(c, AuthMethodHMAC)
+	if err != nil {
+		return nil, err
+	}
+	source := req.GetHead().GetSource()
+	key, err := h.keys(source)
+	if err != nil {
+		writeHandshakeResponse(c, req, pb.ErrorCode_EC_UNAUTHENTICATED, nil)
+		return nil, fmt.Errorf("%v: no key for source %d: %v", ErrAuthFailed, source, err)
+	}
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	if err := writeHandshakeResponse(c, req, pb.ErrorCode_EC_OK, &pb.HandshakeResponse{Challenge: challenge}); err != nil {
+		return nil, err
+	}
+
+	req, hreq, err = readHandshakeRequest(c, AuthMethodHMAC)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetHead().GetSource() != source || !hmac.Equal(hreq.GetAuthProof(), hmacProof(key, challenge, source)) {
+		writeHandshakeResponse(c, req, pb.ErrorCode_EC_UNAUTHENTICATED, nil)
+		return nil, fmt.Errorf("%v: invalid proof from source %d", ErrAuthFailed, source)
+	}
+	if err := writeHandshakeResponse(c, req, pb.ErrorCode_EC_OK, nil); err != nil {
+		return nil, err
+	}
+	return &AuthInfo{Source: source, Method: AuthMethodHMAC}, nil
+}
+
+type hmacClientHandshaker struct {
+	source uint32
+	key    []byte
+}
+
+func (h *hmacClientHandshaker) ClientHandshake(c *Conn) error {
+	resp, err := authRoundTrip(c, h.source, &pb.HandshakeRequest{
+		AuthMethod: proto.String(AuthMethodHMAC),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = authRoundTrip(c, h.source, &pb.HandshakeRequest{
+		AuthMethod: proto.String(AuthMethodHMAC),
+		AuthProof:  hmacProof(h.key, resp.GetChallenge(), h.source),
+	})
+	return err
+}
+
+// hmacProof 计算 HMAC-SHA256(key, challenge || source)
+func hmacProof(key, challenge []byte, source uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], source)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(challenge)
+	mac.Write(b[:])
+	return mac.Sum(nil)
+}
+
+type tokenServerHandshaker struct {
+	verify func(source uint32, token []byte) error
+}
+
+func (h *tokenServerHandshaker) ServerHandshake(c *Conn) (*AuthInfo, error) {
+	req, hreq, err := readHandshakeRequest(c, AuthMethodToken)
+	if err != nil {
+		return nil, err
+	}
+	source := req.GetHead().GetSource()
+	if err := h.verify(source, hreq.GetAuthToken()); err != nil {
+		writeHandshakeResponse(c, req, pb.ErrorCode_EC_UNAUTHENTICATED, nil)
+		return nil, fmt.Errorf("%v: invalid token from source %d: %v", ErrAuthFailed, source, err)
+	}
+	if err := writeHandshakeResponse(c, req, pb.ErrorCode_EC_OK, nil); err != nil {
+		return nil, err
+	}
+	return &AuthInfo{Source: source, Method: AuthMethodToken}, nil
+}
+
+type tokenClientHandshaker struct {
+	source uint32
+	token  []byte
+}
+
+func (h *tokenClientHandshaker) ClientHandshake(c *Conn) error {
+	_, err := authRoundTrip(c, h.source, &pb.HandshakeRequest{
+		AuthMethod: proto.String(AuthMethodToken),
+		AuthToken:  h.token,
+	})
+	return err
+}
+
+// readHandshakeRequest 读取一条握手请求，并检查鉴权方式是否为method
+func readHandshakeRequest(c *Conn, method string) (*pb.BMessage, *pb.HandshakeRequest, error) {
+	req, err := c.ReadMsg()
+	if err != nil {
+		return nil, nil, err
+	}
+	hreq := req.GetBody().GetHandshakeRequest()
+	if pb.MessageType(req.GetHead().GetMessageType()) != pb.MessageType_HANDSHAKE_REQUEST || hreq == nil {
+		writeHandshakeResponse(c, req, pb.ErrorCode_EC_UNAUTHENTICATED, nil)
+		return nil, nil, fmt.Errorf("%v: expect a handshake request, got message type %d", ErrAuthFailed, req.GetHead().GetMessageType())
+	}
+	if hreq.GetAuthMethod() != method {
+		writeHandshakeResponse(c, req, pb.ErrorCode_EC_UNAUTHENTICATED, nil)
+		return nil, nil, fmt.Errorf("%v: unsupported auth method %q", ErrAuthFailed, hreq.GetAuthMethod())
+	}
+	return req, hreq, nil
+}
+
+// writeHandshakeResponse 回复一条握手响应，hresp为nil时只携带返回码
+func writeHandshakeResponse(c *Conn, req *pb.BMessage, code pb.ErrorCode, hresp *pb.HandshakeResponse) error {
+	if hresp == nil {
+		hresp = &pb.HandshakeResponse{}
+	}
+	hresp.Rc = &pb.ResponseCode{Retcode: proto.Int32(int32(code))}
+	return c.WriteMsg(&pb.BMessage{
+		Head: NewResponseHead(req.GetHead()),
+		Body: &pb.Body{
+			HandshakeResponse: hresp,
+		},
+	})
+}
+
+// handshakeRoundTrip 发送一条握手请求并等待server的握手响应
+func handshakeRoundTrip(c *Conn, source uint32, hreq *pb.HandshakeRequest) (*pb.HandshakeResponse, *pb.ResponseCode, error) {
+	version := c.Version()
+	if version == 0 {
+		version = hreq.GetMaxVersion()
+	}
+	req := &pb.BMessage{
+		Head: &pb.Head{
+			Version:     proto.Uint32(version),
+			SessionNo:   proto.String(NewSessionNo()),
+			MessageType: proto.Int32(int32(pb.MessageType_HANDSHAKE_REQUEST)),
+			Source:      proto.Uint32(source),
+		},
+		Body: &pb.Body{
+			HandshakeRequest: hreq,
+		},
+	}
+	if err := c.WriteMsg(req); err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.ReadMsg()
+	if err != nil {
+		return nil, nil, err
+	}
+	if pb.MessageType(resp.GetHead().GetMessageType()) != pb.MessageType_HANDSHAKE_RESPONSE {
+		return nil, nil, fmt.Errorf("bgserver: expect a handshake response, got message type %d", resp.GetHead().GetMessageType())
+	}
+	return resp.GetBody().GetHandshakeResponse(), GetResponseCode(resp), nil
+}
+
+// authRoundTrip 完成一轮鉴权握手，server拒绝时返回ErrAuthFailed
+func authRoundTrip(c *Conn, source uint32, hreq *pb.HandshakeRequest) (*pb.HandshakeResponse, error) {
+	hresp, rc, err := handshakeRoundTrip(c, source, hreq)
+	if err != nil {
+		return nil, err
+	}
+	if rc.GetRetcode() != int32(pb.ErrorCode_EC_OK) {
+		return nil, fmt.Errorf("%v: retcode %d %s", ErrAuthFailed, rc.GetRetcode(), rc.GetErrorMessage())
+	}
+	c.source = source
+	return hresp, nil
+}
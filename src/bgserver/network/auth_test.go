@@ -0,0 +1,137 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	pb "bgserver/message/proto/golang"
+)
+
+var testKeys = map[uint32][]byte{42: []byte("key of 42"), 43: []byte("key of 43")}
+
+func hmacKeys(source uint32) ([]byte, error) {
+	if key, ok := testKeys[source]; ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown source")
+}
+
+// authServer 启动一个使用h鉴权的server，其handler将请求上下文中的AuthInfo发送到infos
+func authServer(t *testing.T, h ServerHandshaker) (string, chan *AuthInfo) {
+	infos := make(chan *AuthInfo, 1)
+	s := NewServer(AuthHandshaker(h))
+	s.Handle(testMessageType, func(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+		ai, _ := AuthInfoFromContext(ctx)
+		infos <- ai
+		return echoHandler(ctx, req)
+	})
+	return startServer(t, s), infos
+}
+
+// expectAuthFailed 检查Dial因鉴权失败而返回错误
+func expectAuthFailed(t *testing.T, name, addr string, h ClientHandshaker) {
+	cc, err := Dial(addr, WithAuthHandshaker(h))
+	if err == nil {
+		cc.Close()
+		t.Fatalf("%s: the handshake succeeded", name)
+	}
+	if !strings.Contains(err.Error(), ErrAuthFailed.Error()) {
+		t.Fatalf("%s: got %v, want ErrAuthFailed", name, err)
+	}
+}
+
+func TestHMACHandshake(t *testing.T) {
+	addr, infos := authServer(t, NewHMACServerHandshaker(hmacKeys))
+	cc := dial(t, addr, WithAuthHandshaker(NewHMACClientHandshaker(42, testKeys[42])))
+	if rc := invoke(t, cc, newRequest(testMessageType, 42)); rc != 0 {
+		t.Fatalf("retcode %d", rc)
+	}
+	if ai := <-infos; ai == nil || ai.Source != 42 || ai.Method != AuthMethodHMAC {
+		t.Fatalf("AuthInfo %+v, want source 42 by hmac", ai)
+	}
+	// 已鉴权的连接不能冒充其它source
+	if rc := invoke(t, cc, newRequest(testMessageType, 43)); rc != int32(pb.ErrorCode_EC_SOURCE_MISMATCH) {
+		t.Fatalf("retcode %d, want EC_SOURCE_MISMATCH", rc)
+	}
+}
+
+// scriptedHMACHandshaker 按指定的source和proof完成两轮hmac握手，用于构造异常的client
+type scriptedHMACHandshaker struct {
+	first, second uint32
+	proof         func(challenge []byte) []byte
+}
+
+func (h *scriptedHMACHandshaker) ClientHandshake(c *Conn) error {
+	resp, err := authRoundTrip(c, h.first, &pb.HandshakeRequest{AuthMethod: proto.String(AuthMethodHMAC)})
+	if err != nil {
+		return err
+	}
+	_, err = authRoundTrip(c, h.second, &pb.HandshakeRequest{
+		AuthMethod: proto.String(AuthMethodHMAC),
+		AuthProof:  h.proof(resp.GetChallenge()),
+	})
+	return err
+}
+
+func TestHMACHandshakeRejects(t *testing.T) {
+	addr, _ := authServer(t, NewHMACServerHandshaker(hmacKeys))
+
+	expectAuthFailed(t, "wrong key", addr, NewHMACClientHandshaker(42, []byte("wrong key")))
+	expectAuthFailed(t, "unknown source", addr, NewHMACClientHandshaker(7, []byte("any key")))
+	expectAuthFailed(t, "token against hmac", addr, NewTokenClientHandshaker(42, []byte("token")))
+
+	// 第二轮换成另一个source，即使proof对该source有效也被拒绝
+	expectAuthFailed(t, "source changed", addr, &scriptedHMACHandshaker{
+		first:  42,
+		second: 43,
+		proof:  func(challenge []byte) []byte { return hmacProof(testKeys[43], challenge, 43) },
+	})
+
+	// 记录一次成功握手的proof，在新连接上重放
+	var recorded []byte
+	cc := dial(t, addr, WithAuthHandshaker(&scriptedHMACHandshaker{
+		first:  42,
+		second: 42,
+		proof: func(challenge []byte) []byte {
+			recorded = hmacProof(testKeys[42], challenge, 42)
+			return recorded
+		},
+	}))
+	cc.Close()
+	expectAuthFailed(t, "replayed proof", addr, &scriptedHMACHandshaker{
+		first:  42,
+		second: 42,
+		proof: func(challenge []byte) []byte {
+			if bytes.Equal(hmacProof(testKeys[42], challenge, 42), recorded) {
+				t.Error("the server sent the same challenge twice")
+			}
+			return recorded
+		},
+	})
+}
+
+func TestTokenHandshake(t *testing.T) {
+	verify := func(source uint32, token []byte) error {
+		if source == 42 && string(token) == "token of 42" {
+			return nil
+		}
+		return errors.New("invalid token")
+	}
+	addr, infos := authServer(t, NewTokenServerHandshaker(verify))
+	cc := dial(t, addr, WithAuthHandshaker(NewTokenClientHandshaker(42, []byte("token of 42"))))
+	if rc := invoke(t, cc, newRequest(testMessageType, 42)); rc != 0 {
+		t.Fatalf("retcode %d", rc)
+	}
+	if ai := <-infos; ai == nil || ai.Source != 42 || ai.Method != AuthMethodToken {
+		t.Fatalf("AuthInfo %+v, want source 42 by token", ai)
+	}
+
+	expectAuthFailed(t, "wrong token", addr, NewTokenClientHandshaker(42, []byte("token of 43")))
+	expectAuthFailed(t, "token of another source", addr, NewTokenClientHandshaker(43, []byte("token of 42")))
+	expectAuthFailed(t, "hmac against token", addr, NewHMACClientHandshaker(42, testKeys[42]))
+}
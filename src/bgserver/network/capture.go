@@ -0,0 +1,257 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "bgserver/common"
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
+)
+
+// 捕获文件由连续的记录组成，每条记录为
+//
+//	magic(2) | direction(1) | timestamp(8) | conn id(8) | length(4) | frame
+//
+// 整数均为大端，timestamp为Unix纳秒，frame为连接上收发的完整的帧(包括帧头)，
+// 与线上的字节完全一致. 一条记录总是一次写入，文件切分不会把它截断.
+const captureHeaderLen = 2 + 1 + 8 + 8 + 4
+
+var captureMagic = [2]byte{0xb6, 0xca}
+
+var ErrBadCaptureRecord = errors.New("bgserver: bad capture record")
+
+// CaptureDirection 为被捕获的帧相对于捕获方的方向
+type CaptureDirection uint8
+
+const (
+	CaptureIn  CaptureDirection = 1 // 从对端收到的帧
+	CaptureOut CaptureDirection = 2 // 发送给对端的帧
+)
+
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureIn:
+		return "in"
+	case CaptureOut:
+		return "out"
+	}
+	return fmt.Sprintf("CaptureDirection(%d)", uint8(d))
+}
+
+// CaptureRecord 为捕获文件中的一条记录
+type CaptureRecord struct {
+	Direction CaptureDirection
+	Time      time.Time
+	ConnID    uint64 // 捕获方进程内的连接编号，见Conn.ID
+	Frame     []byte // 完整的帧，包括帧头
+}
+
+// Capture 将连接上收发的每一帧写入按大小和时间切分的捕获文件，用于离线分析和回放(见bgreplay).
+// 一个Capture可以被多个Server和ClientConn共享.
+type Capture struct {
+	mu  sync.Mutex
+	f   *RotatingFile
+	buf []byte
+}
+
+// NewCapture opens (or creates) the capture file at path for appending. The files
+// are only readable by the owner unless opts.Perm says otherwise, since the
+// captured messages may carry sensitive data.
+func NewCapture(path string, opts RotateOptions) (*Capture, error) {
+	if opts.Perm == 0 {
+		opts.Perm = 0600
+	}
+	f, err := NewRotatingFile(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{f: f}, nil
+}
+
+// record 写入一条记录，frame的各部分拼接为完整的帧. 捕获失败不影响连接本身.
+func (c *Capture) record(dir CaptureDirection, connID uint64, frame ...[]byte) {
+	if len(frame) == 0 {
+		return
+	}
+	n := 0
+	for _, b := range frame {
+		n += len(b)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	buf := append(c.buf[:0], captureMagic[0], captureMagic[1], byte(dir))
+	buf = appendUint64(buf, uint64(time.Now().UnixNano()))
+	buf = appendUint64(buf, connID)
+	buf = append(buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	for _, b := range frame {
+		buf = append(buf, b...)
+	}
+	if _, err := c.f.Write(buf); err != nil {
+		Warn("failed to write the capture file", "error", err)
+	}
+	// 不保留过大的缓冲区
+	if cap(buf) <= 1<<20 {
+		c.buf = buf
+	} else {
+		c.buf = nil
+	}
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	return append(b, tmp[:]...)
+}
+
+// Close closes the capture file. The connections using the Capture must be closed first.
+func (c *Capture) Close() error {
+	return c.f.Close()
+}
+
+// CaptureTo returns a ServerOption that records every frame received and sent by the
+// server, including the handshakes, to c. The auth token and proof of the handshake
+// requests are removed from the records.
+func CaptureTo(c *Capture) ServerOption {
+	return func(o *serverOptions) {
+		o.capture = c
+	}
+}
+
+// WithCapture returns a DialOption that records every frame received and sent by
+// the ClientConn, including the handshakes, to c. The auth token and proof of the
+// handshake requests are removed from the records.
+func WithCapture(c *Capture) DialOption {
+	return func(o *dialOptions) {
+		o.capture = c
+	}
+}
+
+// setCapture 开始捕获连接上收发的帧，需在读写任何消息前调用
+func (c *Conn) setCapture(capture *Capture) {
+	if capture == nil {
+		return
+	}
+	c.capture = capture
+	c.captureHandshake = 1
+	c.parser.SetFrameObserver(func(header, payload []byte) {
+		if atomic.LoadInt32(&c.captureHandshake) == 1 {
+			frame := append(append([]byte(nil), header...), payload...)
+			capture.record(CaptureIn, c.id, redactAuth(c.codec, frame)...)
+			return
+		}
+		capture.record(CaptureIn, c.id, header, payload)
+	})
+}
+
+// handshakeDone 在版本协商和鉴权握手完成后调用，之后捕获的帧不再检查鉴权信息
+func (c *Conn) handshakeDone() {
+	atomic.StoreInt32(&c.captureHandshake, 0)
+}
+
+// redactAuth 去掉握手请求中的auth_token和auth_proof，避免凭据被写入捕获文件. 其它帧原样返回，
+// 握手期间无法解码的帧不记录(返回nil).
+func redactAuth(codec Codec, frame []byte) [][]byte {
+	m, err := DecodeFrame(codec, frame)
+	if err != nil {
+		return nil
+	}
+	hreq := m.GetBody().GetHandshakeRequest()
+	if hreq == nil || (hreq.AuthToken == nil && hreq.AuthProof == nil) {
+		return [][]byte{frame}
+	}
+	hreq.AuthToken, hreq.AuthProof = nil, nil
+	b, err := codec.Marshal(m)
+	if err != nil {
+		return nil
+	}
+	redacted, err := EncodeFrame(b, nil, nil, FrameFormatOf(frame))
+	if err != nil {
+		return nil
+	}
+	return [][]byte{redacted}
+}
+
+// captureWriter 记录写入的每一帧，writeMsg总是一次写入一个完整的帧
+type captureWriter struct {
+	w io.Writer
+	c *Conn
+}
+
+func (w captureWriter) Write(frame []byte) (int, error) {
+	if atomic.LoadInt32(&w.c.captureHandshake) == 1 {
+		w.c.capture.record(CaptureOut, w.c.id, redactAuth(w.c.codec, frame)...)
+	} else {
+		w.c.capture.record(CaptureOut, w.c.id, frame)
+	}
+	return w.w.Write(frame)
+}
+
+// CaptureReader 从捕获文件中依次读取记录
+type CaptureReader struct {
+	r            *bufio.Reader
+	header       [captureHeaderLen]byte
+	maxFrameSize int // 一帧消息体的大小上限，与Parser相同
+}
+
+// NewCaptureReader creates a CaptureReader reading the records from r. It accepts
+// frames whose payload is up to DefaultMaxFrameSize bytes.
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{r: bufio.NewReader(r), maxFrameSize: DefaultMaxFrameSize}
+}
+
+// SetMaxFrameSize 设置记录中一帧消息体的大小上限，n <= 0时使用DefaultMaxFrameSize.
+// 超过上限的记录在分配内存前即返回ErrBadCaptureRecord.
+func (r *CaptureReader) SetMaxFrameSize(n int) {
+	if n <= 0 {
+		n = DefaultMaxFrameSize
+	}
+	r.maxFrameSize = n
+}
+
+// Next returns the next record, or io.EOF if no records remain.
+func (r *CaptureReader) Next() (*CaptureRecord, error) {
+	h := r.header[:]
+	if _, err := io.ReadFull(r.r, h); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: truncated header", ErrBadCaptureRecord)
+		}
+		return nil, err
+	}
+	if h[0] != captureMagic[0] || h[1] != captureMagic[1] {
+		return nil, fmt.Errorf("%w: bad magic %#x%02x", ErrBadCaptureRecord, h[0], h[1])
+	}
+	// 长度来自文件，在分配内存前检查，避免损坏的捕获文件使读取方分配多达4GB的内存
+	n := binary.BigEndian.Uint32(h[19:])
+	if uint64(n) > uint64(r.maxFrameSize)+MaxFrameHeaderLen {
+		return nil, fmt.Errorf("%w: frame of %d bytes exceeds the limit of %d", ErrBadCaptureRecord, n, r.maxFrameSize+MaxFrameHeaderLen)
+	}
+	rec := &CaptureRecord{
+		Direction: CaptureDirection(h[2]),
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(h[3:]))),
+		ConnID:    binary.BigEndian.Uint64(h[11:]),
+		Frame:     make([]byte, n),
+	}
+	if _, err := io.ReadFull(r.r, rec.Frame); err != nil {
+		return nil, fmt.Errorf("%w: truncated frame: %v", ErrBadCaptureRecord, err)
+	}
+	return rec, nil
+}
+
+// DecodeFrame decodes a captured frame, compressed with any registered algorithm,
+// into a BMessage.
+func DecodeFrame(c Codec, frame []byte) (*pb.BMessage, error) {
+	m := new(pb.BMessage)
+	dcs := compressionOptions{}.accepted()
+	if err := readMsg(NewParser(bytes.NewReader(frame)), c, dcs, 0, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,130 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	. "bgserver/common"
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture")
+	c, err := NewCapture(path, RotateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.record(CaptureIn, 7, []byte{1, 2}, []byte{3})
+	c.record(CaptureOut, 7, []byte{4})
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("capture file mode %v, want 0600", perm)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := NewCaptureReader(f)
+	for _, want := range []struct {
+		dir   CaptureDirection
+		frame []byte
+	}{{CaptureIn, []byte{1, 2, 3}}, {CaptureOut, []byte{4}}} {
+		rec, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Direction != want.dir || rec.ConnID != 7 || !bytes.Equal(rec.Frame, want.frame) {
+			t.Fatalf("record %+v, want %v %v", rec, want.dir, want.frame)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("got %v after the last record, want io.EOF", err)
+	}
+}
+
+// captureHeader 返回帧长度为n的记录头
+func captureHeader(n uint32) []byte {
+	h := make([]byte, captureHeaderLen)
+	copy(h, captureMagic[:])
+	h[2] = byte(CaptureIn)
+	binary.BigEndian.PutUint32(h[19:], n)
+	return h
+}
+
+func TestCaptureReaderRejectsBadRecords(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"huge frame", captureHeader(0xffffffff)},
+		{"frame over the limit", captureHeader(1024 + MaxFrameHeaderLen + 1)},
+		{"bad magic", append([]byte{0, 0}, captureHeader(1)[2:]...)},
+		{"truncated header", captureHeader(1)[:10]},
+		{"truncated frame", append(captureHeader(4), 1, 2)},
+	}
+	for _, tt := range tests {
+		r := NewCaptureReader(bytes.NewReader(tt.data))
+		r.SetMaxFrameSize(1024)
+		if _, err := r.Next(); !errors.Is(err, ErrBadCaptureRecord) {
+			t.Errorf("%s: got %v, want ErrBadCaptureRecord", tt.name, err)
+		}
+	}
+	// 上限以内的帧可以读出
+	data := append(captureHeader(1024+MaxFrameHeaderLen), make([]byte, 1024+MaxFrameHeaderLen)...)
+	r := NewCaptureReader(bytes.NewReader(data))
+	r.SetMaxFrameSize(1024)
+	if _, err := r.Next(); err != nil {
+		t.Errorf("frame at the limit: %v", err)
+	}
+}
+
+func TestRedactAuth(t *testing.T) {
+	codec := NewProtoCodec()
+	m := &pb.BMessage{
+		Head: &pb.Head{MessageType: proto.Int32(int32(pb.MessageType_HANDSHAKE_REQUEST))},
+		Body: &pb.Body{HandshakeRequest: &pb.HandshakeRequest{
+			AuthMethod: proto.String(AuthMethodToken),
+			AuthToken:  []byte("secret"),
+		}},
+	}
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ff := range []FrameFormat{{Version: FrameV1}, {Version: FrameV2, Checksum: true}} {
+		frame, err := EncodeFrame(b, nil, nil, ff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := redactAuth(codec, frame)
+		if len(out) != 1 {
+			t.Fatalf("%+v: the handshake request is not recorded", ff)
+		}
+		if bytes.Contains(out[0], []byte("secret")) {
+			t.Fatalf("%+v: the token is recorded", ff)
+		}
+		got, err := DecodeFrame(codec, out[0])
+		if err != nil {
+			t.Fatalf("%+v: %v", ff, err)
+		}
+		if got.GetBody().GetHandshakeRequest().GetAuthMethod() != AuthMethodToken {
+			t.Fatalf("%+v: the auth method is lost: %v", ff, got)
+		}
+	}
+}
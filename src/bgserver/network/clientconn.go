@@ -4,9 +4,19 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	. "bgserver/common"
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
 )
 
 // 定义一些常用的错误
@@ -14,6 +24,8 @@ var (
 	ErrUnspecTarget			= errors.New("target is unspecified")
 	ErrClientConnClosing	= errors.New("the client connection is closing")
 	ErrClientConnTimeout	= errors.New("timed out trying to connect")
+	ErrConnBroken			= errors.New("the connection is broken")
+	ErrInvalidMessage		= errors.New("the message has no head")
 )
 
 var (
@@ -29,9 +41,21 @@ type ConnectOptions struct {
 // client发起连接时可指定的选项
 type dialOptions struct {
 	codec    Codec			// 编码解码
-	cp       Compressor		// 压缩
-	dc       Decompressor	// 解压缩
+	compression	compressionOptions	// 压缩算法的选择
+	frameChecksum	bool				// 使用v2帧头时是否携带CRC32C
+	maxFrameSize	int					// 接收的一帧消息体的大小上限，为0时使用DefaultMaxFrameSize
+	capture		*Capture				// 捕获收发的帧，为nil时不捕获
 	copts    ConnectOptions // 用于连接相关的设置，比如超时、鉴权、拨号函数选择等
+	retryPolicies	map[int32]RetryPolicy	// 按消息类型设置的重试策略
+	retryBudget		*RetryBudget			// 重试预算，避免重试放大故障
+	hedgingPolicies	map[int32]HedgingPolicy	// 按消息类型设置的对冲请求策略
+	resolver		Resolver				// 将target解析为后端实例地址
+	handshaker		ClientHandshaker		// 连接建立后的鉴权握手
+	versions		versionRange			// 支持的协议版本范围
+	heartbeatInterval	time.Duration		// 心跳间隔，为0时不发送心跳
+	adminAddr		string					// 提供管理接口的HTTP地址，为空时不提供
+	shadow		*Shadow					// 复制一部分请求作为影子流量，为nil时不复制
+	msgHandler	MessageHandler			// 处理server主动发送的消息，为nil时丢弃
 }
 
 // 用于设置dialOptions中的字段
@@ -44,15 +68,21 @@ func WithCodec(c Codec) DialOption {
 	}
 }
 
+// WithCompressor returns a DialOption that adds a compressor for outbound messages.
+// The first compressor accepted by the server is used; compressors added earlier
+// are preferred. cp must be registered with common.RegisterCompression.
 func WithCompressor(cp Compressor) DialOption {
 	return func(o *dialOptions) {
-		o.cp = cp
+		o.compression.compressors = append(o.compression.compressors, cp)
 	}
 }
 
+// WithDecompressor returns a DialOption that adds a compression algorithm the
+// client accepts for inbound messages. Without it every registered algorithm is
+// accepted.
 func WithDecompressor(dc Decompressor) DialOption {
 	return func(o *dialOptions) {
-		o.dc = dc
+		o.compression.decompressors = append(o.compression.decompressors, dc)
 	}
 }
 
@@ -69,8 +99,41 @@ func WithDialer(f func(addr string, timeout time.Duration) (net.Conn, error)) Di
 		o.copts.Dialer = f
 	}
 }
+
+// WithResolver returns a DialOption that specifies how the target is resolved
+// into the addresses of backend instances.
+func WithResolver(r Resolver) DialOption {
+	return func(o *dialOptions) {
+		o.resolver = r
+	}
+}
+
+// Resolver 将target解析为一组后端实例的地址
+type Resolver interface {
+	Resolve(target string) ([]string, error)
+}
+
+// listResolver 是默认的Resolver，target为以逗号分隔的地址列表，如"10.0.0.1:8080,10.0.0.2:8080"
+type listResolver struct{}
+
+func (listResolver) Resolve(target string) ([]string, error) {
+	var addrs []string
+	for _, addr := range strings.Split(target, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, ErrUnspecTarget
+	}
+	return addrs, nil
+}
+
 // Dial creates a client connection the given target.
 func Dial(target string, opts ...DialOption) (*ClientConn, error) {
+	if target == "" {
+		return nil, ErrUnspecTarget
+	}
 	cc := &ClientConn{	// 创建一个ClientConn对象
 		target: target,
 	}
@@ -79,11 +142,51 @@ func Dial(target string, opts ...DialOption) (*ClientConn, error) {
 	}
 	if cc.dopts.codec == nil { // 使用proto作为默认的编码解码器
 		// Set the default codec.
-		cc.dopts.codec = protoCodec{}
+		cc.dopts.codec = NewProtoCodec()
+	}
+	if cc.dopts.copts.Timeout == 0 {
+		cc.dopts.copts.Timeout = ConnectTimeout
+	}
+	if cc.dopts.copts.Dialer == nil {
+		cc.dopts.copts.Dialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		}
 	}
-	cc.conn, err = NewConn()
+	if cc.dopts.retryPolicies != nil && cc.dopts.retryBudget == nil {
+		cc.dopts.retryBudget = &defaultRetryBudget
+	}
+	if cc.dopts.retryBudget != nil {
+		cc.throttler = newRetryThrottler(*cc.dopts.retryBudget)
+	}
+
+	if cc.dopts.versions.max == 0 {
+		cc.dopts.versions = defaultVersionRange
+	}
+	if cc.dopts.resolver == nil {
+		cc.dopts.resolver = listResolver{}
+	}
+
+	addrs, err := cc.dopts.resolver.Resolve(target)
 	if err != nil {
-		return
+		return nil, err
+	}
+	// 只要有一个实例可以连接，Dial就成功，其余实例在调用时重新连接
+	var connected bool
+	for _, addr := range addrs {
+		ac := &addrConn{
+			cc:		cc,
+			addr:	addr,
+			state:	Idle,
+			logger:	With("remote_addr", addr),
+		}
+		if err = ac.resetTransport(); err == nil {
+			connected = true
+		}
+		cc.conns = append(cc.conns, ac)
+	}
+	if !connected {
+		cc.Close()
+		return nil, err
 	}
 
 	colonPos := strings.LastIndex(target, ":")
@@ -91,6 +194,13 @@ func Dial(target string, opts ...DialOption) (*ClientConn, error) {
 		colonPos = len(target)
 	}
 	cc.authority = target[:colonPos]
+
+	if cc.dopts.adminAddr != "" {
+		if cc.admin, err = serveAdmin(cc.dopts.adminAddr, cc.AdminHandler()); err != nil {
+			cc.Close()
+			return nil, err
+		}
+	}
 	return cc, nil
 }
 
@@ -128,17 +238,357 @@ func (s ConnectivityState) String() string {
 	}
 }
 
+// MarshalText encodes the state as its name, e.g. in the JSON output of the admin endpoints.
+func (s ConnectivityState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ClientConn represents a client connection to a bgserver service.
 type ClientConn struct {
 	target		string
-	conn		Conn
+	authority	string
 	dopts		dialOptions
+	conns		[]*addrConn
+	throttler	*retryThrottler
+	next		uint32		// 下一个被选中的实例，用于轮询
+	hedgeStats	HedgingStats
+
+	mu			sync.Mutex
+	closed		bool
+	admin		*http.Server	// 管理接口的HTTP服务
+
+	subMu		sync.Mutex
+	subs		map[string][]*Subscription	// 以主题为键的订阅
+}
+
+// Invoke 发送请求消息并等待对应的响应. 请求未指定session_no时会自动生成一个,
+// 重试时沿用同一个session_no，便于server对重复的请求去重.
+// 与server端一样，每次调用带有自己的logger，可通过LoggerFromContext取得.
+func (cc *ClientConn) Invoke(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+	if req.GetHead() == nil {
+		return nil, ErrInvalidMessage
+	}
+	if req.Head.SessionNo == nil {
+		req.Head.SessionNo = proto.String(NewSessionNo())
+	}
+	logger := With("target", cc.target, "session_no", req.Head.GetSessionNo(), "message_type", req.Head.GetMessageType())
+	ctx = NewLoggerContext(ctx, logger)
+	ctx, span := startClientSpan(ctx, req)
+	start := time.Now()
+	resp, err := cc.invoke(ctx, req)
+	retcode := retcodeTransportError
+	if err == nil {
+		retcode = strconv.Itoa(int(GetResponseCode(resp).GetRetcode()))
+	} else {
+		logger.Debug("call failed", "error", err, "duration", time.Since(start))
+	}
+	clientMetrics.observe(strconv.Itoa(int(req.GetHead().GetMessageType())), retcode, time.Since(start))
+	endSpan(span, req, GetResponseCode(resp).GetRetcode(), err)
+	if sh := cc.dopts.shadow; sh != nil && err == nil && sh.sampled(req) {
+		sh.mirror(req, resp)
+	}
+	return resp, err
+}
+
+func (cc *ClientConn) invoke(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+	mt := req.GetHead().GetMessageType()
+	if policy, ok := cc.dopts.hedgingPolicies[mt]; ok {
+		return cc.invokeWithHedging(ctx, req, policy)
+	}
+	if policy, ok := cc.dopts.retryPolicies[mt]; ok {
+		return cc.invokeWithRetry(ctx, req, policy)
+	}
+	resp, _, err := cc.pickAddrConn().invoke(ctx, req)
+	return resp, err
+}
+
+// pickAddrConn 轮询选择一个后端实例
+func (cc *ClientConn) pickAddrConn() *addrConn {
+	return cc.pickAddrConns(1)[0]
+}
+
+// pickAddrConns 轮询选择至多n个不同的后端实例
+func (cc *ClientConn) pickAddrConns(n int) []*addrConn {
+	if n > len(cc.conns) {
+		n = len(cc.conns)
+	}
+	start := int(atomic.AddUint32(&cc.next, 1))
+	acs := make([]*addrConn, 0, n)
+	for i := 0; i < n; i++ {
+		acs = append(acs, cc.conns[(start+i)%len(cc.conns)])
+	}
+	return acs
+}
+
+// State returns the connectivity state of the ClientConn.
+// It is Ready as long as one of the backend instances is ready.
+func (cc *ClientConn) State() ConnectivityState {
+	state := Shutdown
+	for _, ac := range cc.conns {
+		switch s := ac.getState(); {
+		case s == Ready:
+			return Ready
+		case s == Connecting, s == Idle:
+			state = Connecting
+		case s == TransientFailure && state == Shutdown:
+			state = TransientFailure
+		}
+	}
+	return state
 }
 
-// TODO
+// Close tears down the ClientConn and all underlying connections.
+func (cc *ClientConn) Close() error {
+	cc.mu.Lock()
+	if cc.closed {
+		cc.mu.Unlock()
+		return ErrClientConnClosing
+	}
+	cc.closed = true
+	if cc.admin != nil {
+		cc.admin.Close()
+	}
+	cc.mu.Unlock()
+	for _, ac := range cc.conns {
+		ac.tearDown()
+	}
+	return nil
+}
 
-type Conn struct {
-	// TODO
+var sessionSeq uint64
+
+// NewSessionNo returns a session_no unique within the process, for the requests
+// that are not sent through a ClientConn.
+func NewSessionNo() string {
+	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), atomic.AddUint64(&sessionSeq, 1))
 }
 
+// addrConn 表示到某个后端地址的连接，负责请求与响应的匹配.
+// 连接断开后，下一次调用会重新建立连接.
+type addrConn struct {
+	cc		*ClientConn
+	addr	string
+
+	mu		sync.Mutex
+	state	ConnectivityState
+	conn	*Conn
+	pending	map[string]chan *pb.BMessage	// 等待响应的调用，以session_no为键
+	logger	*LevelLogger
+
+	connecting	chan struct{}	// 不为nil时有goroutine正在连接，连接结束后关闭
+	connectErr	error			// 最近一次连接的结果
+
+	reconnecting	int32	// 为1时reconnectLoop正在运行，见startReconnect
+}
+
+// resetTransport 建立到addr的连接. 调用前不能持有ac.mu.
+func (ac *addrConn) resetTransport() error {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.resetTransportLocked()
+}
+
+// resetTransportLocked 重新建立到addr的连接. 调用前需持有ac.mu，拨号和握手期间会释放ac.mu，
+// 使等待响应的调用和recvLoop不被阻塞，返回时仍持有ac.mu. 同一时刻只有一个goroutine在连接，
+// 其余的调用等待并使用它的结果.
+func (ac *addrConn) resetTransportLocked() error {
+	if ac.state == Shutdown {
+		return ErrClientConnClosing
+	}
+	if done := ac.connecting; done != nil {
+		ac.mu.Unlock()
+		<-done
+		ac.mu.Lock()
+		switch ac.state {
+		case Ready:
+			return nil
+		case Shutdown:
+			return ErrClientConnClosing
+		}
+		return ac.connectErr
+	}
+	done := make(chan struct{})
+	ac.connecting = done
+	ac.state = Connecting
+	ac.mu.Unlock()
+	conn, err := ac.newTransport()
+	ac.mu.Lock()
+	ac.connecting, ac.connectErr = nil, err
+	close(done)
+	if ac.state == Shutdown {
+		// 连接期间ClientConn被关闭
+		if conn != nil {
+			conn.Close()
+		}
+		return ErrClientConnClosing
+	}
+	if err != nil {
+		ac.state = TransientFailure
+		return err
+	}
+	ac.conn = conn
+	ac.pending = make(map[string]chan *pb.BMessage)
+	ac.state = Ready
+	go ac.recvLoop(ac.conn, ac.pending)
+	if topics := ac.cc.subscribedTopics(); topics != nil {
+		go ac.resubscribe(topics)
+	}
+	if d := ac.cc.dopts.heartbeatInterval; d > 0 {
+		go ac.heartbeatLoop(ac.conn, d)
+	}
+	return nil
+}
 
+// newTransport 拨号并完成版本协商和握手，返回可以发送应用消息的连接. 它不访问ac中受ac.mu保护的字段.
+func (ac *addrConn) newTransport() (*Conn, error) {
+	copts := ac.cc.dopts.copts
+	rawConn, err := copts.Dialer(ac.addr, copts.Timeout)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, ErrClientConnTimeout
+		}
+		return nil, err
+	}
+	c := newMeteredConn(rawConn, clientMetrics)
+	dopts := ac.cc.dopts
+	conn := newConn(c, dopts.codec, dopts.compression)
+	conn.parser.SetMaxFrameSize(dopts.maxFrameSize)
+	conn.setCapture(dopts.capture)
+	// 在发送任何应用消息前完成版本协商和握手
+	c.SetDeadline(time.Now().Add(copts.Timeout))
+	if err := clientNegotiateVersion(conn, dopts.versions, dopts.compression, dopts.frameChecksum); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if dopts.handshaker != nil {
+		if err := dopts.handshaker.ClientHandshake(conn); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	conn.handshakeDone()
+	c.SetDeadline(time.Time{})
+	return conn, nil
+}
 
+func (ac *addrConn) getState() ConnectivityState {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.state
+}
+
+// invoke 在该连接上发送请求并等待响应. sent表示请求是否已经写入连接,
+// 为false时说明server一定没有收到该请求.
+func (ac *addrConn) invoke(ctx context.Context, req *pb.BMessage) (resp *pb.BMessage, sent bool, err error) {
+	sn := req.GetHead().GetSessionNo()
+	ch := make(chan *pb.BMessage, 1)
+
+	ac.mu.Lock()
+	if ac.state != Ready {
+		if err := ac.resetTransportLocked(); err != nil {
+			ac.mu.Unlock()
+			return nil, false, err
+		}
+	}
+	c, pending := ac.conn, ac.pending
+	pending[sn] = ch
+	ac.mu.Unlock()
+
+	// 未指定版本的请求使用该连接协商得到的版本. req可能同时被发往多个实例，不能直接修改
+	if req.GetHead().GetVersion() == 0 {
+		head := proto.Clone(req.GetHead()).(*pb.Head)
+		head.Version = proto.Uint32(c.Version())
+		req = &pb.BMessage{Head: head, Body: req.GetBody()}
+	}
+
+	if err := c.WriteMsg(req); err != nil {
+		LoggerFromContext(ctx).Debug("failed to send the request", "remote_addr", ac.addr, "error", err)
+		ac.removePending(pending, sn)
+		ac.connBroken(c)
+		return nil, false, err
+	}
+	select {
+	case <-ctx.Done():
+		LoggerFromContext(ctx).Debug("no response before the deadline", "remote_addr", ac.addr, "error", ctx.Err())
+		ac.removePending(pending, sn)
+		return nil, true, ctx.Err()
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, true, ErrConnBroken
+		}
+		return resp, true, nil
+	}
+}
+
+func (ac *addrConn) removePending(pending map[string]chan *pb.BMessage, sn string) {
+	ac.mu.Lock()
+	delete(pending, sn)
+	ac.mu.Unlock()
+}
+
+// recvLoop 持续读取server的响应，并按session_no分发给等待中的调用，推送的消息交给订阅，
+// 其它消息交给WithMessageHandler设置的处理函数
+func (ac *addrConn) recvLoop(c *Conn, pending map[string]chan *pb.BMessage) {
+	for {
+		m, err := c.ReadMsg()
+		if err != nil {
+			ac.connBroken(c)
+			return
+		}
+		if m.GetHead().GetMessageType() == int32(pb.MessageType_PUSH_MESSAGE) {
+			ac.cc.dispatchPush(m)
+			continue
+		}
+		sn := m.GetHead().GetSessionNo()
+		ac.mu.Lock()
+		ch, ok := pending[sn]
+		delete(pending, sn)
+		ac.mu.Unlock()
+		switch {
+		case ok:
+			ch <- m
+		case ac.cc.dopts.msgHandler != nil:
+			// 不是任何调用的响应，如Server.SendTo发送的消息
+			ac.cc.dopts.msgHandler(m)
+		default:
+			ac.logger.Warn("drop the response with unknown session_no", "session_no", sn)
+		}
+	}
+}
+
+// connBroken 关闭已断开的连接，并通知所有等待该连接响应的调用
+func (ac *addrConn) connBroken(c *Conn) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.conn != c {
+		return
+	}
+	ac.logger.Debug("connection broken", "pending", len(ac.pending))
+	c.Close()
+	// recvLoop等也会对同一连接调用connBroken，清除后它们不会把重新连接中的状态改回TransientFailure
+	ac.conn = nil
+	for sn, ch := range ac.pending {
+		close(ch)
+		delete(ac.pending, sn)
+	}
+	if ac.state != Shutdown {
+		ac.state = TransientFailure
+		if ac.cc.subscribedTopics() != nil {
+			ac.startReconnect()
+		}
+	}
+}
+
+func (ac *addrConn) tearDown() {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.state = Shutdown
+	if ac.conn == nil {
+		return
+	}
+	ac.conn.Close()
+	for sn, ch := range ac.pending {
+		close(ch)
+		delete(ac.pending, sn)
+	}
+}
@@ -0,0 +1,64 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResetTransportDoesNotHoldLockWhileDialing(t *testing.T) {
+	s := NewServer()
+	s.Handle(testMessageType, echoHandler)
+	addr := startServer(t, s)
+
+	var dials int32
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var block atomic.Value
+	block.Store(false)
+	cc := dial(t, addr, WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		if block.Load().(bool) {
+			entered <- struct{}{}
+			<-release
+		}
+		return net.DialTimeout("tcp", addr, timeout)
+	}))
+	ac := cc.conns[0]
+	ac.mu.Lock()
+	c := ac.conn
+	ac.mu.Unlock()
+	ac.connBroken(c)
+	block.Store(true)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rc := invoke(t, cc, newRequest(testMessageType, 0)); rc != 0 {
+				t.Errorf("retcode %d", rc)
+			}
+		}()
+	}
+	<-entered
+	// 拨号期间ac.mu可用
+	state := make(chan ConnectivityState)
+	go func() { state <- ac.getState() }()
+	select {
+	case st := <-state:
+		if st != Connecting {
+			t.Errorf("state %v while dialing, want Connecting", st)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ac.mu is held while dialing")
+	}
+	close(release)
+	wg.Wait()
+	// 两个调用共用同一次重新连接
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatalf("%d dials, want 2 (Dial and one reconnection)", n)
+	}
+}
@@ -0,0 +1,292 @@
+package network
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	. "bgserver/common"
+	pb "bgserver/message/proto/golang"
+)
+
+// compressionOptions 为一端的压缩配置. 两端在版本协商的握手中交换各自接受的压缩算法，
+// 发送方从compressors中选择第一个对端接受的算法，帧头中记录所用算法的编号.
+type compressionOptions struct {
+	compressors         []Compressor       // 发送消息时可用的算法，按优先级排列
+	decompressors       []Decompressor     // 接受的算法，为空时接受所有注册的算法
+	policy              *compressionPolicy // 决定一条消息是否压缩，为nil时总是压缩
+	maxDecompressedSize int                // 一条消息解压后的大小上限，为0时使用DefaultMaxDecompressedSize
+}
+
+// accepted 返回本端接受的压缩算法，以帧头中的编号索引
+func (o compressionOptions) accepted() map[uint8]Decompressor {
+	dcs := make(map[uint8]Decompressor)
+	if len(o.decompressors) == 0 {
+		for _, name := range RegisteredCompressions() {
+			if id, ok := CompressionID(name); ok {
+				dcs[id] = GetDecompressor(name)
+			}
+		}
+		return dcs
+	}
+	for _, dc := range o.decompressors {
+		if id, ok := CompressionID(dc.Type()); ok {
+			dcs[id] = dc
+		} else {
+			Warn("ignore the unregistered decompressor", "type", dc.Type())
+		}
+	}
+	return dcs
+}
+
+// maxSize 返回一条消息解压后的大小上限
+func (o compressionOptions) maxSize() int {
+	if o.maxDecompressedSize > 0 {
+		return o.maxDecompressedSize
+	}
+	return DefaultMaxDecompressedSize
+}
+
+// MaxDecompressedSize returns a ServerOption that limits the size of an inbound
+// message after decompression, DefaultMaxDecompressedSize by default. A connection
+// sending a message beyond the limit is closed.
+func MaxDecompressedSize(n int) ServerOption {
+	return func(o *serverOptions) {
+		o.compression.maxDecompressedSize = n
+	}
+}
+
+// WithMaxDecompressedSize returns a DialOption that limits the size of an inbound
+// message after decompression, DefaultMaxDecompressedSize by default. A connection
+// receiving a message beyond the limit is closed.
+func WithMaxDecompressedSize(n int) DialOption {
+	return func(o *dialOptions) {
+		o.compression.maxDecompressedSize = n
+	}
+}
+
+// acceptedNames 返回握手时通告给对端的压缩算法名，按编号排序
+func acceptedNames(dcs map[uint8]Decompressor) []string {
+	ids := make([]int, 0, len(dcs))
+	for id := range dcs {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = dcs[uint8(id)].Type()
+	}
+	return names
+}
+
+// choose 返回第一个对端接受的Compressor，都不接受时返回nil，即不压缩
+func (o compressionOptions) choose(peer []string) Compressor {
+	for _, cp := range o.compressors {
+		if _, ok := CompressionID(cp.Type()); !ok {
+			continue
+		}
+		for _, name := range peer {
+			if name == cp.Type() {
+				return cp
+			}
+		}
+	}
+	return nil
+}
+
+// Compression returns the name of the compression algorithm used for the messages
+// sent on the connection, or "" if they are not compressed.
+func (c *Conn) Compression() string {
+	if c.cp == nil {
+		return ""
+	}
+	return c.cp.Type()
+}
+
+// CompressionPolicy 决定发送的消息是否压缩. 很小的消息(如心跳)压缩后几乎不会变小，
+// 而已经压缩过的数据(如图片)压缩率很差，对它们压缩只会浪费CPU.
+type CompressionPolicy struct {
+	// MinSize 编码后小于MinSize字节的消息不压缩
+	MinSize int
+	// MessageTypes 按消息类型指定是否压缩，true为总是压缩，false为从不压缩，
+	// 优先于MinSize和自动关闭. 未列出的消息类型由MinSize和压缩率决定.
+	MessageTypes map[int32]bool
+	// MaxRatio 为压缩后与压缩前大小之比的上限. 一个消息类型最近SampleSize条压缩过的消息
+	// 总体的比值超过MaxRatio时，该消息类型停止压缩，ProbeInterval后再重新尝试. 为0时不自动关闭.
+	MaxRatio      float64
+	SampleSize    int
+	ProbeInterval time.Duration
+}
+
+// DefaultCompressionPolicy 不压缩心跳和1KB以下的消息，压缩后没有减小10%以上的消息类型停止压缩1分钟
+var DefaultCompressionPolicy = CompressionPolicy{
+	MinSize: 1024,
+	MessageTypes: map[int32]bool{
+		int32(pb.MessageType_HEART_BEAT_REQUEST):  false,
+		int32(pb.MessageType_HEART_BEAT_RESPONSE): false,
+	},
+	MaxRatio:      0.9,
+	SampleSize:    100,
+	ProbeInterval: time.Minute,
+}
+
+// CompressionPolicyOption returns a ServerOption that decides which outbound messages
+// are compressed, instead of compressing all of them.
+func CompressionPolicyOption(p CompressionPolicy) ServerOption {
+	return func(o *serverOptions) {
+		o.compression.policy = newCompressionPolicy(p)
+	}
+}
+
+// WithCompressionPolicy returns a DialOption that decides which outbound messages
+// are compressed, instead of compressing all of them.
+func WithCompressionPolicy(p CompressionPolicy) DialOption {
+	return func(o *dialOptions) {
+		o.compression.policy = newCompressionPolicy(p)
+	}
+}
+
+// CompressionStats 为一个消息类型的压缩统计
+type CompressionStats struct {
+	MessageType int32  `json:"message_type"`
+	Compressed  uint64 `json:"compressed"`   // 压缩的消息数
+	Skipped     uint64 `json:"skipped"`      // 没有压缩的消息数，只统计压缩过或在MessageTypes中配置的消息类型
+	BytesBefore uint64 `json:"bytes_before"` // 压缩的消息在压缩前的总字节数
+	BytesAfter  uint64 `json:"bytes_after"`  // 压缩的消息在压缩后的总字节数
+	Disabled    bool   `json:"disabled"`     // 是否因压缩率差被暂时停止压缩
+}
+
+// SavedBytes returns the number of bytes saved by compression, negative if the
+// compressed messages grew.
+func (s CompressionStats) SavedBytes() int64 {
+	return int64(s.BytesBefore) - int64(s.BytesAfter)
+}
+
+// compressionPolicy 为CompressionPolicy在一个Server或ClientConn的所有连接上共享的状态
+type compressionPolicy struct {
+	CompressionPolicy
+
+	mu    sync.Mutex
+	types map[int32]*typeCompression
+}
+
+// typeCompression 为一个消息类型的压缩状态
+type typeCompression struct {
+	stats         CompressionStats
+	samples       int    // 当前窗口内压缩的消息数
+	sampleBefore  uint64 // 当前窗口内压缩前的字节数
+	sampleAfter   uint64
+	disabledUntil time.Time
+}
+
+func newCompressionPolicy(p CompressionPolicy) *compressionPolicy {
+	return &compressionPolicy{
+		CompressionPolicy: p,
+		types:             make(map[int32]*typeCompression),
+	}
+}
+
+// maxCompressionTypes 为统计压缩状态的消息类型个数上限. 响应的消息类型由client发送的请求决定，
+// 不能让任意的消息类型无限地撑大types.
+const maxCompressionTypes = 1024
+
+// typeLocked 返回mt的压缩状态. 没有时create为true且未达上限才创建，否则返回nil.
+func (p *compressionPolicy) typeLocked(mt int32, create bool) *typeCompression {
+	t, ok := p.types[mt]
+	if !ok && create && len(p.types) < maxCompressionTypes {
+		t = &typeCompression{stats: CompressionStats{MessageType: mt}}
+		p.types[mt] = t
+	}
+	return t
+}
+
+// allow 返回消息类型为mt、编码后大小为size的消息是否压缩. p为nil时总是压缩.
+func (p *compressionPolicy) allow(mt int32, size int) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := p.typeLocked(mt, false)
+	allow, ok := p.MessageTypes[mt]
+	if !ok {
+		allow = size >= p.MinSize
+		if allow && t != nil && t.stats.Disabled {
+			if time.Now().Before(t.disabledUntil) {
+				allow = false
+			} else {
+				// 重新尝试压缩，在新的窗口中测量压缩率
+				t.stats.Disabled = false
+			}
+		}
+	}
+	if !allow {
+		// 只为压缩过或在MessageTypes中配置的消息类型统计跳过的消息
+		if t == nil && ok {
+			t = p.typeLocked(mt, true)
+		}
+		if t != nil {
+			t.stats.Skipped++
+		}
+	}
+	return allow
+}
+
+// record 记录一条消息压缩前后的大小，压缩率差时停止压缩该消息类型
+func (p *compressionPolicy) record(mt int32, before, after int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := p.typeLocked(mt, true)
+	if t == nil {
+		return
+	}
+	t.stats.Compressed++
+	t.stats.BytesBefore += uint64(before)
+	t.stats.BytesAfter += uint64(after)
+	if _, ok := p.MessageTypes[mt]; ok || p.MaxRatio <= 0 {
+		return
+	}
+	t.samples++
+	t.sampleBefore += uint64(before)
+	t.sampleAfter += uint64(after)
+	if t.samples < p.SampleSize {
+		return
+	}
+	if t.sampleBefore > 0 && float64(t.sampleAfter)/float64(t.sampleBefore) > p.MaxRatio {
+		t.stats.Disabled = true
+		t.disabledUntil = time.Now().Add(p.ProbeInterval)
+		Info("stop compressing the message type for its poor ratio", "message_type", mt,
+			"ratio", float64(t.sampleAfter)/float64(t.sampleBefore))
+	}
+	t.samples, t.sampleBefore, t.sampleAfter = 0, 0, 0
+}
+
+// stats 返回所有消息类型的压缩统计，按消息类型排序
+func (p *compressionPolicy) stats() []CompressionStats {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make([]CompressionStats, 0, len(p.types))
+	for _, t := range p.types {
+		stats = append(stats, t.stats)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].MessageType < stats[j].MessageType })
+	return stats
+}
+
+// CompressionStats returns the compression statistics of the messages sent by the
+// server, by message type. It returns nil without a CompressionPolicy.
+func (s *Server) CompressionStats() []CompressionStats {
+	return s.opts.compression.policy.stats()
+}
+
+// CompressionStats returns the compression statistics of the messages sent by the
+// ClientConn, by message type. It returns nil without a CompressionPolicy.
+func (cc *ClientConn) CompressionStats() []CompressionStats {
+	return cc.dopts.compression.policy.stats()
+}
@@ -0,0 +1,137 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "bgserver/common"
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
+)
+
+// Conn 表示一条已建立的TCP连接，负责BMessage的收发.
+// 写操作可以被多个goroutine并发调用，读操作只能由一个goroutine调用.
+type Conn struct {
+	msgsIn       uint64 // 收到的消息数
+	msgsOut      uint64 // 发出的消息数
+	heartbeatRTT int64  // 最近一次心跳的往返时间(纳秒)
+
+	id                  uint64    // 进程内唯一的连接编号
+	created             time.Time // 连接建立的时间
+	conn                *meteredConn
+	codec               Codec
+	cp                  Compressor             // 握手时选定的压缩算法，为nil时不压缩
+	dcs                 map[uint8]Decompressor // 本端接受的压缩算法，以帧头中的编号索引
+	policy              *compressionPolicy     // 决定一条消息是否压缩
+	maxDecompressedSize int                    // 一条消息解压后的大小上限
+	parser              *Parser
+	capture             *Capture // 为nil时不捕获收发的帧
+	captureHandshake    int32    // 为1时握手尚未完成，捕获的帧需抹去鉴权信息
+
+	version uint32       // 连接建立时协商得到的协议版本
+	source  uint32       // client端鉴权握手使用的source，用于心跳等框架自己发送的消息
+	frame   FrameFormat  // 发送的帧使用的帧头格式，握手前为v1
+	unread  *pb.BMessage // 已读取但需要重新交给ReadMsg返回的消息
+
+	mu sync.Mutex // 保护写操作，保证一条消息的帧不会被其它消息打断
+}
+
+var connSeq uint64
+
+func newConn(c *meteredConn, codec Codec, compression compressionOptions) *Conn {
+	return &Conn{
+		id:                  atomic.AddUint64(&connSeq, 1),
+		created:             time.Now(),
+		conn:                c,
+		codec:               codec,
+		dcs:                 compression.accepted(),
+		policy:              compression.policy,
+		maxDecompressedSize: compression.maxSize(),
+		parser:              NewParser(c),
+	}
+}
+
+// WriteMsg 将消息编码成帧并写入连接.
+func (c *Conn) WriteMsg(m *pb.BMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var w io.Writer = c.conn
+	if c.capture != nil {
+		w = captureWriter{w: c.conn, c: c}
+	}
+	if err := writeMsg(w, c.codec, c.cp, c.policy, c.frame, m); err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.msgsOut, 1)
+	return nil
+}
+
+// ReadMsg 从连接中读取一条完整的消息并解码.
+func (c *Conn) ReadMsg() (*pb.BMessage, error) {
+	if m := c.unread; m != nil {
+		c.unread = nil
+		return m, nil
+	}
+	m := new(pb.BMessage)
+	if err := readMsg(c.parser, c.codec, c.dcs, c.maxDecompressedSize, m); err != nil {
+		if errors.Is(err, ErrDecompressedTooLarge) {
+			// 对端发送的很可能是解压炸弹，不再信任这条连接
+			c.conn.m.decompressionLimitExceeded.Inc()
+			c.conn.Close()
+		}
+		return nil, err
+	}
+	atomic.AddUint64(&c.msgsIn, 1)
+	return m, nil
+}
+
+// unreadMsg 将m放回连接，下一次ReadMsg会返回m
+func (c *Conn) unreadMsg(m *pb.BMessage) {
+	c.unread = m
+}
+
+// Version returns the protocol version negotiated on the connection.
+func (c *Conn) Version() uint32 {
+	return c.version
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ID returns the identifier of the connection, unique within the process.
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// ConnStats 为一条连接的统计信息
+type ConnStats struct {
+	ConnectTime      time.Time     `json:"connect_time"`
+	BytesIn          uint64        `json:"bytes_in"`
+	BytesOut         uint64        `json:"bytes_out"`
+	MsgsIn           uint64        `json:"msgs_in"`
+	MsgsOut          uint64        `json:"msgs_out"`
+	LastHeartbeatRTT time.Duration `json:"last_heartbeat_rtt_ns"` // client发送心跳时才有值
+}
+
+// Stats returns a snapshot of the statistics of the connection.
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{
+		ConnectTime:      c.created,
+		BytesIn:          atomic.LoadUint64(&c.conn.bytesIn),
+		BytesOut:         atomic.LoadUint64(&c.conn.bytesOut),
+		MsgsIn:           atomic.LoadUint64(&c.msgsIn),
+		MsgsOut:          atomic.LoadUint64(&c.msgsOut),
+		LastHeartbeatRTT: time.Duration(atomic.LoadInt64(&c.heartbeatRTT)),
+	}
+}
+
+// Close closes the underlying TCP connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
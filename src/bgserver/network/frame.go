@@ -0,0 +1,66 @@
+package network
+
+import (
+	. "bgserver/message"
+)
+
+// 本实现可以接收和发送的最高帧头版本. 接收方逐帧识别v1和v2帧头，发送方在握手时
+// 得知对端可以接收v2帧头后才使用它，因此新旧两端可以共存.
+const MaxFrameVersion = FrameV2
+
+// negotiateFrameVersion 返回与声明最高可接收peer版本的对端通信时使用的帧头版本
+func negotiateFrameVersion(peer uint32) uint8 {
+	if peer >= uint32(MaxFrameVersion) {
+		return MaxFrameVersion
+	}
+	return FrameV1
+}
+
+// setFrameVersion 设置之后发送的帧使用的帧头格式，只有v2帧头可以携带校验和
+func (c *Conn) setFrameVersion(v uint8, checksum bool) {
+	c.frame = FrameFormat{Version: v, Checksum: checksum && v >= FrameV2}
+}
+
+// FrameVersion returns the version of the frame header used for the messages
+// sent on the connection.
+func (c *Conn) FrameVersion() uint8 {
+	if c.frame.Version == 0 {
+		return FrameV1
+	}
+	return c.frame.Version
+}
+
+// FrameChecksum returns a ServerOption that adds a CRC32C of the payload to every
+// frame sent to the clients supporting the v2 frame header. The checksums of the
+// received frames are always verified if present.
+func FrameChecksum() ServerOption {
+	return func(o *serverOptions) {
+		o.frameChecksum = true
+	}
+}
+
+// MaxFrameSize returns a ServerOption that limits the payload size of an inbound
+// frame, before decompression, to n bytes, DefaultMaxFrameSize by default. The
+// length in the frame header is checked before the payload is read, and a
+// connection sending a larger frame is closed.
+func MaxFrameSize(n int) ServerOption {
+	return func(o *serverOptions) {
+		o.maxFrameSize = n
+	}
+}
+
+// WithMaxFrameSize returns a DialOption that limits the payload size of an
+// inbound frame, before decompression, to n bytes, DefaultMaxFrameSize by default.
+func WithMaxFrameSize(n int) DialOption {
+	return func(o *dialOptions) {
+		o.maxFrameSize = n
+	}
+}
+
+// WithFrameChecksum returns a DialOption that adds a CRC32C of the payload to
+// every frame sent to a server supporting the v2 frame header.
+func WithFrameChecksum() DialOption {
+	return func(o *dialOptions) {
+		o.frameChecksum = true
+	}
+}
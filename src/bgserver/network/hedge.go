@@ -0,0 +1,113 @@
+package network
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
+)
+
+// HedgingPolicy 描述某一消息类型的对冲请求策略: 请求发出后若在HedgingDelay内
+// 没有收到成功的响应，则把同一个请求发送给另一个实例，以最先成功的响应为准.
+// 只应对只读的消息类型开启. 同一消息类型同时设置了重试策略时，以对冲策略为准.
+type HedgingPolicy struct {
+	// MaxHedges 为除第一次发送外最多再发出的请求数，同时受实例数的限制. 小于1时不发出对冲请求
+	MaxHedges int
+	// HedgingDelay 为发出下一个对冲请求前等待的时间
+	HedgingDelay time.Duration
+}
+
+// HedgingStats 统计对冲请求的效果
+type HedgingStats struct {
+	Calls     uint64 // 使用对冲策略的调用数
+	Hedges    uint64 // 发出的对冲请求数(不含第一次发送)
+	HedgeWins uint64 // 由对冲请求返回最终结果的调用数
+}
+
+// WithHedgingPolicy returns a DialOption that specifies the hedging policy of each message type.
+func WithHedgingPolicy(policies map[int32]HedgingPolicy) DialOption {
+	return func(o *dialOptions) {
+		o.hedgingPolicies = policies
+	}
+}
+
+// HedgingStats returns a snapshot of the hedging statistics of the ClientConn.
+func (cc *ClientConn) HedgingStats() HedgingStats {
+	return HedgingStats{
+		Calls:     atomic.LoadUint64(&cc.hedgeStats.Calls),
+		Hedges:    atomic.LoadUint64(&cc.hedgeStats.Hedges),
+		HedgeWins: atomic.LoadUint64(&cc.hedgeStats.HedgeWins),
+	}
+}
+
+type hedgeResult struct {
+	resp  *pb.BMessage
+	err   error
+	hedge bool // 是否由对冲请求返回
+}
+
+func (cc *ClientConn) invokeWithHedging(ctx context.Context, req *pb.BMessage, p HedgingPolicy) (*pb.BMessage, error) {
+	if p.MaxHedges < 1 {
+		resp, _, err := cc.pickAddrConn().invoke(ctx, req)
+		return resp, err
+	}
+	// 返回时取消其余尚未完成的请求
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	mt := strconv.Itoa(int(req.GetHead().GetMessageType()))
+	acs := cc.pickAddrConns(1 + p.MaxHedges)
+	results := make(chan hedgeResult, len(acs))
+	sent := 0
+	send := func() {
+		ac, hedge := acs[sent], sent > 0
+		sent++
+		if hedge {
+			atomic.AddUint64(&cc.hedgeStats.Hedges, 1)
+			clientHedges.WithLabelValues(mt).Inc()
+		}
+		go func() {
+			resp, _, err := ac.invoke(ctx, req)
+			results <- hedgeResult{resp: resp, err: err, hedge: hedge}
+		}()
+	}
+	atomic.AddUint64(&cc.hedgeStats.Calls, 1)
+	send()
+
+	var first *hedgeResult
+	timer := time.After(p.HedgingDelay)
+	for received := 0; received < sent; {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer:
+			if sent < len(acs) {
+				send()
+				timer = time.After(p.HedgingDelay)
+			}
+		case r := <-results:
+			received++
+			if r.err == nil && GetResponseCode(r.resp).GetRetcode() == 0 {
+				if r.hedge {
+					atomic.AddUint64(&cc.hedgeStats.HedgeWins, 1)
+					clientHedgeWins.WithLabelValues(mt).Inc()
+				}
+				return r.resp, nil
+			}
+			if first == nil {
+				first = &r
+			}
+			// 已有请求失败，不必等待延迟，立即发出下一个对冲请求
+			if sent < len(acs) {
+				send()
+				timer = time.After(p.HedgingDelay)
+			}
+		}
+	}
+	// 所有请求都失败时，返回最先收到的结果
+	return first.resp, first.err
+}
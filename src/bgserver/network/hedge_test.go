@@ -0,0 +1,188 @@
+package network
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	pb "bgserver/message/proto/golang"
+	"bgserver/status"
+)
+
+// stallServer 阻塞收到的前stalls个请求直到测试结束，之后的请求按reply回复
+type stallServer struct {
+	mu       sync.Mutex
+	stalls   int
+	received int
+	release  chan struct{}
+	reply    func(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error)
+}
+
+func (s *stallServer) handle(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+	s.mu.Lock()
+	s.received++
+	stall := s.received <= s.stalls
+	s.mu.Unlock()
+	if stall {
+		<-s.release
+	}
+	return s.reply(ctx, req)
+}
+
+func (s *stallServer) requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received
+}
+
+// hedgingClient 启动n个共用s的实例，并连接所有实例
+func hedgingClient(t *testing.T, s *stallServer, n int, p HedgingPolicy) *ClientConn {
+	s.release = make(chan struct{})
+	if s.reply == nil {
+		s.reply = echoHandler
+	}
+	addrs := make([]string, n)
+	for i := range addrs {
+		srv := NewServer()
+		srv.Handle(testMessageType, s.handle)
+		addrs[i] = startServer(t, srv)
+	}
+	// 先于Stop执行，使阻塞的请求返回
+	t.Cleanup(func() { close(s.release) })
+	return dial(t, strings.Join(addrs, ","),
+		WithHedgingPolicy(map[int32]HedgingPolicy{testMessageType: p}))
+}
+
+// pendingCalls 返回所有实例上仍在等待响应的调用数
+func pendingCalls(cc *ClientConn) int {
+	n := 0
+	for _, ac := range cc.conns {
+		ac.mu.Lock()
+		n += len(ac.pending)
+		ac.mu.Unlock()
+	}
+	return n
+}
+
+// waitNoPending 等待被取消的调用从等待响应的调用中移除
+func waitNoPending(t *testing.T, cc *ClientConn) {
+	deadline := time.Now().Add(time.Second)
+	for pendingCalls(cc) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d calls are still pending", pendingCalls(cc))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHedgingFirstSuccessWins(t *testing.T) {
+	s := &stallServer{stalls: 1}
+	cc := hedgingClient(t, s, 3, HedgingPolicy{MaxHedges: 2, HedgingDelay: 20 * time.Millisecond})
+
+	if rc := invoke(t, cc, newRequest(testMessageType, 0)); rc != 0 {
+		t.Fatalf("retcode %d, want 0", rc)
+	}
+	// 对冲请求立即成功，不会再发出第三个请求
+	time.Sleep(50 * time.Millisecond)
+	if n := s.requests(); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+	if st := cc.HedgingStats(); st != (HedgingStats{Calls: 1, Hedges: 1, HedgeWins: 1}) {
+		t.Errorf("stats %+v", st)
+	}
+	// 落后的请求被取消，不再占用等待响应的位置
+	waitNoPending(t, cc)
+}
+
+func TestHedgingFirstAttemptWins(t *testing.T) {
+	s := &stallServer{}
+	cc := hedgingClient(t, s, 2, HedgingPolicy{MaxHedges: 1, HedgingDelay: time.Second})
+
+	if rc := invoke(t, cc, newRequest(testMessageType, 0)); rc != 0 {
+		t.Fatalf("retcode %d, want 0", rc)
+	}
+	if n := s.requests(); n != 1 {
+		t.Errorf("%d requests, want 1", n)
+	}
+	if st := cc.HedgingStats(); st != (HedgingStats{Calls: 1}) {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestHedgingAfterFailure(t *testing.T) {
+	// 第一个请求失败后不等待HedgingDelay，立即发出对冲请求
+	var mu sync.Mutex
+	calls := 0
+	s := &stallServer{reply: func(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			return nil, status.Error(retcodeBusy, "busy")
+		}
+		return echoHandler(ctx, req)
+	}}
+	cc := hedgingClient(t, s, 2, HedgingPolicy{MaxHedges: 1, HedgingDelay: time.Minute})
+
+	start := time.Now()
+	if rc := invoke(t, cc, newRequest(testMessageType, 0)); rc != 0 {
+		t.Fatalf("retcode %d, want 0", rc)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("the hedge waited %v for the delay", d)
+	}
+	if st := cc.HedgingStats(); st != (HedgingStats{Calls: 1, Hedges: 1, HedgeWins: 1}) {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestHedgingAllFail(t *testing.T) {
+	s := &stallServer{reply: func(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+		return nil, status.Error(retcodeBusy, "busy")
+	}}
+	cc := hedgingClient(t, s, 2, HedgingPolicy{MaxHedges: 3, HedgingDelay: time.Millisecond})
+
+	// 对冲请求数受实例数的限制
+	if rc := invoke(t, cc, newRequest(testMessageType, 0)); rc != retcodeBusy {
+		t.Fatalf("retcode %d, want %d", rc, retcodeBusy)
+	}
+	if n := s.requests(); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+}
+
+func TestNoHedging(t *testing.T) {
+	for _, maxHedges := range []int{0, -1} {
+		s := &stallServer{reply: func(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+			time.Sleep(50 * time.Millisecond)
+			return echoHandler(ctx, req)
+		}}
+		cc := hedgingClient(t, s, 2, HedgingPolicy{MaxHedges: maxHedges, HedgingDelay: time.Millisecond})
+
+		if rc := invoke(t, cc, newRequest(testMessageType, 0)); rc != 0 {
+			t.Fatalf("MaxHedges %d: retcode %d, want 0", maxHedges, rc)
+		}
+		if n := s.requests(); n != 1 {
+			t.Errorf("MaxHedges %d: %d requests, want 1", maxHedges, n)
+		}
+		if st := cc.HedgingStats(); st.Hedges != 0 {
+			t.Errorf("MaxHedges %d: stats %+v", maxHedges, st)
+		}
+	}
+}
+
+func TestHedgingContextCanceled(t *testing.T) {
+	s := &stallServer{stalls: 2}
+	cc := hedgingClient(t, s, 2, HedgingPolicy{MaxHedges: 1, HedgingDelay: time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := cc.Invoke(ctx, newRequest(testMessageType, 0)); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+	// 两个请求都在等待server时被取消
+	waitNoPending(t, cc)
+}
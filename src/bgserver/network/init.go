@@ -2,6 +2,5 @@ package network
 
 
 func init() {
-
+	registerMetrics()
 }
-
@@ -0,0 +1,215 @@
+package network
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	. "bgserver/common"
+)
+
+// retcodeTransportError 为没有收到响应(如连接断开、超时)的调用在retcode标签上的取值
+const retcodeTransportError = "-1"
+
+// messageTypeUnknown 为server上未注册的消息类型在message_type标签上的取值，
+// 避免client发送任意的消息类型产生无限多的时间序列
+const messageTypeUnknown = "unknown"
+
+// connMetrics 为server端或client端连接的一组指标
+type connMetrics struct {
+	connsOpen   prometheus.Gauge
+	connsOpened prometheus.Counter
+	connsClosed prometheus.Counter
+	bytesIn     prometheus.Counter
+	bytesOut    prometheus.Counter
+	requests    *prometheus.CounterVec   // 按message_type和retcode统计的请求数
+	errors      *prometheus.CounterVec   // retcode不为0的请求数
+	latency     *prometheus.HistogramVec // 请求的处理耗时(server)或调用耗时(client)
+
+	decompressionLimitExceeded prometheus.Counter // 因解压后超过大小上限而关闭的连接数
+}
+
+func newConnMetrics(side, opened string) *connMetrics {
+	labels := []string{"message_type", "retcode"}
+	return &connMetrics{
+		connsOpen: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "bgserver", Subsystem: side, Name: "connections_open",
+			Help: "Number of currently open connections.",
+		}),
+		connsOpened: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "bgserver", Subsystem: side, Name: "connections_" + opened + "_total",
+			Help: "Total number of connections " + opened + ".",
+		}),
+		connsClosed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "bgserver", Subsystem: side, Name: "connections_closed_total",
+			Help: "Total number of connections closed.",
+		}),
+		bytesIn: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "bgserver", Subsystem: side, Name: "received_bytes_total",
+			Help: "Total number of bytes received.",
+		}),
+		bytesOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "bgserver", Subsystem: side, Name: "sent_bytes_total",
+			Help: "Total number of bytes sent.",
+		}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "bgserver", Subsystem: side, Name: "requests_total",
+			Help: "Total number of requests completed, by message type and retcode.",
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "bgserver", Subsystem: side, Name: "errors_total",
+			Help: "Total number of requests completed with a non-zero retcode.",
+		}, labels),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "bgserver", Subsystem: side, Name: "request_duration_seconds",
+			Help:    "Latency of requests, by message type and retcode.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, labels),
+		decompressionLimitExceeded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "bgserver", Subsystem: side, Name: "decompression_limit_exceeded_total",
+			Help: "Total number of connections closed for a message exceeding the decompressed size limit.",
+		}),
+	}
+}
+
+func (m *connMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.connsOpen, m.connsOpened, m.connsClosed, m.bytesIn, m.bytesOut,
+		m.requests, m.errors, m.latency, m.decompressionLimitExceeded,
+	}
+}
+
+// observe 记录一次已完成的请求，mt为message_type标签的取值
+func (m *connMetrics) observe(mt string, retcode string, d time.Duration) {
+	m.requests.WithLabelValues(mt, retcode).Inc()
+	if retcode != "0" {
+		m.errors.WithLabelValues(mt, retcode).Inc()
+	}
+	m.latency.WithLabelValues(mt, retcode).Observe(d.Seconds())
+}
+
+var (
+	serverMetrics = newConnMetrics("server", "accepted")
+	clientMetrics = newConnMetrics("client", "established")
+
+	clientRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bgserver", Subsystem: "client", Name: "retries_total",
+		Help: "Total number of retried requests, by message type.",
+	}, []string{"message_type"})
+	clientHedges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bgserver", Subsystem: "client", Name: "hedges_total",
+		Help: "Total number of hedged requests sent, by message type.",
+	}, []string{"message_type"})
+	clientHedgeWins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bgserver", Subsystem: "client", Name: "hedge_wins_total",
+		Help: "Total number of calls answered by a hedged request, by message type.",
+	}, []string{"message_type"})
+
+	shadowRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bgserver", Subsystem: "shadow", Name: "requests_total",
+		Help: "Total number of shadow requests, by message type and result (matched, mismatched, failed or dropped).",
+	}, []string{"message_type", "result"})
+
+	pubsubPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "bgserver", Subsystem: "pubsub", Name: "published_total",
+		Help: "Total number of messages published by the server.",
+	})
+	pubsubDelivered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "bgserver", Subsystem: "pubsub", Name: "delivered_total",
+		Help: "Total number of published messages queued for the subscribed connections.",
+	})
+	pubsubEvicted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "bgserver", Subsystem: "pubsub", Name: "evicted_total",
+		Help: "Total number of subscribed connections closed for being too slow.",
+	})
+
+	sessionsOnline = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "bgserver", Subsystem: "sessions", Name: "online",
+		Help: "Number of connections bound in the session registry.",
+	})
+	sessionEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bgserver", Subsystem: "sessions", Name: "events_total",
+		Help: "Total number of presence changes, by type (online, offline, kicked or rejected).",
+	}, []string{"type"})
+	sessionLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bgserver", Subsystem: "sessions", Name: "lookups_total",
+		Help: "Total number of session lookups, by result (found or not_found).",
+	}, []string{"result"})
+)
+
+func registerMetrics() {
+	prometheus.MustRegister(serverMetrics.collectors()...)
+	prometheus.MustRegister(clientMetrics.collectors()...)
+	prometheus.MustRegister(clientRetries, clientHedges, clientHedgeWins, shadowRequests)
+	prometheus.MustRegister(pubsubPublished, pubsubDelivered, pubsubEvicted)
+	prometheus.MustRegister(sessionsOnline, sessionEvents, sessionLookups)
+}
+
+// meteredConn 统计一条连接上收发的字节数
+type meteredConn struct {
+	bytesIn  uint64
+	bytesOut uint64
+
+	net.Conn
+	m         *connMetrics
+	closeOnce sync.Once
+}
+
+func newMeteredConn(c net.Conn, m *connMetrics) *meteredConn {
+	m.connsOpened.Inc()
+	m.connsOpen.Inc()
+	return &meteredConn{Conn: c, m: m}
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+	c.m.bytesIn.Add(float64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+	c.m.bytesOut.Add(float64(n))
+	return n, err
+}
+
+func (c *meteredConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.m.connsOpen.Dec()
+		c.m.connsClosed.Inc()
+	})
+	return c.Conn.Close()
+}
+
+// MetricsHandler returns an http.Handler serving all bgserver metrics in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ServeMetrics 在addr上启动HTTP服务，通过/metrics路径提供指标. 该函数会一直阻塞.
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// MetricsAddr returns a ServerOption that serves the metrics on addr/metrics
+// over HTTP once the server starts serving.
+func MetricsAddr(addr string) ServerOption {
+	return func(o *serverOptions) {
+		o.metricsAddr = addr
+	}
+}
+
+func (s *Server) serveMetrics() {
+	if err := ServeMetrics(s.opts.metricsAddr); err != nil {
+		Error("failed to serve metrics", "addr", s.opts.metricsAddr, "error", err)
+	}
+}
@@ -0,0 +1,294 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	. "bgserver/common"
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
+	"bgserver/status"
+)
+
+// DefaultSubscriberBuffer 为默认每个订阅连接缓存的待推送消息数
+const DefaultSubscriberBuffer = 256
+
+// SubscriberBuffer returns a ServerOption that sets the number of published messages
+// buffered for each subscribed connection, DefaultSubscriberBuffer by default. A
+// connection whose buffer is full is considered a slow consumer: it is unsubscribed
+// from all its topics and closed, so that it does not hold back the publishers.
+func SubscriberBuffer(n int) ServerOption {
+	return func(o *serverOptions) {
+		o.subscriberBuffer = n
+	}
+}
+
+const (
+	// DefaultMaxSubscriptions 为默认每个连接最多订阅的主题数
+	DefaultMaxSubscriptions = 1024
+	// MaxTopicLength 为主题名的最大字节数
+	MaxTopicLength = 256
+)
+
+// MaxSubscriptions returns a ServerOption that sets the maximum number of topics a
+// connection may subscribe to, DefaultMaxSubscriptions by default. A subscribe
+// request that would exceed it is rejected as a whole with EC_INVALID_ARGUMENT.
+func MaxSubscriptions(n int) ServerOption {
+	return func(o *serverOptions) {
+		o.maxSubscriptions = n
+	}
+}
+
+// pubsub 记录server上每个主题的订阅连接
+type pubsub struct {
+	mu     sync.Mutex
+	topics map[string]map[*subscriber]bool
+	subs   map[*serverConn]*subscriber
+}
+
+// subscriber 为一条订阅了主题的连接，发布的消息先进入queue，再由writeLoop按顺序写入连接
+type subscriber struct {
+	sc     *serverConn
+	topics map[string]bool // 由pubsub.mu保护
+	queue  chan *pb.BMessage
+	done   chan struct{}
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{
+		topics: make(map[string]map[*subscriber]bool),
+		subs:   make(map[*serverConn]*subscriber),
+	}
+}
+
+// validTopic 检查主题名，空的和超过MaxTopicLength的主题名不能订阅
+func validTopic(topic string) error {
+	if topic == "" {
+		return errors.New("empty topic")
+	}
+	if len(topic) > MaxTopicLength {
+		return fmt.Errorf("topic longer than %d bytes", MaxTopicLength)
+	}
+	return nil
+}
+
+// update 为sc订阅和取消订阅主题，返回sc当前订阅的所有主题. 主题名无效或订阅的主题数将超过max时
+// 整个请求都不生效.
+func (ps *pubsub) update(sc *serverConn, subscribe, unsubscribe []string, buffer, max int) ([]string, error) {
+	for _, t := range subscribe {
+		if err := validTopic(t); err != nil {
+			return nil, err
+		}
+	}
+	if max <= 0 {
+		max = DefaultMaxSubscriptions
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if sc.unsubscribed {
+		// 连接已经关闭
+		return nil, nil
+	}
+	sub, ok := ps.subs[sc]
+	var current map[string]bool
+	if ok {
+		current = sub.topics
+	}
+	if n := countAfterUpdate(current, subscribe, unsubscribe); n > max {
+		return nil, fmt.Errorf("subscribing to %d topics, more than %d", n, max)
+	}
+	if !ok {
+		if buffer <= 0 {
+			buffer = DefaultSubscriberBuffer
+		}
+		sub = &subscriber{
+			sc:     sc,
+			topics: make(map[string]bool),
+			queue:  make(chan *pb.BMessage, buffer),
+			done:   make(chan struct{}),
+		}
+		ps.subs[sc] = sub
+		go sub.writeLoop()
+	}
+	for _, t := range subscribe {
+		if sub.topics[t] {
+			continue
+		}
+		sub.topics[t] = true
+		if ps.topics[t] == nil {
+			ps.topics[t] = make(map[*subscriber]bool)
+		}
+		ps.topics[t][sub] = true
+	}
+	for _, t := range unsubscribe {
+		if sub.topics[t] {
+			ps.unsubscribeLocked(sub, t)
+		}
+	}
+	topics := make([]string, 0, len(sub.topics))
+	for t := range sub.topics {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// countAfterUpdate 返回按update的顺序先订阅subscribe再取消unsubscribe后订阅的主题数
+func countAfterUpdate(current map[string]bool, subscribe, unsubscribe []string) int {
+	added := make(map[string]bool)
+	for _, t := range subscribe {
+		if !current[t] {
+			added[t] = true
+		}
+	}
+	n := len(current) + len(added)
+	removed := make(map[string]bool)
+	for _, t := range unsubscribe {
+		if (current[t] || added[t]) && !removed[t] {
+			removed[t] = true
+			n--
+		}
+	}
+	return n
+}
+
+func (ps *pubsub) unsubscribeLocked(sub *subscriber, topic string) {
+	delete(sub.topics, topic)
+	delete(ps.topics[topic], sub)
+	if len(ps.topics[topic]) == 0 {
+		delete(ps.topics, topic)
+	}
+}
+
+// remove 取消sc的所有订阅，在连接关闭时调用
+func (ps *pubsub) remove(sc *serverConn) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sc.unsubscribed = true
+	ps.removeLocked(sc)
+}
+
+func (ps *pubsub) removeLocked(sc *serverConn) {
+	sub, ok := ps.subs[sc]
+	if !ok {
+		return
+	}
+	for t := range sub.topics {
+		ps.unsubscribeLocked(sub, t)
+	}
+	delete(ps.subs, sc)
+	close(sub.done)
+}
+
+// publish 将m放入订阅了topic的所有连接的队列，返回放入的连接数
+func (ps *pubsub) publish(topic string, m *pb.BMessage) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	n := 0
+	for sub := range ps.topics[topic] {
+		select {
+		case sub.queue <- m:
+			n++
+		default:
+			// 慢消费者，关闭连接后client会重新连接并订阅
+			sub.sc.logger.Warn("evict the slow subscriber", "topic", topic, "buffer", cap(sub.queue))
+			pubsubEvicted.Inc()
+			ps.removeLocked(sub.sc)
+			sub.sc.conn.Close()
+		}
+	}
+	return n
+}
+
+func (sub *subscriber) writeLoop() {
+	for {
+		select {
+		case m := <-sub.queue:
+			// 同一条推送被放入所有订阅连接的队列，不能直接修改. 推送使用该连接协商得到的版本
+			head := proto.Clone(m.GetHead()).(*pb.Head)
+			head.Version = proto.Uint32(sub.sc.conn.Version())
+			m = &pb.BMessage{Head: head, Body: m.GetBody()}
+			if err := sub.sc.conn.WriteMsg(m); err != nil {
+				select {
+				case <-sub.done:
+					// 已被剔除或连接已关闭
+				default:
+					sub.sc.logger.Warn("failed to push the message", "error", err)
+				}
+				return
+			}
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// Publish sends msg to all the connections subscribed to topic, wrapped in a
+// PUSH_MESSAGE, and returns the number of them. The PUSH_MESSAGE carries the
+// protocol version negotiated on each connection. It does not wait for the message
+// to be written to the connections. msg must not be modified afterwards.
+func (s *Server) Publish(topic string, msg *pb.BMessage) int {
+	push := &pb.BMessage{
+		Head: &pb.Head{
+			SessionNo:   proto.String(""),
+			MessageType: proto.Int32(int32(pb.MessageType_PUSH_MESSAGE)),
+			Source:      proto.Uint32(msg.GetHead().GetSource()),
+		},
+		Body: &pb.Body{
+			PushMessage: &pb.PushMessage{
+				Topic:   proto.String(topic),
+				Message: msg,
+			},
+		},
+	}
+	pubsubPublished.Inc()
+	n := s.pubsub.publish(topic, push)
+	pubsubDelivered.Add(float64(n))
+	return n
+}
+
+// Topics returns the number of subscribed connections of every topic.
+func (s *Server) Topics() map[string]int {
+	s.pubsub.mu.Lock()
+	defer s.pubsub.mu.Unlock()
+	topics := make(map[string]int, len(s.pubsub.topics))
+	for t, subs := range s.pubsub.topics {
+		topics[t] = len(subs)
+	}
+	return topics
+}
+
+// serverConnKey 为context中保存请求所在连接的键，供内置的处理函数使用
+type serverConnKey struct{}
+
+// handleSubscribe 为请求所在的连接订阅和取消订阅主题
+func (s *Server) handleSubscribe(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+	sreq := req.GetBody().GetSubscribeRequest()
+	if sreq == nil {
+		return nil, errors.New("the message has no subscribe_request")
+	}
+	sc, ok := ctx.Value(serverConnKey{}).(*serverConn)
+	if !ok {
+		return nil, errors.New("subscribe_request is only accepted on a connection")
+	}
+	topics, err := s.pubsub.update(sc, sreq.GetSubscribe(), sreq.GetUnsubscribe(), s.opts.subscriberBuffer, s.opts.maxSubscriptions)
+	LoggerFromContext(ctx).Debug("subscribe request", "subscribe", sreq.GetSubscribe(),
+		"unsubscribe", sreq.GetUnsubscribe(), "error", err)
+	if err != nil {
+		return nil, status.Error(int32(pb.ErrorCode_EC_INVALID_ARGUMENT), err.Error())
+	}
+	return &pb.BMessage{
+		Head: NewResponseHead(req.GetHead()),
+		Body: &pb.Body{
+			SubscribeResponse: &pb.SubscribeResponse{
+				Rc:     &pb.ResponseCode{Retcode: proto.Int32(int32(pb.ErrorCode_EC_OK))},
+				Topics: topics,
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,176 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	. "bgserver/common"
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
+	"bgserver/status"
+)
+
+// pushVersions 返回捕获文件中client收到的PUSH_MESSAGE的Head.version
+func pushVersions(t *testing.T, path string) []uint32 {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var versions []uint32
+	r := NewCaptureReader(f)
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			break
+		}
+		m, err := DecodeFrame(NewProtoCodec(), rec.Frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Direction == CaptureIn && pb.MessageType(m.GetHead().GetMessageType()) == pb.MessageType_PUSH_MESSAGE {
+			versions = append(versions, m.GetHead().GetVersion())
+		}
+	}
+	return versions
+}
+
+func TestPublishUsesConnectionVersion(t *testing.T) {
+	s := NewServer(SupportedVersions(1, 2))
+	addr := startServer(t, s)
+
+	var paths []string
+	var chans []<-chan *pb.BMessage
+	for _, v := range []uint32{1, 2} {
+		path := filepath.Join(t.TempDir(), "capture")
+		c, err := NewCapture(path, RotateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 在ClientConn关闭之后关闭
+		t.Cleanup(func() { c.Close() })
+		cc := dial(t, addr, WithVersions(v, v), WithCapture(c))
+		_, ch, err := cc.SubscribeChan(context.Background(), 0, "news", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		chans = append(chans, ch)
+	}
+
+	// 调用者消息中的版本不影响推送使用的版本
+	msg := newRequest(testMessageType, 0)
+	msg.Head.Version = proto.Uint32(7)
+	if n := s.Publish("news", msg); n != 2 {
+		t.Fatalf("published to %d connections, want 2", n)
+	}
+	for i, ch := range chans {
+		select {
+		case m := <-ch:
+			if m.GetHead().GetVersion() != 7 {
+				t.Errorf("the published message is modified: version %d", m.GetHead().GetVersion())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("client %d: no push", i)
+		}
+	}
+	for i, path := range paths {
+		if got, want := pushVersions(t, path), []uint32{uint32(i + 1)}; !reflect.DeepEqual(got, want) {
+			t.Errorf("client %d: push versions %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestSubscriptionLimit(t *testing.T) {
+	s := NewServer(MaxSubscriptions(2))
+	cc := dial(t, startServer(t, s))
+	ctx := context.Background()
+	h := func(string, *pb.BMessage) {}
+
+	for _, topic := range []string{"a", "b"} {
+		if _, err := cc.Subscribe(ctx, 0, topic, h); err != nil {
+			t.Fatalf("subscribe %s: %v", topic, err)
+		}
+	}
+	if _, err := cc.Subscribe(ctx, 0, "c", h); status.Code(err) != int32(pb.ErrorCode_EC_INVALID_ARGUMENT) {
+		t.Fatalf("subscribe over the limit: got %v, want EC_INVALID_ARGUMENT", err)
+	}
+	// 超过上限的请求整个不生效
+	if err := cc.sendSubscribe(ctx, 0, []string{"a", "c"}, nil); status.Code(err) != int32(pb.ErrorCode_EC_INVALID_ARGUMENT) {
+		t.Fatalf("got %v, want EC_INVALID_ARGUMENT", err)
+	}
+	if got, want := s.Topics(), map[string]int{"a": 1, "b": 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("topics %v, want %v", got, want)
+	}
+	// 同一请求中取消订阅的主题不计入上限
+	if err := cc.sendSubscribe(ctx, 0, []string{"c"}, []string{"a"}); err != nil {
+		t.Fatalf("subscribe c and unsubscribe a: %v", err)
+	}
+	if got, want := s.Topics(), map[string]int{"b": 1, "c": 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("topics %v, want %v", got, want)
+	}
+}
+
+func TestSubscribeInvalidTopic(t *testing.T) {
+	s := NewServer()
+	cc := dial(t, startServer(t, s))
+	for _, topic := range []string{"", strings.Repeat("t", MaxTopicLength+1)} {
+		_, err := cc.Subscribe(context.Background(), 0, topic, func(string, *pb.BMessage) {})
+		if status.Code(err) != int32(pb.ErrorCode_EC_INVALID_ARGUMENT) {
+			t.Errorf("topic of %d bytes: got %v, want EC_INVALID_ARGUMENT", len(topic), err)
+		}
+	}
+	if topics := s.Topics(); len(topics) != 0 {
+		t.Errorf("topics %v, want none", topics)
+	}
+}
+
+func TestValidTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		valid bool
+	}{
+		{"", false},
+		{"a", true},
+		{"room/1024", true},
+		{strings.Repeat("t", MaxTopicLength), true},
+		{strings.Repeat("t", MaxTopicLength+1), false},
+	}
+	for _, tt := range tests {
+		if err := validTopic(tt.topic); (err == nil) != tt.valid {
+			t.Errorf("validTopic(%d bytes) = %v, want valid %v", len(tt.topic), err, tt.valid)
+		}
+	}
+}
+
+func TestCountAfterUpdate(t *testing.T) {
+	current := map[string]bool{"a": true, "b": true}
+	tests := []struct {
+		subscribe, unsubscribe []string
+		want                   int
+	}{
+		{nil, nil, 2},
+		{[]string{"c"}, nil, 3},
+		{[]string{"a", "c", "c"}, nil, 3},
+		{nil, []string{"a", "a", "x"}, 1},
+		{[]string{"c"}, []string{"a"}, 2},
+		// 先订阅后取消，同一请求中订阅又取消的主题不计入
+		{[]string{"c"}, []string{"c"}, 2},
+		{[]string{"a"}, []string{"a"}, 1},
+	}
+	for _, tt := range tests {
+		if n := countAfterUpdate(current, tt.subscribe, tt.unsubscribe); n != tt.want {
+			t.Errorf("subscribe %v, unsubscribe %v: %d topics, want %d", tt.subscribe, tt.unsubscribe, n, tt.want)
+		}
+	}
+	if n := countAfterUpdate(nil, []string{"a", "b"}, nil); n != 2 {
+		t.Errorf("no current topics: %d, want 2", n)
+	}
+}
@@ -0,0 +1,11 @@
+package network
+
+import (
+	. "bgserver/common"
+	. "bgserver/message"
+)
+
+// readMsg 读取一个完整的帧，并按帧头中的压缩算法将其解码到m中
+func readMsg(p *Parser, c Codec, dcs map[uint8]Decompressor, maxDecompressedSize int, m interface{}) error {
+	return Recv(p, c, dcs, maxDecompressedSize, m)
+}
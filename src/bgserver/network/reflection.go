@@ -0,0 +1,117 @@
+package network
+
+import (
+	"reflect"
+	"runtime"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	. "bgserver/message"
+	"bgserver/message/msgrange"
+	pb "bgserver/message/proto/golang"
+)
+
+// Reflection returns a ServerOption that makes the server answer REFLECTION_REQUEST
+// messages with the message types it handles and the FileDescriptorProtos of their
+// body fields, so that generic tools can build requests without the .proto files.
+func Reflection() ServerOption {
+	return func(o *serverOptions) {
+		o.reflection = true
+	}
+}
+
+// handler 返回消息类型messageType的处理函数，没有注册Handler时使用内置的处理函数
+func (s *Server) handler(messageType int32) (Handler, bool) {
+	s.mu.Lock()
+	h, ok := s.handlers[messageType]
+	s.mu.Unlock()
+	if ok {
+		return h, true
+	}
+	return s.builtinHandler(messageType)
+}
+
+// messageTypes 返回server可以处理的所有消息类型，按从小到大排序
+func (s *Server) messageTypes() []int32 {
+	var mts []int32
+	for mt := msgrange.BuiltinMessageTypes.Begin; mt < msgrange.BuiltinMessageTypes.End; mt++ {
+		if _, ok := s.builtinHandler(mt); ok {
+			mts = append(mts, mt)
+		}
+	}
+	s.mu.Lock()
+	for mt := range s.handlers {
+		if _, ok := s.builtinHandler(mt); !ok {
+			mts = append(mts, mt)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(mts, func(i, j int) bool { return mts[i] < mts[j] })
+	return mts
+}
+
+// handleReflection 处理REFLECTION_REQUEST消息
+func (s *Server) handleReflection(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+	mts := req.GetBody().GetReflectionRequest().GetMessageTypes()
+	if len(mts) == 0 {
+		mts = s.messageTypes()
+	}
+	rresp := &pb.ReflectionResponse{
+		Rc: &pb.ResponseCode{Retcode: proto.Int32(int32(pb.ErrorCode_EC_OK))},
+	}
+	var filenames []string
+	for _, mt := range mts {
+		h, ok := s.handler(mt)
+		if !ok {
+			continue
+		}
+		info := &pb.MessageTypeInfo{
+			MessageType: proto.Int32(mt),
+			Handler:     proto.String(funcName(h)),
+		}
+		if f, ok := GetBodyFieldInfo(mt); ok {
+			info.RequestField = proto.String(f.Name)
+			info.RequestType = proto.String(f.TypeName)
+			filenames = append(filenames, f.Filename)
+		}
+		if f, ok := GetBodyFieldInfo(mt + 1); ok {
+			info.ResponseField = proto.String(f.Name)
+			info.ResponseType = proto.String(f.TypeName)
+			filenames = append(filenames, f.Filename)
+		}
+		rresp.MessageTypes = append(rresp.MessageTypes, info)
+	}
+
+	fds, err := LoadFileDescriptors(filenames...)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range msgrange.RegisteredServices() {
+		rresp.Ranges = append(rresp.Ranges, &pb.MessageTypeRange{
+			Package: proto.String(spec.Name),
+			Begin:   proto.Int32(spec.MessageTypes.Begin),
+			End:     proto.Int32(spec.MessageTypes.End),
+		})
+	}
+	for _, fd := range fds {
+		b, err := proto.Marshal(fd)
+		if err != nil {
+			return nil, err
+		}
+		rresp.FileDescriptors = append(rresp.FileDescriptors, b)
+	}
+	return &pb.BMessage{
+		Head: NewResponseHead(req.GetHead()),
+		Body: &pb.Body{ReflectionResponse: rresp},
+	}, nil
+}
+
+// funcName 返回函数的完整名字，如bgserver/service1.(*Service).SayHello-fm
+func funcName(f interface{}) string {
+	if fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return ""
+}
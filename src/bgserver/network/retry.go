@@ -0,0 +1,171 @@
+package network
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "bgserver/common"
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
+)
+
+// RetryPolicy 描述某一消息类型的请求在失败后如何重试.
+type RetryPolicy struct {
+	// MaxAttempts 为最大的发送次数(包含第一次发送)，小于2时不会重试
+	MaxAttempts int
+	// 第n次重试前等待 min(InitialBackoff * BackoffMultiplier^(n-1), MaxBackoff)，并加上随机抖动
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	// RetryableCodes 为可以重试的返回码(ResponseCode.retcode)
+	RetryableCodes []int32
+	// RetryableErrors 为可以重试的传输层错误，如io.EOF、ErrConnBroken，用errors.Is比较
+	RetryableErrors []error
+	// Idempotent 表示请求是否幂等. 非幂等的请求在可能已被server收到的情况下
+	// 不会因传输层错误而重试，只有确定请求未发出或server返回可重试的返回码时才重试
+	Idempotent bool
+}
+
+// RetryBudget 限制一个ClientConn上的重试次数，避免在服务故障时重试放大流量.
+// 每次需要重试的失败消耗一个令牌(已达到MaxAttempts的失败不消耗)，每个成功的请求归还TokenRatio个令牌，
+// 令牌数不高于MaxTokens的一半时停止重试.
+type RetryBudget struct {
+	MaxTokens  float64
+	TokenRatio float64
+}
+
+var defaultRetryBudget = RetryBudget{
+	MaxTokens:  10,
+	TokenRatio: 0.1,
+}
+
+// WithRetryPolicy returns a DialOption that specifies the retry policy of each message type.
+// Message types that are absent from policies are never retried.
+func WithRetryPolicy(policies map[int32]RetryPolicy) DialOption {
+	return func(o *dialOptions) {
+		o.retryPolicies = policies
+	}
+}
+
+// WithRetryBudget returns a DialOption that overrides the default retry budget of the ClientConn.
+func WithRetryBudget(b RetryBudget) DialOption {
+	return func(o *dialOptions) {
+		o.retryBudget = &b
+	}
+}
+
+// retryThrottler 实现RetryBudget描述的令牌桶
+type retryThrottler struct {
+	max    float64
+	thresh float64
+	ratio  float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+func newRetryThrottler(b RetryBudget) *retryThrottler {
+	return &retryThrottler{
+		max:    b.MaxTokens,
+		thresh: b.MaxTokens / 2,
+		ratio:  b.TokenRatio,
+		tokens: b.MaxTokens,
+	}
+}
+
+// throttle 记录一次失败，返回true表示预算已耗尽，不应再重试
+func (t *retryThrottler) throttle() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens--
+	if t.tokens < 0 {
+		t.tokens = 0
+	}
+	return t.tokens <= t.thresh
+}
+
+// successfulCall 记录一次成功的调用
+func (t *retryThrottler) successfulCall() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens += t.ratio
+	if t.tokens > t.max {
+		t.tokens = t.max
+	}
+}
+
+func (cc *ClientConn) invokeWithRetry(ctx context.Context, req *pb.BMessage, p RetryPolicy) (*pb.BMessage, error) {
+	for attempt := 1; ; attempt++ {
+		resp, sent, err := cc.pickAddrConn().invoke(ctx, req)
+		if !p.retryable(ctx, resp, sent, err) {
+			if err == nil && GetResponseCode(resp).GetRetcode() == 0 {
+				cc.throttler.successfulCall()
+			}
+			return resp, err
+		}
+		// 最后一次失败之后不会再重试，不消耗预算
+		if attempt >= p.MaxAttempts || cc.throttler.throttle() {
+			return resp, err
+		}
+		clientRetries.WithLabelValues(strconv.Itoa(int(req.GetHead().GetMessageType()))).Inc()
+		LoggerFromContext(ctx).Debug("retry the call", "attempt", attempt, "error", err,
+			"retcode", GetResponseCode(resp).GetRetcode())
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(p.backoff(attempt)):
+		}
+	}
+}
+
+// retryable 判断一次调用的结果是否可以重试
+func (p *RetryPolicy) retryable(ctx context.Context, resp *pb.BMessage, sent bool, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		if !sent {
+			return true
+		}
+		if !p.Idempotent {
+			return false
+		}
+		for _, e := range p.RetryableErrors {
+			if errors.Is(err, e) {
+				return true
+			}
+		}
+		return false
+	}
+	rc := GetResponseCode(resp)
+	if rc == nil {
+		return false
+	}
+	for _, code := range p.RetryableCodes {
+		if code == rc.GetRetcode() {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff 返回第attempt次失败后到下一次重试前需等待的时间
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	mult := p.BackoffMultiplier
+	if mult < 1 {
+		mult = 1
+	}
+	d := float64(p.InitialBackoff) * math.Pow(mult, float64(attempt-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	// 加上±20%的随机抖动，避免多个client同时重试
+	d *= 1 + 0.2*(rand.Float64()*2-1)
+	return time.Duration(d)
+}
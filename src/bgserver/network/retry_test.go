@@ -0,0 +1,167 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	pb "bgserver/message/proto/golang"
+	"bgserver/status"
+)
+
+// 业务返回的可重试返回码
+const retcodeBusy = 1003
+
+// flakyServer 对前failures次请求返回retcodeBusy，之后正常回复，并记录收到的session_no
+type flakyServer struct {
+	mu         sync.Mutex
+	failures   int
+	sessionNos []string
+}
+
+func (f *flakyServer) handle(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessionNos = append(f.sessionNos, req.GetHead().GetSessionNo())
+	if len(f.sessionNos) <= f.failures {
+		return nil, status.Error(retcodeBusy, "busy")
+	}
+	return echoHandler(ctx, req)
+}
+
+func (f *flakyServer) attempts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sessionNos)
+}
+
+func retryClient(t *testing.T, f *flakyServer, p RetryPolicy, b RetryBudget) *ClientConn {
+	s := NewServer()
+	s.Handle(testMessageType, f.handle)
+	return dial(t, startServer(t, s),
+		WithRetryPolicy(map[int32]RetryPolicy{testMessageType: p}),
+		WithRetryBudget(b))
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	f := &flakyServer{failures: 2}
+	cc := retryClient(t, f, RetryPolicy{MaxAttempts: 3, RetryableCodes: []int32{retcodeBusy}},
+		RetryBudget{MaxTokens: 10, TokenRatio: 0.1})
+	if rc := invoke(t, cc, newRequest(testMessageType, 0)); rc != 0 {
+		t.Fatalf("retcode %d, want 0 after the retries", rc)
+	}
+	if n := f.attempts(); n != 3 {
+		t.Fatalf("%d attempts, want 3", n)
+	}
+	// 重试使用相同的session_no，server可以据此去重
+	for _, sn := range f.sessionNos {
+		if sn != f.sessionNos[0] {
+			t.Fatalf("session_no changed between attempts: %q", f.sessionNos)
+		}
+	}
+}
+
+func TestRetryMaxAttemptsDoesNotSpendBudget(t *testing.T) {
+	f := &flakyServer{failures: 100}
+	cc := retryClient(t, f, RetryPolicy{MaxAttempts: 3, RetryableCodes: []int32{retcodeBusy}},
+		RetryBudget{MaxTokens: 10, TokenRatio: 0.1})
+	if rc := invoke(t, cc, newRequest(testMessageType, 0)); rc != retcodeBusy {
+		t.Fatalf("retcode %d, want %d", rc, retcodeBusy)
+	}
+	if n := f.attempts(); n != 3 {
+		t.Fatalf("%d attempts, want 3", n)
+	}
+	// 3次发送中只有前2次失败之后发生了重试
+	cc.throttler.mu.Lock()
+	tokens := cc.throttler.tokens
+	cc.throttler.mu.Unlock()
+	if tokens != 8 {
+		t.Fatalf("%v tokens left, want 8", tokens)
+	}
+}
+
+func TestRetryBudgetStopsRetries(t *testing.T) {
+	f := &flakyServer{failures: 100}
+	// 第一次重试后令牌数降到阈值2，之后不再重试
+	cc := retryClient(t, f, RetryPolicy{MaxAttempts: 5, RetryableCodes: []int32{retcodeBusy}},
+		RetryBudget{MaxTokens: 4, TokenRatio: 0.1})
+	invoke(t, cc, newRequest(testMessageType, 0))
+	if n := f.attempts(); n != 2 {
+		t.Fatalf("%d attempts, want 2", n)
+	}
+	invoke(t, cc, newRequest(testMessageType, 0))
+	if n := f.attempts(); n != 3 {
+		t.Fatalf("%d attempts after the budget ran out, want 3", n)
+	}
+}
+
+func TestRetryThrottler(t *testing.T) {
+	th := newRetryThrottler(RetryBudget{MaxTokens: 10, TokenRatio: 2})
+	for i := 1; i <= 4; i++ {
+		if th.throttle() {
+			t.Fatalf("throttled after %d failures", i)
+		}
+	}
+	if !th.throttle() {
+		t.Fatal("not throttled at half of the tokens")
+	}
+	th.successfulCall()
+	if th.throttle() {
+		t.Fatal("throttled after a successful call returned tokens")
+	}
+	for i := 0; i < 100; i++ {
+		th.successfulCall()
+	}
+	if th.tokens != 10 {
+		t.Fatalf("%v tokens, want them capped at 10", th.tokens)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	ctx := context.Background()
+	wrapped := fmt.Errorf("read: %w", io.EOF)
+	tests := []struct {
+		name  string
+		p     RetryPolicy
+		sent  bool
+		err   error
+		retry bool
+	}{
+		{"not sent", RetryPolicy{}, false, ErrConnBroken, true},
+		{"sent, not idempotent", RetryPolicy{RetryableErrors: []error{io.EOF}}, true, io.EOF, false},
+		{"sent, idempotent", RetryPolicy{Idempotent: true, RetryableErrors: []error{io.EOF}}, true, io.EOF, true},
+		{"wrapped error", RetryPolicy{Idempotent: true, RetryableErrors: []error{io.EOF}}, true, wrapped, true},
+		{"other error", RetryPolicy{Idempotent: true, RetryableErrors: []error{io.EOF}}, true, ErrConnBroken, false},
+	}
+	for _, tt := range tests {
+		if got := tt.p.retryable(ctx, nil, tt.sent, tt.err); got != tt.retry {
+			t.Errorf("%s: retryable = %v, want %v", tt.name, got, tt.retry)
+		}
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if (&RetryPolicy{}).retryable(cancelled, nil, false, ErrConnBroken) {
+		t.Error("retried after the context was cancelled")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond, BackoffMultiplier: 2}
+	for attempt, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 300 * time.Millisecond,
+		4: 300 * time.Millisecond,
+	} {
+		for i := 0; i < 20; i++ {
+			d := p.backoff(attempt)
+			if d < want*8/10 || d > want*12/10 {
+				t.Fatalf("attempt %d: backoff %v, want %v±20%%", attempt, d, want)
+			}
+		}
+	}
+}
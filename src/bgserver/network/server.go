@@ -0,0 +1,408 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "bgserver/common"
+	. "bgserver/message"
+	"bgserver/message/msgrange"
+	pb "bgserver/message/proto/golang"
+	"bgserver/status"
+)
+
+var (
+	ErrServerStopped = errors.New("the server has been stopped")
+)
+
+// Handler 处理一条请求消息并返回响应消息，返回的响应为nil时不回包.
+// 返回的错误由status.Convert转换为消息头中的返回码：*status.Status和生成代码中的
+// ErrorCode保留其返回码，其它错误以EC_INTERNAL的形式返回给client.
+type Handler func(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error)
+
+// ServerInterceptor 拦截对Handler的调用，可在调用h前后做额外的处理，
+// 也可以不调用h而直接返回响应.
+type ServerInterceptor func(ctx context.Context, req *pb.BMessage, h Handler) (*pb.BMessage, error)
+
+// server启动时可指定的选项
+type serverOptions struct {
+	codec         Codec              // 编码解码
+	compression   compressionOptions // 压缩算法的选择
+	frameChecksum bool               // 使用v2帧头时是否携带CRC32C
+	maxFrameSize  int                // 接收的一帧消息体的大小上限，为0时使用DefaultMaxFrameSize
+	capture       *Capture           // 捕获收发的帧，为nil时不捕获
+	handshaker    ServerHandshaker   // 连接建立后的鉴权握手
+	versions      versionRange       // 支持的协议版本范围
+	metricsAddr   string             // 提供/metrics的HTTP地址，为空时不提供
+
+	adminAddr      string               // 提供管理接口的HTTP地址，为空时不提供
+	adminMessage   bool                 // 是否处理ADMIN_REQUEST消息
+	adminAuthorize func(*AuthInfo) bool // 判断对端是否可以发送ADMIN_REQUEST，为nil时全部拒绝
+	reflection     bool                 // 是否处理REFLECTION_REQUEST消息
+
+	interceptors []ServerInterceptor // 按添加的顺序由外向内包装Handler
+
+	subscriberBuffer int // 每个订阅连接缓存的待推送消息数
+	maxSubscriptions int // 每个连接最多订阅的主题数
+
+	sessions *SessionOptions // 会话注册表的设置，为nil时不启用
+}
+
+// 用于设置serverOptions中的字段
+type ServerOption func(*serverOptions)
+
+// CustomCodec returns a ServerOption that sets a codec for message marshaling and unmarshaling.
+func CustomCodec(c Codec) ServerOption {
+	return func(o *serverOptions) {
+		o.codec = c
+	}
+}
+
+// Interceptor returns a ServerOption that adds an interceptor around the handlers.
+// Interceptors added earlier are outer, i.e. called first.
+func Interceptor(i ServerInterceptor) ServerOption {
+	return func(o *serverOptions) {
+		o.interceptors = append(o.interceptors, i)
+	}
+}
+
+// MsgCompressor returns a ServerOption that adds a compressor for outbound messages.
+// On each connection the first compressor accepted by the client is used;
+// compressors added earlier are preferred. cp must be registered with
+// common.RegisterCompression.
+func MsgCompressor(cp Compressor) ServerOption {
+	return func(o *serverOptions) {
+		o.compression.compressors = append(o.compression.compressors, cp)
+	}
+}
+
+// MsgDecompressor returns a ServerOption that adds a compression algorithm the
+// server accepts for inbound messages. Without it every registered algorithm is
+// accepted.
+func MsgDecompressor(dc Decompressor) ServerOption {
+	return func(o *serverOptions) {
+		o.compression.decompressors = append(o.compression.decompressors, dc)
+	}
+}
+
+// Server is a bgserver server to serve BMessage requests.
+type Server struct {
+	opts serverOptions
+
+	mu       sync.Mutex
+	lis      map[net.Listener]bool
+	conns    map[*serverConn]bool
+	handlers map[int32]Handler
+	stopped  bool
+	pubsub   *pubsub
+	sessions *sessions // 未启用会话注册表时为nil
+
+	metricsOnce sync.Once
+	adminOnce   sync.Once
+	admin       *http.Server // 管理接口的HTTP服务
+}
+
+// NewServer creates a bgserver server which has no handler registered
+// and has not started to accept requests yet.
+func NewServer(opt ...ServerOption) *Server {
+	opts := serverOptions{
+		versions: defaultVersionRange,
+	}
+	for _, o := range opt {
+		o(&opts)
+	}
+	if opts.codec == nil {
+		// Set the default codec.
+		opts.codec = NewProtoCodec()
+	}
+	return &Server{
+		opts:     opts,
+		lis:      make(map[net.Listener]bool),
+		conns:    make(map[*serverConn]bool),
+		handlers: make(map[int32]Handler),
+		pubsub:   newPubsub(),
+		sessions: newSessions(opts.sessions),
+	}
+}
+
+// Handle 注册某一消息类型的处理函数. 需在Serve之前调用.
+func (s *Server) Handle(messageType int32, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.handlers[messageType]; ok {
+		Fatalf("bgserver: Server.Handle found duplicate handler for message type %d", messageType)
+	}
+	if _, ok := msgrange.LookupMessageType(messageType); !ok {
+		Warn("the message type is not in the range of any registered service", "message_type", messageType)
+	}
+	s.handlers[messageType] = h
+}
+
+// Serve accepts incoming connections on the listener lis, creating a new
+// goroutine for each. Serve returns when lis.Accept fails.
+func (s *Server) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		lis.Close()
+		return ErrServerStopped
+	}
+	s.lis[lis] = true
+	s.mu.Unlock()
+	if s.opts.metricsAddr != "" {
+		s.metricsOnce.Do(func() { go s.serveMetrics() })
+	}
+	if s.opts.adminAddr != "" {
+		s.adminOnce.Do(func() {
+			admin, err := serveAdmin(s.opts.adminAddr, s.AdminHandler())
+			if err != nil {
+				Error("failed to serve the admin endpoints", "addr", s.opts.adminAddr, "error", err)
+				return
+			}
+			s.mu.Lock()
+			s.admin = admin
+			s.mu.Unlock()
+		})
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.lis, lis)
+		s.mu.Unlock()
+		lis.Close()
+	}()
+	for {
+		c, err := lis.Accept()
+		if err != nil {
+			s.mu.Lock()
+			stopped := s.stopped
+			s.mu.Unlock()
+			if stopped {
+				return ErrServerStopped
+			}
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+// Stop stops the server. It closes all the listeners and connections.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	for lis := range s.lis {
+		lis.Close()
+	}
+	for sc := range s.conns {
+		sc.conn.Close()
+	}
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	s.mu.Unlock()
+}
+
+// serverConn 表示server端的一条连接
+type serverConn struct {
+	inFlight int64 // 正在处理的请求数
+
+	s        *Server
+	conn     *Conn
+	authInfo *AuthInfo // 握手得到的对端身份，未配置握手时为nil
+	logger   *LevelLogger
+
+	unsubscribed bool // 连接已关闭，不再接受订阅，由Server.pubsub.mu保护
+
+	// 以下由Server.sessions.mu保护
+	source  uint32 // 绑定的source
+	bound   bool   // 是否在会话注册表中绑定到source
+	unbound bool   // 连接已关闭或被踢下线，不再绑定
+}
+
+func (s *Server) serveConn(rawConn net.Conn) {
+	c := newMeteredConn(rawConn, serverMetrics)
+	sc := &serverConn{
+		s:      s,
+		conn:   newConn(c, s.opts.codec, s.opts.compression),
+		logger: With("remote_addr", c.RemoteAddr().String()),
+	}
+	sc.conn.parser.SetMaxFrameSize(s.opts.maxFrameSize)
+	sc.conn.setCapture(s.opts.capture)
+	// 在处理任何应用消息前完成版本协商和握手
+	c.SetDeadline(time.Now().Add(ConnectTimeout))
+	if err := sc.negotiateVersion(); err != nil {
+		sc.logger.Warn("version negotiation failed", "error", err)
+		c.Close()
+		return
+	}
+	if hs := s.opts.handshaker; hs != nil {
+		authInfo, err := hs.ServerHandshake(sc.conn)
+		if err != nil {
+			sc.logger.Warn("handshake failed", "error", err)
+			c.Close()
+			return
+		}
+		sc.authInfo = authInfo
+	}
+	sc.conn.handshakeDone()
+	c.SetDeadline(time.Time{})
+
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		c.Close()
+		return
+	}
+	s.conns[sc] = true
+	s.mu.Unlock()
+	sc.logger.Debug("connection accepted", "version", sc.conn.Version())
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, sc)
+		s.mu.Unlock()
+		s.pubsub.remove(sc)
+		if s.sessions != nil {
+			s.sessions.unbind(sc)
+		}
+		c.Close()
+	}()
+	if s.sessions != nil && sc.authInfo != nil && !s.sessions.bind(sc, sc.authInfo.Source) {
+		return
+	}
+
+	for {
+		req, err := sc.conn.ReadMsg()
+		if err != nil {
+			if err != io.EOF {
+				sc.logger.Warn("failed to read", "error", err)
+			}
+			sc.logger.Debug("connection closed")
+			return
+		}
+		if !sc.bindFirst(req) {
+			return
+		}
+		go sc.handle(req)
+	}
+}
+
+// bindFirst 在未配置握手时将连接绑定到第一条应用消息的source，返回false表示因重复登录被拒绝.
+// 被拒绝时回复EC_DUPLICATE_LOGIN，由调用方关闭连接. 与process一样不看内置消息(如心跳)的source.
+func (sc *serverConn) bindFirst(req *pb.BMessage) bool {
+	r := sc.s.sessions
+	if r == nil || sc.authInfo != nil || msgrange.BuiltinMessageTypes.Contains(req.GetHead().GetMessageType()) {
+		return true
+	}
+	if r.bind(sc, req.GetHead().GetSource()) {
+		return true
+	}
+	resp := newErrorResponse(req, pb.ErrorCode_EC_DUPLICATE_LOGIN, "the source has logged in on another connection")
+	if err := sc.conn.WriteMsg(resp); err != nil {
+		sc.logger.Warn("failed to write the response", "error", err)
+	}
+	return false
+}
+
+// handle 处理一条请求消息并回包
+func (sc *serverConn) handle(req *pb.BMessage) {
+	atomic.AddInt64(&sc.inFlight, 1)
+	defer atomic.AddInt64(&sc.inFlight, -1)
+	start := time.Now()
+	head := req.GetHead()
+	logger := sc.logger.With("session_no", head.GetSessionNo(), "message_type", head.GetMessageType())
+	ctx := NewLoggerContext(context.Background(), logger)
+	ctx, span := startServerSpan(ctx, req)
+	resp := sc.process(ctx, req)
+	if resp == nil {
+		// 不回包的请求也计入指标
+		serverMetrics.observe(sc.s.messageTypeLabel(head.GetMessageType()), "0", time.Since(start))
+		endSpan(span, req, 0, nil)
+		return
+	}
+	if resp.GetHead() == nil {
+		resp.Head = NewResponseHead(req.GetHead())
+	}
+	if err := sc.conn.WriteMsg(resp); err != nil {
+		logger.Warn("failed to write the response", "error", err)
+	}
+	rc := GetResponseCode(resp)
+	serverMetrics.observe(sc.s.messageTypeLabel(head.GetMessageType()), strconv.Itoa(int(rc.GetRetcode())), time.Since(start))
+	var err error
+	if rc.GetRetcode() != 0 && rc.GetErrorMessage() != "" {
+		err = errors.New(rc.GetErrorMessage())
+	}
+	endSpan(span, req, rc.GetRetcode(), err)
+}
+
+// messageTypeLabel 返回消息类型在指标中的标签，未注册的消息类型都记为messageTypeUnknown
+func (s *Server) messageTypeLabel(messageType int32) string {
+	if _, ok := s.handler(messageType); !ok {
+		return messageTypeUnknown
+	}
+	return strconv.Itoa(int(messageType))
+}
+
+// Handler returns the handler of the message type wrapped by the interceptors,
+// as called for the requests received on the connections.
+func (s *Server) Handler(messageType int32) (Handler, bool) {
+	h, ok := s.handler(messageType)
+	if !ok {
+		return nil, false
+	}
+	return s.intercept(h), true
+}
+
+// intercept 返回由所有拦截器包装后的h
+func (s *Server) intercept(h Handler) Handler {
+	for i := len(s.opts.interceptors) - 1; i >= 0; i-- {
+		next, in := h, s.opts.interceptors[i]
+		h = func(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+			return in(ctx, req, next)
+		}
+	}
+	return h
+}
+
+// process 检查请求并交给对应的Handler处理，返回需要回复的响应
+func (sc *serverConn) process(ctx context.Context, req *pb.BMessage) *pb.BMessage {
+	head := req.GetHead()
+	if !sc.s.opts.versions.contains(head.GetVersion()) {
+		return newErrorResponse(req, pb.ErrorCode_EC_UNSUPPORTED_VERSION, fmt.Sprintf("unsupported version %d", head.GetVersion()))
+	}
+	if sc.authInfo != nil && head.GetSource() != sc.authInfo.Source {
+		return newErrorResponse(req, pb.ErrorCode_EC_SOURCE_MISMATCH, "source does not match the authenticated identity")
+	}
+	// 内置消息(如心跳)不一定带有source，只检查应用消息
+	if sc.authInfo == nil && sc.s.sessions != nil && !msgrange.BuiltinMessageTypes.Contains(head.GetMessageType()) {
+		if source, ok := sc.s.sessions.sourceOf(sc); ok && head.GetSource() != source {
+			return newErrorResponse(req, pb.ErrorCode_EC_SOURCE_MISMATCH, "source does not match the bound session")
+		}
+	}
+	h, ok := sc.s.handler(head.GetMessageType())
+	if !ok {
+		return newErrorResponse(req, pb.ErrorCode_EC_UNKNOWN_MESSAGE_TYPE, "unknown message type")
+	}
+
+	ctx = context.WithValue(ctx, versionKey{}, sc.conn.Version())
+	ctx = context.WithValue(ctx, serverConnKey{}, sc)
+	if sc.authInfo != nil {
+		ctx = NewContextWithAuthInfo(ctx, sc.authInfo)
+	}
+	resp, err := sc.s.intercept(h)(ctx, req)
+	if err != nil {
+		return NewStatusResponse(req, status.Convert(err))
+	}
+	return resp
+}
+
+func newErrorResponse(req *pb.BMessage, code pb.ErrorCode, errMsg string) *pb.BMessage {
+	return NewErrorResponse(req, int32(code), errMsg)
+}
@@ -0,0 +1,267 @@
+package network
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "bgserver/message/proto/golang"
+)
+
+var (
+	ErrSessionNotFound    = errors.New("no connection is bound to the source")
+	ErrSessionsNotEnabled = errors.New("the session registry is not enabled")
+)
+
+// DuplicateLoginPolicy 决定同一source的新连接登录时如何处理已有的连接
+type DuplicateLoginPolicy int
+
+const (
+	// KickOld 关闭已有的连接，由新连接取代
+	KickOld DuplicateLoginPolicy = iota
+	// RejectNew 保留已有的连接，拒绝并关闭新连接
+	RejectNew
+)
+
+// PresenceType 为一条连接在会话注册表中的状态变化
+type PresenceType int
+
+const (
+	PresenceOnline   PresenceType = iota // 连接绑定到source
+	PresenceOffline                      // 绑定的连接关闭
+	PresenceKicked                       // 绑定的连接被同一source的新连接踢下线
+	PresenceRejected                     // 新连接因同一source已有连接而被拒绝
+)
+
+func (t PresenceType) String() string {
+	switch t {
+	case PresenceOnline:
+		return "online"
+	case PresenceOffline:
+		return "offline"
+	case PresenceKicked:
+		return "kicked"
+	case PresenceRejected:
+		return "rejected"
+	}
+	return "unknown"
+}
+
+// PresenceEvent 描述一次上下线
+type PresenceEvent struct {
+	Type       PresenceType
+	Source     uint32
+	ConnID     uint64
+	RemoteAddr string
+}
+
+// SessionOptions 为会话注册表的设置
+type SessionOptions struct {
+	// DuplicateLogin 为同一source重复登录时的处理方式，默认KickOld. 它只用于鉴权握手
+	// 得到的source，未经鉴权的连接总是按RejectNew处理.
+	DuplicateLogin DuplicateLoginPolicy
+	// OnPresence 不为nil时在每次上下线时调用. 它在连接的goroutine中被同步调用，
+	// 不同连接的事件可能并发到达，不能阻塞.
+	OnPresence func(PresenceEvent)
+}
+
+// SessionRegistry returns a ServerOption that enables the session registry, which
+// binds every connection to the source id of its peer so that Server.SendTo can
+// reach it. A connection is bound to the authenticated source after the handshake,
+// or, without a handshaker, to the Head.source of its first application message;
+// source 0 is never bound, so such a connection is bound by its first application
+// message with a source. The later application messages must carry the same
+// source. The built-in messages such as heartbeats neither bind a connection nor
+// are checked.
+//
+// Only a handshaker (see AuthHandshaker) proves that a peer owns its source.
+// Without one any client can claim any source, so the registry must then only be
+// reachable by trusted clients. A second connection of an authenticated source is
+// resolved by o.DuplicateLogin, while a second connection claiming the source of
+// an unauthenticated one is always rejected as with RejectNew, so that a client
+// cannot kick the real owner of a source offline by claiming it.
+func SessionRegistry(o SessionOptions) ServerOption {
+	return func(opts *serverOptions) {
+		opts.sessions = &o
+	}
+}
+
+// sessions 为source到连接的注册表
+type sessions struct {
+	opts  SessionOptions
+	mu    sync.Mutex
+	conns map[uint32]*serverConn
+}
+
+func newSessions(o *SessionOptions) *sessions {
+	if o == nil {
+		return nil
+	}
+	return &sessions{opts: *o, conns: make(map[uint32]*serverConn)}
+}
+
+// bind 将sc绑定到source，返回false表示因重复登录被拒绝. source为0或sc已经绑定过时不做任何事.
+func (r *sessions) bind(sc *serverConn, source uint32) bool {
+	if source == 0 {
+		return true
+	}
+	r.mu.Lock()
+	if sc.bound || sc.unbound {
+		r.mu.Unlock()
+		return true
+	}
+	old := r.conns[source]
+	policy := r.opts.DuplicateLogin
+	if sc.authInfo == nil {
+		// 未经鉴权的source可能是冒充的，不能踢掉已有的连接
+		policy = RejectNew
+	}
+	if old != nil && policy == RejectNew {
+		r.mu.Unlock()
+		sc.logger.Info("reject the duplicate login", "source", source, "conn_id", old.conn.ID())
+		r.notify(PresenceRejected, source, sc)
+		return false
+	}
+	if old != nil {
+		// 被踢下线的连接不再绑定，关闭时也不再产生下线事件
+		old.bound, old.unbound = false, true
+	} else {
+		sessionsOnline.Inc()
+	}
+	r.conns[source] = sc
+	sc.source, sc.bound = source, true
+	r.mu.Unlock()
+
+	if old != nil {
+		old.logger.Info("kicked by a new login", "source", source, "conn_id", sc.conn.ID())
+		old.conn.Close()
+		r.notify(PresenceKicked, source, old)
+	}
+	sc.logger.Debug("session online", "source", source)
+	r.notify(PresenceOnline, source, sc)
+	return true
+}
+
+// unbind 解除sc的绑定，在连接关闭时调用
+func (r *sessions) unbind(sc *serverConn) {
+	r.mu.Lock()
+	sc.unbound = true
+	if !sc.bound {
+		r.mu.Unlock()
+		return
+	}
+	sc.bound = false
+	delete(r.conns, sc.source)
+	sessionsOnline.Dec()
+	r.mu.Unlock()
+	sc.logger.Debug("session offline", "source", sc.source)
+	r.notify(PresenceOffline, sc.source, sc)
+}
+
+// sourceOf 返回sc绑定的source
+func (r *sessions) sourceOf(sc *serverConn) (uint32, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sc.source, sc.bound
+}
+
+// lookup 返回绑定到source的连接
+func (r *sessions) lookup(source uint32) *serverConn {
+	r.mu.Lock()
+	sc := r.conns[source]
+	r.mu.Unlock()
+	if sc == nil {
+		sessionLookups.WithLabelValues("not_found").Inc()
+	} else {
+		sessionLookups.WithLabelValues("found").Inc()
+	}
+	return sc
+}
+
+func (r *sessions) notify(t PresenceType, source uint32, sc *serverConn) {
+	sessionEvents.WithLabelValues(t.String()).Inc()
+	if r.opts.OnPresence != nil {
+		r.opts.OnPresence(PresenceEvent{
+			Type:       t,
+			Source:     source,
+			ConnID:     sc.conn.ID(),
+			RemoteAddr: sc.conn.RemoteAddr().String(),
+		})
+	}
+}
+
+// SendTo sends msg to the connection bound to the source dest, see SessionRegistry.
+// Head.dest of the message sent is set to dest. The client receives it as an
+// unsolicited message, see WithMessageHandler.
+func (s *Server) SendTo(dest uint32, msg *pb.BMessage) error {
+	if s.sessions == nil {
+		return ErrSessionsNotEnabled
+	}
+	if msg.GetHead() == nil {
+		return ErrInvalidMessage
+	}
+	sc := s.sessions.lookup(dest)
+	if sc == nil {
+		return ErrSessionNotFound
+	}
+	// 不修改调用方的消息
+	head := proto.Clone(msg.Head).(*pb.Head)
+	head.Dest = proto.Uint32(dest)
+	return sc.conn.WriteMsg(&pb.BMessage{Head: head, Body: msg.Body})
+}
+
+// Lookup returns the connection bound to source, see SessionRegistry.
+func (s *Server) Lookup(source uint32) (ConnInfo, bool) {
+	if s.sessions == nil {
+		return ConnInfo{}, false
+	}
+	sc := s.sessions.lookup(source)
+	if sc == nil {
+		return ConnInfo{}, false
+	}
+	return sc.info(), true
+}
+
+// SessionInfo 为会话注册表中的一个绑定
+type SessionInfo struct {
+	Source     uint32 `json:"source"`
+	ConnID     uint64 `json:"conn_id"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// Sessions returns the connections bound in the session registry, ordered by
+// source. It returns nil if the registry is not enabled.
+func (s *Server) Sessions() []SessionInfo {
+	if s.sessions == nil {
+		return nil
+	}
+	s.sessions.mu.Lock()
+	infos := make([]SessionInfo, 0, len(s.sessions.conns))
+	for source, sc := range s.sessions.conns {
+		infos = append(infos, SessionInfo{
+			Source:     source,
+			ConnID:     sc.conn.ID(),
+			RemoteAddr: sc.conn.RemoteAddr().String(),
+		})
+	}
+	s.sessions.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Source < infos[j].Source })
+	return infos
+}
+
+// MessageHandler 处理server主动发送给ClientConn的消息. 它在连接的读goroutine中被调用，
+// 阻塞会推迟该连接上所有响应的接收.
+type MessageHandler func(msg *pb.BMessage)
+
+// WithMessageHandler returns a DialOption that sets the handler of the messages
+// received from the servers which answer no pending call, such as the messages
+// sent by Server.SendTo. Without it such messages are dropped. The session_no of
+// the messages must not collide with the calls in flight, so Server.SendTo
+// callers usually leave it empty.
+func WithMessageHandler(h MessageHandler) DialOption {
+	return func(o *dialOptions) {
+		o.msgHandler = h
+	}
+}
@@ -0,0 +1,46 @@
+package network
+
+import (
+	"testing"
+
+	pb "bgserver/message/proto/golang"
+)
+
+func TestSessionBindsFirstApplicationMessage(t *testing.T) {
+	s := NewServer(SessionRegistry(SessionOptions{DuplicateLogin: KickOld}))
+	s.Handle(testMessageType, echoHandler)
+	addr := startServer(t, s)
+
+	cc1 := dial(t, addr)
+	// 心跳的source不绑定连接，也不与之后绑定的source比较
+	if rc := invoke(t, cc1, newHeartBeat(42)); rc != 0 {
+		t.Fatalf("heartbeat: retcode %d", rc)
+	}
+	if sessions := s.Sessions(); len(sessions) != 0 {
+		t.Fatalf("bound by a heartbeat: %+v", sessions)
+	}
+	if rc := invoke(t, cc1, newRequest(testMessageType, 7)); rc != 0 {
+		t.Fatalf("request: retcode %d", rc)
+	}
+	if rc := invoke(t, cc1, newHeartBeat(0)); rc != 0 {
+		t.Fatalf("heartbeat after the binding: retcode %d", rc)
+	}
+	sessions := s.Sessions()
+	if len(sessions) != 1 || sessions[0].Source != 7 {
+		t.Fatalf("sessions %+v, want source 7 only", sessions)
+	}
+	owner := sessions[0].ConnID
+
+	// 未经鉴权的第二条连接不能踢掉已有的连接
+	cc2 := dial(t, addr)
+	if rc := invoke(t, cc2, newHeartBeat(7)); rc != 0 {
+		t.Fatalf("heartbeat on the second connection: retcode %d", rc)
+	}
+	if rc := invoke(t, cc2, newRequest(testMessageType, 7)); rc != int32(pb.ErrorCode_EC_DUPLICATE_LOGIN) {
+		t.Fatalf("second login: retcode %d, want EC_DUPLICATE_LOGIN", rc)
+	}
+	sessions = s.Sessions()
+	if len(sessions) != 1 || sessions[0].ConnID != owner {
+		t.Fatalf("sessions %+v, want the first connection to stay bound", sessions)
+	}
+}
@@ -0,0 +1,201 @@
+package network
+
+import (
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	. "bgserver/common"
+	. "bgserver/message"
+	"bgserver/message/msgrange"
+	pb "bgserver/message/proto/golang"
+	"bgserver/status"
+)
+
+// ShadowPolicy 描述影子流量: 将一部分线上请求复制发送到另一个target(如即将上线的新版本)，
+// 丢弃其响应，只与主路径的响应比较并统计差异.
+type ShadowPolicy struct {
+	// Target 为影子请求发往的target，格式同Dial
+	Target      string
+	DialOptions []DialOption
+	// Fraction 为复制的请求比例，取值(0, 1]
+	Fraction float64
+	// MessageTypes 不为空时只复制其中的消息类型. 框架内置的消息类型(心跳、握手、订阅、管理等)从不复制.
+	MessageTypes map[int32]bool
+	// Timeout 为一个影子请求的超时，默认5秒
+	Timeout time.Duration
+	// MaxInFlight 为同时进行的影子请求的上限，超过时丢弃新的影子请求，默认100
+	MaxInFlight int
+	// Compare 判断主路径和影子的响应是否一致，为nil时比较消息类型、返回码和消息体
+	Compare func(primary, shadow *pb.BMessage) bool
+}
+
+// ShadowStats 统计影子请求的结果
+type ShadowStats struct {
+	Mirrored   uint64 `json:"mirrored"`   // 发出的影子请求数
+	Dropped    uint64 `json:"dropped"`    // 因MaxInFlight丢弃的影子请求数
+	Matched    uint64 `json:"matched"`    // 响应与主路径一致的影子请求数
+	Mismatched uint64 `json:"mismatched"` // 响应与主路径不一致的影子请求数
+	Failed     uint64 `json:"failed"`     // 发送失败或超时的影子请求数
+}
+
+// Shadow 将请求复制发送到ShadowPolicy.Target. 复制在主路径的响应返回后异步进行，
+// 影子请求的复制、发送、等待和比较都不在主路径上，达到MaxInFlight时直接丢弃，因此不会增加主路径的延迟.
+// 可通过WithShadow用于ClientConn，或通过Interceptor(s.Interceptor())用于Server.
+//
+// 被抽中的请求和响应在返回后仍会被异步读取，调用方(ClientConn.Invoke的调用方或Server的handler)
+// 不能再修改它们.
+type Shadow struct {
+	policy   ShadowPolicy
+	cc       *ClientConn
+	inFlight chan struct{}
+	stats    ShadowStats
+	// 上一次输出不一致日志的时间(UnixNano)及之后未输出的不一致次数
+	lastWarn   int64
+	suppressed uint64
+}
+
+// shadowWarnInterval 为输出响应不一致日志的最小间隔，间隔内的不一致只计数
+const shadowWarnInterval = 10 * time.Second
+
+// NewShadow dials the shadow target of p.
+func NewShadow(p ShadowPolicy) (*Shadow, error) {
+	if p.Timeout <= 0 {
+		p.Timeout = 5 * time.Second
+	}
+	if p.MaxInFlight <= 0 {
+		p.MaxInFlight = 100
+	}
+	if p.Compare == nil {
+		p.Compare = SameResponse
+	}
+	cc, err := Dial(p.Target, p.DialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return &Shadow{
+		policy:   p,
+		cc:       cc,
+		inFlight: make(chan struct{}, p.MaxInFlight),
+	}, nil
+}
+
+// WithShadow returns a DialOption that mirrors a fraction of the requests sent by
+// the ClientConn to the shadow target. Only the requests answered by the primary
+// target are mirrored. The requests and responses of the calls are read after
+// Invoke returns, so the callers must not modify them.
+func WithShadow(s *Shadow) DialOption {
+	return func(o *dialOptions) {
+		o.shadow = s
+	}
+}
+
+// Interceptor returns a ServerInterceptor that mirrors a fraction of the requests
+// answered by the handlers to the shadow target. The requests and responses are
+// read after the handlers return, so the handlers must not keep modifying them.
+func (s *Shadow) Interceptor() ServerInterceptor {
+	return func(ctx context.Context, req *pb.BMessage, h Handler) (*pb.BMessage, error) {
+		resp, err := h(ctx, req)
+		if s.sampled(req) {
+			// 与客户端实际收到的响应比较
+			primary := resp
+			if err != nil {
+				primary = NewStatusResponse(req, status.Convert(err))
+			} else if resp != nil && resp.Head == nil {
+				// 先于Server补上响应的消息头，使返回后resp不再被修改
+				resp.Head = NewResponseHead(req.GetHead())
+			}
+			s.mirror(req, primary)
+		}
+		return resp, err
+	}
+}
+
+// Stats returns a snapshot of the statistics of the shadow requests.
+func (s *Shadow) Stats() ShadowStats {
+	return ShadowStats{
+		Mirrored:   atomic.LoadUint64(&s.stats.Mirrored),
+		Dropped:    atomic.LoadUint64(&s.stats.Dropped),
+		Matched:    atomic.LoadUint64(&s.stats.Matched),
+		Mismatched: atomic.LoadUint64(&s.stats.Mismatched),
+		Failed:     atomic.LoadUint64(&s.stats.Failed),
+	}
+}
+
+// Close closes the connections to the shadow target.
+func (s *Shadow) Close() error {
+	return s.cc.Close()
+}
+
+// sampled 返回req是否需要复制
+func (s *Shadow) sampled(req *pb.BMessage) bool {
+	mt := req.GetHead().GetMessageType()
+	if msgrange.BuiltinMessageTypes.Contains(mt) {
+		return false
+	}
+	if len(s.policy.MessageTypes) > 0 && !s.policy.MessageTypes[mt] {
+		return false
+	}
+	return rand.Float64() < s.policy.Fraction
+}
+
+// mirror 异步地将被抽中的req发送到影子target，并与主路径的响应primary比较. primary为nil(不回包)时不复制.
+// req和primary在影子goroutine中复制，调用方在返回后不能再修改它们.
+func (s *Shadow) mirror(req, primary *pb.BMessage) {
+	if primary == nil {
+		return
+	}
+	mt := strconv.Itoa(int(req.GetHead().GetMessageType()))
+	select {
+	case s.inFlight <- struct{}{}:
+	default:
+		atomic.AddUint64(&s.stats.Dropped, 1)
+		shadowRequests.WithLabelValues(mt, "dropped").Inc()
+		return
+	}
+	atomic.AddUint64(&s.stats.Mirrored, 1)
+	go func() {
+		defer func() { <-s.inFlight }()
+		req := proto.Clone(req).(*pb.BMessage)
+		if primary.Head == nil {
+			// 与Server回包时一样补上响应的消息头
+			primary = &pb.BMessage{Head: NewResponseHead(req.GetHead()), Body: primary.Body}
+		}
+		// 由Invoke重新生成session_no，避免不同连接上相同的session_no在影子ClientConn上冲突
+		req.Head.SessionNo = nil
+		ctx, cancel := context.WithTimeout(context.Background(), s.policy.Timeout)
+		defer cancel()
+		resp, err := s.cc.Invoke(ctx, req)
+		switch {
+		case err != nil:
+			atomic.AddUint64(&s.stats.Failed, 1)
+			shadowRequests.WithLabelValues(mt, "failed").Inc()
+			Debug("shadow request failed", "message_type", mt, "error", err)
+		case s.policy.Compare(primary, resp):
+			atomic.AddUint64(&s.stats.Matched, 1)
+			shadowRequests.WithLabelValues(mt, "matched").Inc()
+		default:
+			atomic.AddUint64(&s.stats.Mismatched, 1)
+			shadowRequests.WithLabelValues(mt, "mismatched").Inc()
+			s.warnMismatch(mt, primary, resp)
+		}
+	}()
+}
+
+// warnMismatch 输出响应不一致的日志，每shadowWarnInterval最多一条. 消息体可能包含用户数据，不写入日志.
+func (s *Shadow) warnMismatch(mt string, primary, resp *pb.BMessage) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.lastWarn)
+	if now-last < int64(shadowWarnInterval) || !atomic.CompareAndSwapInt64(&s.lastWarn, last, now) {
+		atomic.AddUint64(&s.suppressed, 1)
+		return
+	}
+	Warn("shadow response differs from the primary one", "message_type", mt,
+		"primary_rc", proto.CompactTextString(GetResponseCode(primary)),
+		"shadow_rc", proto.CompactTextString(GetResponseCode(resp)),
+		"suppressed", atomic.SwapUint64(&s.suppressed, 0))
+}
@@ -0,0 +1,265 @@
+package network
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	. "bgserver/common"
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
+)
+
+var (
+	ErrSubscriptionClosed = errors.New("the subscription has been cancelled")
+)
+
+// PushHandler 处理server推送到某一主题的消息. 它在连接的读goroutine中被调用，
+// 阻塞会推迟该连接上所有响应的接收，耗时的处理应使用SubscribeChan.
+type PushHandler func(topic string, msg *pb.BMessage)
+
+// Subscription 为ClientConn上对一个主题的订阅. 订阅发往ClientConn的所有后端实例，
+// 连接断开后会自动重连并重新订阅.
+type Subscription struct {
+	cc     *ClientConn
+	topic  string
+	source uint32
+	h      PushHandler
+
+	dropped uint64 // SubscribeChan的channel满时丢弃的消息数
+
+	mu     sync.Mutex
+	ch     chan *pb.BMessage // 由SubscribeChan创建
+	closed bool
+}
+
+// Subscribe subscribes to topic on all the backends of the ClientConn with source
+// as Head.source, and calls h for every message published to it.
+func (cc *ClientConn) Subscribe(ctx context.Context, source uint32, topic string, h PushHandler) (*Subscription, error) {
+	sub := &Subscription{cc: cc, topic: topic, source: source, h: h}
+	if err := cc.addSubscription(ctx, sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// SubscribeChan is like Subscribe, but delivers the messages published to topic
+// through a channel buffering size messages. The messages arriving when the
+// channel is full are dropped. The channel is closed by Unsubscribe.
+func (cc *ClientConn) SubscribeChan(ctx context.Context, source uint32, topic string, size int) (*Subscription, <-chan *pb.BMessage, error) {
+	sub := &Subscription{cc: cc, topic: topic, source: source, ch: make(chan *pb.BMessage, size)}
+	sub.h = sub.send
+	if err := cc.addSubscription(ctx, sub); err != nil {
+		return nil, nil, err
+	}
+	return sub, sub.ch, nil
+}
+
+// send 将消息放入channel，channel满时丢弃
+func (sub *Subscription) send(topic string, msg *pb.BMessage) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	select {
+	case sub.ch <- msg:
+	default:
+		if atomic.AddUint64(&sub.dropped, 1) == 1 {
+			Warn("drop the pushed messages for the full channel", "topic", topic)
+		}
+	}
+}
+
+// Topic returns the subscribed topic.
+func (sub *Subscription) Topic() string {
+	return sub.topic
+}
+
+// Dropped returns the number of messages dropped because the channel of
+// SubscribeChan was full.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Unsubscribe cancels the subscription. The topic is unsubscribed on the backends
+// when no other subscription of the ClientConn is left on it.
+func (sub *Subscription) Unsubscribe(ctx context.Context) error {
+	sub.mu.Lock()
+	if sub.closed {
+		sub.mu.Unlock()
+		return ErrSubscriptionClosed
+	}
+	sub.closed = true
+	if sub.ch != nil {
+		close(sub.ch)
+	}
+	sub.mu.Unlock()
+
+	cc := sub.cc
+	if !cc.removeSubscription(sub) {
+		return nil
+	}
+	return cc.sendSubscribe(ctx, sub.source, nil, []string{sub.topic})
+}
+
+// addSubscription 记录sub，是该主题的第一个订阅时向所有后端实例发送订阅请求
+func (cc *ClientConn) addSubscription(ctx context.Context, sub *Subscription) error {
+	cc.subMu.Lock()
+	if cc.subs == nil {
+		cc.subs = make(map[string][]*Subscription)
+	}
+	first := len(cc.subs[sub.topic]) == 0
+	cc.subs[sub.topic] = append(cc.subs[sub.topic], sub)
+	cc.subMu.Unlock()
+	if !first {
+		return nil
+	}
+	if err := cc.sendSubscribe(ctx, sub.source, []string{sub.topic}, nil); err != nil {
+		cc.removeSubscription(sub)
+		return err
+	}
+	return nil
+}
+
+// removeSubscription 删除sub，返回该主题是否已没有订阅
+func (cc *ClientConn) removeSubscription(sub *Subscription) bool {
+	cc.subMu.Lock()
+	defer cc.subMu.Unlock()
+	subs := cc.subs[sub.topic]
+	for i, s := range subs {
+		if s == sub {
+			subs = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(cc.subs, sub.topic)
+		return true
+	}
+	cc.subs[sub.topic] = subs
+	return false
+}
+
+// sendSubscribe 向所有后端实例发送订阅请求，至少一个实例成功时返回nil.
+// 失败的实例在重新连接后会重新订阅.
+func (cc *ClientConn) sendSubscribe(ctx context.Context, source uint32, subscribe, unsubscribe []string) error {
+	var lastErr error
+	ok := false
+	for _, ac := range cc.conns {
+		if err := ac.subscribe(ctx, source, subscribe, unsubscribe); err != nil {
+			ac.logger.Warn("failed to subscribe", "subscribe", subscribe, "unsubscribe", unsubscribe, "error", err)
+			lastErr = err
+			if len(subscribe) > 0 && ac.getState() == TransientFailure {
+				ac.startReconnect()
+			}
+			continue
+		}
+		ok = true
+	}
+	if ok {
+		return nil
+	}
+	return lastErr
+}
+
+func (ac *addrConn) subscribe(ctx context.Context, source uint32, subscribe, unsubscribe []string) error {
+	req := &pb.BMessage{
+		Head: &pb.Head{
+			SessionNo:   proto.String(NewSessionNo()),
+			MessageType: proto.Int32(int32(pb.MessageType_SUBSCRIBE_REQUEST)),
+			Source:      proto.Uint32(source),
+		},
+		Body: &pb.Body{
+			SubscribeRequest: &pb.SubscribeRequest{
+				Subscribe:   subscribe,
+				Unsubscribe: unsubscribe,
+			},
+		},
+	}
+	resp, _, err := ac.invoke(ctx, req)
+	if err != nil {
+		return err
+	}
+	return CheckResponse(resp)
+}
+
+// subscribedTopics 返回ClientConn订阅的所有主题，以订阅时使用的source分组
+func (cc *ClientConn) subscribedTopics() map[uint32][]string {
+	cc.subMu.Lock()
+	defer cc.subMu.Unlock()
+	if len(cc.subs) == 0 {
+		return nil
+	}
+	topics := make(map[uint32][]string)
+	for t, subs := range cc.subs {
+		source := subs[0].source
+		topics[source] = append(topics[source], t)
+	}
+	return topics
+}
+
+// resubscribe 在重新建立的连接上恢复订阅
+func (ac *addrConn) resubscribe(topics map[uint32][]string) {
+	for source, ts := range topics {
+		ctx, cancel := context.WithTimeout(context.Background(), ac.cc.dopts.copts.Timeout)
+		err := ac.subscribe(ctx, source, ts, nil)
+		cancel()
+		if err != nil {
+			ac.logger.Warn("failed to resubscribe", "topics", ts, "error", err)
+		}
+	}
+}
+
+// startReconnect 在没有reconnectLoop运行时启动一个
+func (ac *addrConn) startReconnect() {
+	if atomic.CompareAndSwapInt32(&ac.reconnecting, 0, 1) {
+		go ac.reconnectLoop()
+	}
+}
+
+// reconnectLoop 在有订阅时于后台重新连接，使推送不依赖于新的调用来触发重连.
+// 退出前在持有ac.mu时清除reconnecting，使之后断开的连接(connBroken同样持有ac.mu)能启动新的reconnectLoop.
+func (ac *addrConn) reconnectLoop() {
+	backoff := time.Second
+	for {
+		time.Sleep(backoff)
+		ac.mu.Lock()
+		if ac.state == Ready || ac.state == Shutdown {
+			atomic.StoreInt32(&ac.reconnecting, 0)
+			ac.mu.Unlock()
+			return
+		}
+		err := ac.resetTransportLocked()
+		if err == nil {
+			atomic.StoreInt32(&ac.reconnecting, 0)
+			ac.mu.Unlock()
+			return
+		}
+		ac.mu.Unlock()
+		ac.logger.Debug("failed to reconnect for the subscriptions", "error", err)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// dispatchPush 将server推送的消息交给订阅了其主题的所有订阅
+func (cc *ClientConn) dispatchPush(m *pb.BMessage) {
+	push := m.GetBody().GetPushMessage()
+	topic := push.GetTopic()
+	cc.subMu.Lock()
+	subs := append([]*Subscription(nil), cc.subs[topic]...)
+	cc.subMu.Unlock()
+	if len(subs) == 0 {
+		Debug("drop the pushed message of a topic not subscribed", "topic", topic)
+		return
+	}
+	for _, sub := range subs {
+		sub.h(topic, push.GetMessage())
+	}
+}
@@ -0,0 +1,66 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
+)
+
+// testMessageType 为测试使用的应用消息类型，响应类型为testMessageType+1
+const testMessageType int32 = 1001
+
+// startServer 在本地随机端口上启动s，测试结束时停止
+func startServer(t *testing.T, s *Server) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+// echoHandler 回复一个空的响应
+func echoHandler(ctx context.Context, req *pb.BMessage) (*pb.BMessage, error) {
+	return &pb.BMessage{Head: NewResponseHead(req.GetHead()), Body: &pb.Body{}}, nil
+}
+
+func newRequest(mt int32, source uint32) *pb.BMessage {
+	return &pb.BMessage{
+		Head: &pb.Head{
+			MessageType: proto.Int32(mt),
+			Source:      proto.Uint32(source),
+		},
+		Body: &pb.Body{},
+	}
+}
+
+func newHeartBeat(source uint32) *pb.BMessage {
+	m := newRequest(int32(pb.MessageType_HEART_BEAT_REQUEST), source)
+	m.Body.HeartBeatRequest = &pb.HeartBeatRequest{}
+	return m
+}
+
+// dial 连接addr，测试结束时关闭
+func dial(t *testing.T, addr string, opts ...DialOption) *ClientConn {
+	cc, err := Dial(addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
+
+// invoke 发送req并返回响应中的返回码
+func invoke(t *testing.T, cc *ClientConn, req *pb.BMessage) int32 {
+	resp, err := cc.Invoke(context.Background(), req)
+	if err != nil {
+		t.Fatalf("message type %d: %v", req.GetHead().GetMessageType(), err)
+	}
+	return GetResponseCode(resp).GetRetcode()
+}
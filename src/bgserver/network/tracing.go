@@ -0,0 +1,51 @@
+package network
+
+import (
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	pb "bgserver/message/proto/golang"
+	"bgserver/trace"
+)
+
+// startClientSpan 为一次调用开始client端的span，并将其上下文写入请求的消息头.
+// ctx中已有span(如在Handler中继续调用下游服务)时，新span属于同一条调用链.
+func startClientSpan(ctx context.Context, req *pb.BMessage) (context.Context, *trace.Span) {
+	var parent *trace.SpanContext
+	if s := trace.FromContext(ctx); s != nil {
+		sc := s.SpanContext()
+		parent = &sc
+	}
+	ctx, span := trace.StartSpan(ctx, trace.SpanKindClient, parent)
+	sc := span.SpanContext()
+	req.Head.Trace = &pb.TraceContext{
+		TraceId: sc.TraceID[:],
+		SpanId:  sc.SpanID[:],
+		Sampled: proto.Bool(sc.Sampled),
+	}
+	return ctx, span
+}
+
+// startServerSpan 根据请求消息头中的追踪上下文开始server端的span
+func startServerSpan(ctx context.Context, req *pb.BMessage) (context.Context, *trace.Span) {
+	var parent *trace.SpanContext
+	if tc := req.GetHead().GetTrace(); len(tc.GetTraceId()) == len(trace.TraceID{}) && len(tc.GetSpanId()) == len(trace.SpanID{}) {
+		parent = &trace.SpanContext{Sampled: tc.GetSampled()}
+		copy(parent.TraceID[:], tc.GetTraceId())
+		copy(parent.SpanID[:], tc.GetSpanId())
+	}
+	return trace.StartSpan(ctx, trace.SpanKindServer, parent)
+}
+
+// endSpan 记录请求的信息和结果并结束span
+func endSpan(span *trace.Span, req *pb.BMessage, retcode int32, err error) {
+	head := req.GetHead()
+	span.MessageType = head.GetMessageType()
+	span.Source = head.GetSource()
+	span.Dest = head.GetDest()
+	span.Retcode = retcode
+	if err != nil {
+		span.Error = err.Error()
+	}
+	span.End()
+}
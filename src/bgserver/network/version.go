@@ -0,0 +1,148 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	pb "bgserver/message/proto/golang"
+)
+
+// 本实现支持的协议版本范围，即Head.version的取值范围
+const (
+	MinProtocolVersion uint32 = 1
+	MaxProtocolVersion uint32 = 1
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("no protocol version supported by both ends")
+)
+
+// versionRange 表示一端支持的协议版本范围[min, max]
+type versionRange struct {
+	min uint32
+	max uint32
+}
+
+var defaultVersionRange = versionRange{
+	min: MinProtocolVersion,
+	max: MaxProtocolVersion,
+}
+
+func (r versionRange) contains(v uint32) bool {
+	return v >= r.min && v <= r.max
+}
+
+// highestCommon 返回两个范围内共同支持的最高版本
+func (r versionRange) highestCommon(min, max uint32) (uint32, bool) {
+	if max > r.max {
+		max = r.max
+	}
+	if min < r.min {
+		min = r.min
+	}
+	if max < min {
+		return 0, false
+	}
+	return max, true
+}
+
+// SupportedVersions returns a ServerOption that declares the range of protocol
+// versions the server accepts. Requests of other versions are rejected with
+// EC_UNSUPPORTED_VERSION.
+func SupportedVersions(min, max uint32) ServerOption {
+	return func(o *serverOptions) {
+		o.versions = versionRange{min: min, max: max}
+	}
+}
+
+// MaxVersion returns the highest protocol version the server accepts, which is
+// the version of the requests it builds itself rather than receives on a connection.
+func (s *Server) MaxVersion() uint32 {
+	return s.opts.versions.max
+}
+
+// WithVersions returns a DialOption that declares the range of protocol
+// versions the client speaks.
+func WithVersions(min, max uint32) DialOption {
+	return func(o *dialOptions) {
+		o.versions = versionRange{min: min, max: max}
+	}
+}
+
+type versionKey struct{}
+
+// VersionFromContext returns the protocol version negotiated on the connection
+// the request in ctx was received from.
+func VersionFromContext(ctx context.Context) (uint32, bool) {
+	v, ok := ctx.Value(versionKey{}).(uint32)
+	return v, ok
+}
+
+// negotiateVersion 在连接建立时与client协商协议版本、压缩算法和帧头版本. 不支持版本协商的旧client
+// 会直接发送应用消息，此时以该消息的Head.version作为连接的版本，且以不压缩的v1帧发送消息.
+func (sc *serverConn) negotiateVersion() error {
+	versions := sc.s.opts.versions
+	m, err := sc.conn.ReadMsg()
+	if err != nil {
+		return err
+	}
+	hreq := m.GetBody().GetHandshakeRequest()
+	if pb.MessageType(m.GetHead().GetMessageType()) != pb.MessageType_HANDSHAKE_REQUEST || hreq.GetMaxVersion() == 0 {
+		sc.conn.unreadMsg(m)
+		sc.conn.version = m.GetHead().GetVersion()
+		return nil
+	}
+	v, ok := versions.highestCommon(hreq.GetMinVersion(), hreq.GetMaxVersion())
+	if !ok {
+		writeHandshakeResponse(sc.conn, m, pb.ErrorCode_EC_UNSUPPORTED_VERSION, nil)
+		return fmt.Errorf("%v: client supports [%d, %d], server supports [%d, %d]", ErrUnsupportedVersion,
+			hreq.GetMinVersion(), hreq.GetMaxVersion(), versions.min, versions.max)
+	}
+	sc.conn.version = v
+	frameVersion := negotiateFrameVersion(hreq.GetFrameVersion())
+	if err := writeHandshakeResponse(sc.conn, m, pb.ErrorCode_EC_OK, &pb.HandshakeResponse{
+		Version:      proto.Uint32(v),
+		Compressions: acceptedNames(sc.conn.dcs),
+		FrameVersion: proto.Uint32(uint32(frameVersion)),
+	}); err != nil {
+		return err
+	}
+	// 握手响应本身使用v1帧头且不压缩，之后的消息使用双方都支持的帧头和压缩算法
+	sc.conn.cp = sc.s.opts.compression.choose(hreq.GetCompressions())
+	sc.conn.setFrameVersion(frameVersion, sc.s.opts.frameChecksum)
+	return nil
+}
+
+// clientNegotiateVersion 在连接建立时与server协商协议版本、压缩算法和帧头版本.
+// 不支持版本协商的旧server会返回EC_UNKNOWN_MESSAGE_TYPE，此时认为server只支持MinProtocolVersion，
+// 且以不压缩的v1帧发送消息.
+func clientNegotiateVersion(c *Conn, versions versionRange, compression compressionOptions, frameChecksum bool) error {
+	hresp, rc, err := handshakeRoundTrip(c, 0, &pb.HandshakeRequest{
+		MinVersion:   proto.Uint32(versions.min),
+		MaxVersion:   proto.Uint32(versions.max),
+		Compressions: acceptedNames(c.dcs),
+		FrameVersion: proto.Uint32(uint32(MaxFrameVersion)),
+	})
+	if err != nil {
+		return err
+	}
+	switch pb.ErrorCode(rc.GetRetcode()) {
+	case pb.ErrorCode_EC_OK:
+		c.version = hresp.GetVersion()
+		c.cp = compression.choose(hresp.GetCompressions())
+		c.setFrameVersion(negotiateFrameVersion(hresp.GetFrameVersion()), frameChecksum)
+	case pb.ErrorCode_EC_UNKNOWN_MESSAGE_TYPE:
+		if !versions.contains(MinProtocolVersion) {
+			return ErrUnsupportedVersion
+		}
+		c.version = MinProtocolVersion
+	case pb.ErrorCode_EC_UNSUPPORTED_VERSION:
+		return fmt.Errorf("%v: client supports [%d, %d], %s", ErrUnsupportedVersion, versions.min, versions.max, rc.GetErrorMessage())
+	default:
+		return fmt.Errorf("bgserver: version negotiation failed with retcode %d %s", rc.GetRetcode(), rc.GetErrorMessage())
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package network
+
+import (
+	"bytes"
+	"io"
+
+	. "bgserver/common"
+	. "bgserver/message"
+	pb "bgserver/message/proto/golang"
+)
+
+// writeMsg 对消息进行编码，按照policy决定是否用cp压缩，并将帧头格式为ff的完整的帧写入w
+func writeMsg(w io.Writer, c Codec, cp Compressor, policy *compressionPolicy, ff FrameFormat, m *pb.BMessage) error {
+	b, err := c.Marshal(m)
+	if err != nil {
+		return err
+	}
+	mt := m.GetHead().GetMessageType()
+	if cp != nil && !policy.allow(mt, len(b)) {
+		cp = nil
+	}
+	var cbuf *bytes.Buffer
+	if cp != nil {
+		cbuf = new(bytes.Buffer)
+	}
+	frame, err := EncodeFrame(b, cp, cbuf, ff)
+	if err != nil {
+		return err
+	}
+	if cp != nil {
+		policy.record(mt, len(b), cbuf.Len())
+	}
+	_, err = w.Write(frame)
+	return err
+}
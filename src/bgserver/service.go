@@ -3,19 +3,44 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
+	"time"
 
-	"tcpserver/network"
+	"bgserver/common"
+	"bgserver/network"
 )
 
 var (
 	listen_ip		= flag.String("s", "127.0.0.1", "the ip the server will listen")
 	listen_port		= flag.Int("p", 8080, "the port the server will listen")
+	log_file		= flag.String("log_file", "", "the file to write logs to, stderr if empty")
+	log_max_size	= flag.Int64("log_max_size", 100, "rotate the log file when it grows beyond this many MB")
+	log_max_backups	= flag.Int("log_max_backups", 10, "the number of rotated log files to keep")
 )
 
 func main() {
 	flag.Parse()
 
-	s := network.TCPServer(*listen_ip, *listen_port)
-	fmt.Printf("The TCP server is listenning at %s:%d\n", *listen_ip, *port)
-	s.Run()
+	if *log_file != "" {
+		rf, err := common.NewRotatingFile(*log_file, common.RotateOptions{
+			MaxSize:	*log_max_size << 20,
+			Interval:	24 * time.Hour,
+			MaxBackups:	*log_max_backups,
+			Compress:	true,
+		})
+		if err != nil {
+			common.Fatalf("failed to open the log file: %v", err)
+		}
+		defer rf.Close()
+		common.L().SetOutput(rf)
+	}
+
+	address := fmt.Sprintf("%s:%d", *listen_ip, *listen_port)
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		common.Fatalf("failed to listen: %v", err)
+	}
+	s := network.NewServer()
+	fmt.Printf("The TCP server is listenning at %s\n", address)
+	s.Serve(lis)
 }
@@ -0,0 +1,181 @@
+/*
+Package status implements the errors carried by ResponseCode.
+
+A handler returns a *Status (or an error wrapping one) to answer with a specific
+retcode, and the client gets a *Status back for every response whose retcode is
+not 0. The ErrorCode enums generated by protoc-gen-bgserver implement Coder, so
+
+	return nil, status.Errorf(int32(service1.ErrorCode_EC_NOT_AT_HOME), "%d is out", person)
+
+on the server side matches
+
+	errors.Is(err, service1.ErrorCode_EC_NOT_AT_HOME)
+
+on the client side. Structured information can be attached with WithDetails.
+*/
+package status
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "bgserver/message/proto/golang"
+)
+
+// Coder 由生成代码中的ErrorCode枚举实现，使其可以直接作为error返回，或作为errors.Is的target
+type Coder interface {
+	error
+	Retcode() int32
+}
+
+// Status 为返回码不为0的响应所对应的错误
+type Status struct {
+	code    int32
+	message string
+	details []*pb.ErrorDetail
+}
+
+// New returns a Status with the retcode code and the error message msg.
+func New(code int32, msg string) *Status {
+	return &Status{code: code, message: msg}
+}
+
+// Newf returns a Status with the retcode code and a formatted error message.
+func Newf(code int32, format string, args ...interface{}) *Status {
+	return New(code, fmt.Sprintf(format, args...))
+}
+
+// Error returns an error with the retcode code and the error message msg.
+func Error(code int32, msg string) error {
+	return New(code, msg)
+}
+
+// Errorf returns an error with the retcode code and a formatted error message.
+func Errorf(code int32, format string, args ...interface{}) error {
+	return Newf(code, format, args...)
+}
+
+// Code returns the retcode of the status.
+func (s *Status) Code() int32 {
+	return s.code
+}
+
+// Message returns the error message of the status.
+func (s *Status) Message() string {
+	return s.message
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("bgserver: retcode %d: %s", s.code, s.message)
+}
+
+// Is reports whether target is a Status or a Coder with the same retcode,
+// which makes errors.Is(err, service1.ErrorCode_EC_NOT_AT_HOME) work.
+func (s *Status) Is(target error) bool {
+	switch t := target.(type) {
+	case *Status:
+		return t != nil && s.code == t.code
+	case Coder:
+		return s.code == t.Retcode()
+	}
+	return false
+}
+
+// WithDetails returns a copy of the status with the messages appended to its details.
+func (s *Status) WithDetails(details ...proto.Message) (*Status, error) {
+	ns := &Status{
+		code:    s.code,
+		message: s.message,
+		details: append([]*pb.ErrorDetail(nil), s.details...),
+	}
+	for _, d := range details {
+		b, err := proto.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		ns.details = append(ns.details, &pb.ErrorDetail{
+			Type:  proto.String(proto.MessageName(d)),
+			Value: b,
+		})
+	}
+	return ns, nil
+}
+
+// Details returns the messages attached to the status. The types of the messages
+// must be linked into the program, otherwise an error is returned for them.
+func (s *Status) Details() ([]proto.Message, error) {
+	var msgs []proto.Message
+	for _, d := range s.details {
+		t := proto.MessageType(d.GetType())
+		if t == nil {
+			return msgs, fmt.Errorf("status: unknown detail type %q", d.GetType())
+		}
+		m := reflect.New(t.Elem()).Interface().(proto.Message)
+		if err := proto.Unmarshal(d.GetValue(), m); err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// Proto returns the ResponseCode sent on the wire for the status.
+func (s *Status) Proto() *pb.ResponseCode {
+	rc := &pb.ResponseCode{
+		Retcode:      proto.Int32(s.code),
+		ErrorMessage: proto.String(s.message),
+	}
+	if len(s.details) > 0 {
+		rc.Details = s.details
+	}
+	return rc
+}
+
+// FromResponseCode returns the Status of rc, or nil if rc is nil or its retcode is 0.
+func FromResponseCode(rc *pb.ResponseCode) *Status {
+	if rc.GetRetcode() == 0 {
+		return nil
+	}
+	return &Status{
+		code:    rc.GetRetcode(),
+		message: rc.GetErrorMessage(),
+		details: rc.GetDetails(),
+	}
+}
+
+// FromError returns the Status in the chain of err, or a Status built from the
+// first Coder in the chain. It returns false if there is neither.
+func FromError(err error) (*Status, bool) {
+	if err == nil {
+		return nil, false
+	}
+	var s *Status
+	if errors.As(err, &s) {
+		return s, true
+	}
+	var c Coder
+	if errors.As(err, &c) {
+		return New(c.Retcode(), err.Error()), true
+	}
+	return nil, false
+}
+
+// Convert 将handler返回的错误转换为Status，不能识别的错误作为EC_INTERNAL
+func Convert(err error) *Status {
+	if s, ok := FromError(err); ok {
+		return s
+	}
+	return New(int32(pb.ErrorCode_EC_INTERNAL), err.Error())
+}
+
+// Code returns the retcode of err: 0 for nil, the retcode of a Status or Coder,
+// and EC_INTERNAL for other errors.
+func Code(err error) int32 {
+	if err == nil {
+		return 0
+	}
+	return Convert(err).Code()
+}
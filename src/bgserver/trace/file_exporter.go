@@ -0,0 +1,93 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	. "bgserver/common"
+)
+
+// FileExporter 将span以JSON lines的格式写入本地文件，每行一个span，
+// 不依赖外部的收集端即可查看调用链.
+type FileExporter struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	closed bool
+	done   chan struct{}
+}
+
+// 后台定期将缓冲的span写入文件的间隔
+const fileExporterFlushInterval = time.Second
+
+// NewFileExporter creates a FileExporter appending spans to the file at path.
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := &FileExporter{
+		f:    f,
+		w:    bufio.NewWriter(f),
+		done: make(chan struct{}),
+	}
+	go e.flushLoop()
+	return e, nil
+}
+
+// ExportSpan implements Exporter.
+func (e *FileExporter) ExportSpan(s *Span) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		Error("trace: failed to marshal span", "error", err)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	e.w.Write(b)
+	e.w.WriteByte('\n')
+}
+
+// Flush writes the buffered spans to the file.
+func (e *FileExporter) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.w.Flush()
+}
+
+// Close flushes the buffered spans and closes the file.
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	close(e.done)
+	if err := e.w.Flush(); err != nil {
+		e.f.Close()
+		return err
+	}
+	return e.f.Close()
+}
+
+func (e *FileExporter) flushLoop() {
+	ticker := time.NewTicker(fileExporterFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+			if err := e.Flush(); err != nil {
+				Error("trace: failed to flush spans", "error", err)
+			}
+		}
+	}
+}
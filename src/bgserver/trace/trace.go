@@ -0,0 +1,189 @@
+/*
+Package trace records the call path of a request across bgserver services.
+
+A client starts a client span for each call and carries its SpanContext in
+binggo.Head.trace; the server starts a child span from it and passes it to the
+handler through the context. Sampled spans are handed to the registered exporters.
+*/
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// span的类型
+const (
+	SpanKindClient = "client"
+	SpanKindServer = "server"
+)
+
+// TraceID 标识一次完整的调用链
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// MarshalText encodes the TraceID in hex.
+func (t TraceID) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// SpanID 标识调用链中的一个span
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// MarshalText encodes the SpanID in hex.
+func (s SpanID) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// SpanContext 为需要在进程间传递的span信息
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Span 记录一次调用在client端或server端的信息
+type Span struct {
+	TraceID      TraceID   `json:"trace_id"`
+	SpanID       SpanID    `json:"span_id"`
+	ParentSpanID SpanID    `json:"parent_span_id"`
+	Sampled      bool      `json:"-"`
+	Kind         string    `json:"kind"`
+	StartTime    time.Time `json:"start_time"`
+	EndTime      time.Time `json:"end_time"`
+
+	MessageType int32  `json:"message_type"`
+	Source      uint32 `json:"source"`
+	Dest        uint32 `json:"dest"`
+	Retcode     int32  `json:"retcode"`
+	Error       string `json:"error,omitempty"`
+}
+
+// SpanContext returns the SpanContext to propagate to the next hop.
+func (s *Span) SpanContext() SpanContext {
+	return SpanContext{
+		TraceID: s.TraceID,
+		SpanID:  s.SpanID,
+		Sampled: s.Sampled,
+	}
+}
+
+// End 结束span，被采样的span会交给所有已注册的Exporter
+func (s *Span) End() {
+	s.EndTime = time.Now()
+	if !s.Sampled {
+		return
+	}
+	exportersMu.Lock()
+	es := exporters
+	exportersMu.Unlock()
+	for e := range es {
+		e.ExportSpan(s)
+	}
+}
+
+// StartSpan 创建一个新的span. parent为nil时开始一条新的调用链，并按采样率决定是否采样，
+// 否则新span属于parent所在的调用链，并沿用其采样决定.
+func StartSpan(ctx context.Context, kind string, parent *SpanContext) (context.Context, *Span) {
+	s := &Span{
+		Kind:      kind,
+		StartTime: time.Now(),
+	}
+	if parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentSpanID = parent.SpanID
+		s.Sampled = parent.Sampled
+	} else {
+		rand.Read(s.TraceID[:])
+		s.Sampled = sampled(s.TraceID)
+	}
+	rand.Read(s.SpanID[:])
+	return NewContext(ctx, s), s
+}
+
+type spanKey struct{}
+
+// NewContext returns a new context carrying span.
+func NewContext(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// FromContext returns the span in ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// 采样率的取值为[0, 1]，以TraceID的前8字节与阈值比较，使同一条调用链的采样决定一致
+var samplingThreshold uint64 = math.MaxUint64 / 10000
+
+// SetSamplingRate 设置新调用链被采样的比例，默认为万分之一
+func SetSamplingRate(rate float64) {
+	switch {
+	case rate <= 0:
+		atomic.StoreUint64(&samplingThreshold, 0)
+	case rate >= 1:
+		atomic.StoreUint64(&samplingThreshold, math.MaxUint64)
+	default:
+		atomic.StoreUint64(&samplingThreshold, uint64(rate*math.MaxUint64))
+	}
+}
+
+func sampled(id TraceID) bool {
+	var x uint64
+	for _, b := range id[:8] {
+		x = x<<8 | uint64(b)
+	}
+	threshold := atomic.LoadUint64(&samplingThreshold)
+	return threshold == math.MaxUint64 || x < threshold
+}
+
+// Exporter 负责将被采样的span发送到存储或收集端. ExportSpan会在调用End的goroutine中
+// 同步执行，实现时应避免阻塞.
+type Exporter interface {
+	ExportSpan(s *Span)
+}
+
+var (
+	exportersMu sync.Mutex
+	exporters   map[Exporter]bool
+)
+
+// RegisterExporter adds e to the exporters that receive sampled spans.
+func RegisterExporter(e Exporter) {
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	// 复制一份新的map，使End可以在不持有锁的情况下遍历
+	es := make(map[Exporter]bool, len(exporters)+1)
+	for k := range exporters {
+		es[k] = true
+	}
+	es[e] = true
+	exporters = es
+}
+
+// UnregisterExporter removes e from the exporters.
+func UnregisterExporter(e Exporter) {
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	es := make(map[Exporter]bool, len(exporters))
+	for k := range exporters {
+		if k != e {
+			es[k] = true
+		}
+	}
+	exporters = es
+}
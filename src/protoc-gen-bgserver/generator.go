@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"path"
+	"strings"
+	"text/template"
+	"unicode"
+
+	descriptor "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"bgserver/message/msgrange"
+)
+
+// 业务服务通过扩展binggo.Body定义自己的消息体字段
+const bodyExtendee = ".binggo.Body"
+
+const (
+	requestSuffix  = "_REQUEST"
+	responseSuffix = "_RESPONSE"
+)
+
+type fileDesc struct {
+	*descriptor.FileDescriptorProto
+}
+
+// service 为一个.proto文件中定义的所有请求/响应对
+type service struct {
+	Source    string // .proto文件名
+	GoPackage string
+	Name      string // 服务名，如Service1
+	Methods   []*method
+	Ranges    *ranges
+}
+
+// ranges 为服务在init中向msgrange.RangeRegistry登记的范围，取值均为生成的Go常量名
+type ranges struct {
+	Name              string // 服务的包名，如binggo.service1
+	MessageTypeBegin  string // 如MessageType_BEGINNING_ID
+	MessageTypeEnd    string
+	ErrorCodeBegin    string // 没有定义ErrorCode枚举时为空
+	ErrorCodeEnd      string
+	MessageTypeValues []string
+	ErrorCodeValues   []string
+}
+
+// method 为一对*_REQUEST和*_RESPONSE消息类型
+type method struct {
+	Name             string // 如SayHello
+	RequestType      string // 如MessageType_SAY_HELLO_REQUEST
+	RequestMessage   string // 如SayHelloRequest
+	RequestExtension string // 如E_SayHelloRequest
+	ResponseMessage  string
+	ResponseExt      string
+}
+
+// newService 按照MessageType枚举和binggo.Body的扩展字段配对请求和响应，
+// 文件中没有这些定义时返回nil
+func newService(f *fileDesc) (*service, error) {
+	if f == nil {
+		return nil, fmt.Errorf("file not found in the request")
+	}
+	var enum *descriptor.EnumDescriptorProto
+	for _, e := range f.GetEnumType() {
+		if e.GetName() == "MessageType" {
+			enum = e
+		}
+	}
+	exts := make(map[int32]*descriptor.FieldDescriptorProto)
+	for _, x := range f.GetExtension() {
+		if x.GetExtendee() == bodyExtendee {
+			exts[x.GetNumber()] = x
+		}
+	}
+	if enum == nil || len(exts) == 0 {
+		return nil, nil
+	}
+
+	values := make(map[string]*descriptor.EnumValueDescriptorProto)
+	for _, v := range enum.GetValue() {
+		values[v.GetName()] = v
+	}
+	var err error
+	svc := &service{
+		Source:    f.GetName(),
+		GoPackage: goPackageName(f),
+		Name:      serviceName(f),
+	}
+	for _, v := range enum.GetValue() {
+		if !strings.HasSuffix(v.GetName(), requestSuffix) {
+			continue
+		}
+		base := strings.TrimSuffix(v.GetName(), requestSuffix)
+		rv, ok := values[base+responseSuffix]
+		if !ok {
+			return nil, fmt.Errorf("%s has no matching %s", v.GetName(), base+responseSuffix)
+		}
+		if rv.GetNumber() != v.GetNumber()+1 {
+			return nil, fmt.Errorf("%s must be %s + 1", rv.GetName(), v.GetName())
+		}
+		reqExt, ok := exts[v.GetNumber()]
+		if !ok {
+			return nil, fmt.Errorf("no binggo.Body extension is numbered %d for %s", v.GetNumber(), v.GetName())
+		}
+		respExt, ok := exts[rv.GetNumber()]
+		if !ok {
+			return nil, fmt.Errorf("no binggo.Body extension is numbered %d for %s", rv.GetNumber(), rv.GetName())
+		}
+		var reqMsg, respMsg string
+		reqMsg, err = localMessageName(f, reqExt)
+		if err != nil {
+			return nil, err
+		}
+		respMsg, err = localMessageName(f, respExt)
+		if err != nil {
+			return nil, err
+		}
+		svc.Methods = append(svc.Methods, &method{
+			Name:             camelCase(strings.ToLower(base)),
+			RequestType:      "MessageType_" + v.GetName(),
+			RequestMessage:   reqMsg,
+			RequestExtension: "E_" + camelCase(reqExt.GetName()),
+			ResponseMessage:  respMsg,
+			ResponseExt:      "E_" + camelCase(respExt.GetName()),
+		})
+	}
+	if len(svc.Methods) == 0 {
+		return nil, nil
+	}
+	if svc.Ranges, err = newRanges(f); err != nil {
+		return nil, err
+	}
+	return svc, nil
+}
+
+// newRanges 检查文件声明的范围，并返回登记这些范围所需的常量名
+func newRanges(f *fileDesc) (*ranges, error) {
+	spec, err := msgrange.ServiceSpecFromFile(f.FileDescriptorProto)
+	if err != nil {
+		return nil, err
+	}
+	// 在生成代码时就发现超出范围的消息类型和错误码，与其它服务的重叠由bgcheck检查
+	if err := msgrange.NewRangeRegistry().Register(spec); err != nil {
+		return nil, err
+	}
+	r := &ranges{Name: spec.Name}
+	for _, e := range f.GetEnumType() {
+		for _, v := range e.GetValue() {
+			name := e.GetName() + "_" + v.GetName()
+			switch e.GetName() {
+			case "MessageType":
+				switch v.GetName() {
+				case "BEGINNING_ID":
+					r.MessageTypeBegin = name
+				case "ENDING_ID":
+					r.MessageTypeEnd = name
+				default:
+					r.MessageTypeValues = append(r.MessageTypeValues, name)
+				}
+			case "ErrorCode":
+				switch {
+				case strings.HasSuffix(v.GetName(), "_BEGIN"):
+					r.ErrorCodeBegin = name
+				case strings.HasSuffix(v.GetName(), "_END"):
+					r.ErrorCodeEnd = name
+				default:
+					r.ErrorCodeValues = append(r.ErrorCodeValues, name)
+				}
+			}
+		}
+	}
+	return r, nil
+}
+
+// hasErrorCode 返回文件是否定义了顶层的ErrorCode枚举，生成的代码使其实现status.Coder
+func hasErrorCode(f *fileDesc) bool {
+	for _, e := range f.GetEnumType() {
+		if e.GetName() == "ErrorCode" {
+			return true
+		}
+	}
+	return false
+}
+
+// localMessageName 返回扩展字段的消息类型在本文件生成的Go包中的名字,
+// 如.binggo.service1.SayHelloRequest对应SayHelloRequest
+func localMessageName(f *fileDesc, x *descriptor.FieldDescriptorProto) (string, error) {
+	if x.GetType() != descriptor.FieldDescriptorProto_TYPE_MESSAGE {
+		return "", fmt.Errorf("extension %s must be a message", x.GetName())
+	}
+	prefix := "."
+	if f.GetPackage() != "" {
+		prefix += f.GetPackage() + "."
+	}
+	if !strings.HasPrefix(x.GetTypeName(), prefix) {
+		return "", fmt.Errorf("the type %s of extension %s must be defined in package %s",
+			x.GetTypeName(), x.GetName(), f.GetPackage())
+	}
+	parts := strings.Split(strings.TrimPrefix(x.GetTypeName(), prefix), ".")
+	for i, p := range parts {
+		parts[i] = camelCase(p)
+	}
+	return strings.Join(parts, "_"), nil
+}
+
+// goPackageName 与protoc-gen-go相同：优先使用go_package，否则将包名中的.替换为_
+func goPackageName(f *fileDesc) string {
+	if pkg := f.GetOptions().GetGoPackage(); pkg != "" {
+		if i := strings.LastIndex(pkg, ";"); i >= 0 {
+			return pkg[i+1:]
+		}
+		return path.Base(pkg)
+	}
+	if pkg := f.GetPackage(); pkg != "" {
+		return strings.Replace(pkg, ".", "_", -1)
+	}
+	base := path.Base(f.GetName())
+	return strings.Replace(base[:strings.Index(base, ".")], "-", "_", -1)
+}
+
+// serviceName 以包名的最后一段作为服务名，如binggo.service1对应Service1
+func serviceName(f *fileDesc) string {
+	name := f.GetPackage()
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" {
+		base := path.Base(f.GetName())
+		name = base[:strings.Index(base, ".")]
+	}
+	return camelCase(name)
+}
+
+// camelCase 与protoc-gen-go的CamelCase相同，如say_hello_request对应SayHelloRequest
+func camelCase(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '_' && i == 0:
+			b = append(b, 'X')
+		case c == '_' && i+1 < len(s) && unicode.IsLower(rune(s[i+1])):
+			// 跳过下划线，下一个字母大写
+		case i == 0 || s[i-1] == '_':
+			b = append(b, byte(unicode.ToUpper(rune(c))))
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// render 生成文件f的代码，svc为nil时只生成ErrorCode的方法
+func render(f *fileDesc, svc *service, binggoImport string) (string, error) {
+	var buf bytes.Buffer
+	if err := fileTemplate.Execute(&buf, map[string]interface{}{
+		"Source":       f.GetName(),
+		"GoPackage":    goPackageName(f),
+		"Service":      svc,
+		"ErrorCode":    hasErrorCode(f),
+		"BinggoImport": binggoImport,
+	}); err != nil {
+		return "", err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("failed to format the generated code: %v", err)
+	}
+	return string(src), nil
+}
+
+// lowerFirst 将首字母小写，用于不导出的类型名
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return string(unicode.ToLower(rune(s[0]))) + s[1:]
+}
+
+var fileTemplate = template.Must(template.New("file").Funcs(template.FuncMap{
+	"lowerFirst": lowerFirst,
+}).Parse(`// Code generated by protoc-gen-bgserver. DO NOT EDIT.
+// source: {{.Source}}
+
+package {{.GoPackage}}
+{{- if .Service}}
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"bgserver/message"
+	{{- if .Service.Ranges}}
+	"bgserver/message/msgrange"
+	{{- end}}
+	binggo "{{.BinggoImport}}"
+	"bgserver/network"
+)
+{{end}}
+{{if .ErrorCode}}
+// Error makes an ErrorCode usable as an error returned by handlers and as the
+// target of errors.Is against the errors returned by clients.
+func (x ErrorCode) Error() string {
+	return x.String()
+}
+
+// Retcode implements status.Coder.
+func (x ErrorCode) Retcode() int32 {
+	return int32(x)
+}
+{{end}}
+{{with .Service}}
+{{- with .Ranges}}
+func init() {
+	msgrange.MustRegisterService(&msgrange.ServiceSpec{
+		Name:         "{{.Name}}",
+		MessageTypes: msgrange.Range{Begin: int32({{.MessageTypeBegin}}), End: int32({{.MessageTypeEnd}})},
+		{{- if .ErrorCodeEnd}}
+		ErrorCodes:   msgrange.Range{Begin: int32({{.ErrorCodeBegin}}), End: int32({{.ErrorCodeEnd}})},
+		{{- end}}
+		MessageTypeValues: []int32{
+		{{- range .MessageTypeValues}}
+			int32({{.}}),
+		{{- end}}
+		},
+		ErrorCodeValues: []int32{
+		{{- range .ErrorCodeValues}}
+			int32({{.}}),
+		{{- end}}
+		},
+	})
+}
+{{end}}
+// {{.Name}}Client is the client API of the {{.Name}} service.
+type {{.Name}}Client interface {
+{{- range .Methods}}
+	{{.Name}}(ctx context.Context, req *{{.RequestMessage}}) (*{{.ResponseMessage}}, error)
+{{- end}}
+}
+
+type {{lowerFirst .Name}}Client struct {
+	cc     *network.ClientConn
+	source uint32
+}
+
+// New{{.Name}}Client returns a {{.Name}}Client sending requests on cc with source as Head.source.
+// A response whose retcode is not 0 is returned along with a *status.Status.
+func New{{.Name}}Client(cc *network.ClientConn, source uint32) {{.Name}}Client {
+	return &{{lowerFirst .Name}}Client{cc: cc, source: source}
+}
+{{$svc := .}}
+{{- range .Methods}}
+func (c *{{lowerFirst $svc.Name}}Client) {{.Name}}(ctx context.Context, req *{{.RequestMessage}}) (*{{.ResponseMessage}}, error) {
+	msg := &binggo.BMessage{
+		Head: &binggo.Head{
+			MessageType: proto.Int32(int32({{.RequestType}})),
+			Source:      proto.Uint32(c.source),
+		},
+		Body: &binggo.Body{},
+	}
+	if err := proto.SetExtension(msg.Body, {{.RequestExtension}}, req); err != nil {
+		return nil, err
+	}
+	resp, err := c.cc.Invoke(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	if resp.GetHead().GetRc().GetRetcode() != 0 {
+		// 框架层面的错误，响应中没有消息体
+		return nil, message.CheckResponse(resp)
+	}
+	ext, err := proto.GetExtension(resp.GetBody(), {{.ResponseExt}})
+	if err != nil {
+		return nil, fmt.Errorf("bgserver: invalid response of {{.Name}}: %v", err)
+	}
+	out := ext.(*{{.ResponseMessage}})
+	return out, message.CheckResponse(resp)
+}
+{{end}}
+// {{.Name}}Server is the server API of the {{.Name}} service.
+// A returned *status.Status or ErrorCode is sent to the client as the retcode,
+// other errors as EC_INTERNAL.
+type {{.Name}}Server interface {
+{{- range .Methods}}
+	{{.Name}}(ctx context.Context, req *{{.RequestMessage}}) (*{{.ResponseMessage}}, error)
+{{- end}}
+}
+
+// Register{{.Name}}Server registers the handlers of all the request message types of srv on s.
+func Register{{.Name}}Server(s *network.Server, srv {{.Name}}Server) {
+{{- range .Methods}}
+	s.Handle(int32({{.RequestType}}), func(ctx context.Context, req *binggo.BMessage) (*binggo.BMessage, error) {
+		ext, err := proto.GetExtension(req.GetBody(), {{.RequestExtension}})
+		if err != nil {
+			return nil, fmt.Errorf("invalid request of {{.Name}}: %v", err)
+		}
+		out, err := srv.{{.Name}}(ctx, ext.(*{{.RequestMessage}}))
+		if err != nil {
+			return nil, err
+		}
+		body := &binggo.Body{}
+		if err := proto.SetExtension(body, {{.ResponseExt}}, out); err != nil {
+			return nil, err
+		}
+		return &binggo.BMessage{Head: message.NewResponseHead(req.GetHead()), Body: body}, nil
+	})
+{{- end}}
+}
+{{end}}`))
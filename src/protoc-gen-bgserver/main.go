@@ -0,0 +1,122 @@
+/*
+protoc-gen-bgserver generates typed client stubs and server interfaces for the
+BMessage services defined like service1.1000.2000.proto: a MessageType enum whose
+*_REQUEST values are paired with the *_RESPONSE values, and binggo.Body extensions
+whose field numbers are the message types.
+
+For SAY_HELLO_REQUEST and SAY_HELLO_RESPONSE of package binggo.service1 it generates
+
+	type Service1Client interface {
+		SayHello(ctx context.Context, req *SayHelloRequest) (*SayHelloResponse, error)
+	}
+	func NewService1Client(cc *network.ClientConn, source uint32) Service1Client
+
+	type Service1Server interface {
+		SayHello(ctx context.Context, req *SayHelloRequest) (*SayHelloResponse, error)
+	}
+	func RegisterService1Server(s *network.Server, srv Service1Server)
+
+into <file>.bg.go next to the output of protoc-gen-go. The ErrorCode enum of every
+file, including binggo.proto, gets Error and Retcode methods so that its values
+implement status.Coder. Usage:
+
+	protoc --plugin=protoc-gen-bgserver=$GOPATH/bin/protoc-gen-bgserver \
+		--bgserver_out=binggo_import=bgserver/message/proto/golang:golang service1.1000.2000.proto
+
+binggo_import is the Go import path of the package generated from binggo.proto.
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+)
+
+// binggo.proto生成的Go包的默认导入路径
+const defaultBinggoImport = "bgserver/message/proto/golang"
+
+func main() {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fail("failed to read the request: %v", err)
+	}
+	req := new(plugin.CodeGeneratorRequest)
+	if err := proto.Unmarshal(data, req); err != nil {
+		fail("failed to parse the request: %v", err)
+	}
+
+	resp := generate(req)
+	data, err = proto.Marshal(resp)
+	if err != nil {
+		fail("failed to marshal the response: %v", err)
+	}
+	if _, err := os.Stdout.Write(data); err != nil {
+		fail("failed to write the response: %v", err)
+	}
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "protoc-gen-bgserver: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// parseParameter 解析--bgserver_out中冒号前的参数，形如k1=v1,k2=v2
+func parseParameter(param string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, kv := range strings.Split(param, ",") {
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid parameter %q, want key=value", kv)
+		}
+		params[kv[:i]] = kv[i+1:]
+	}
+	return params, nil
+}
+
+func generate(req *plugin.CodeGeneratorRequest) *plugin.CodeGeneratorResponse {
+	resp := new(plugin.CodeGeneratorResponse)
+	params, err := parseParameter(req.GetParameter())
+	if err != nil {
+		resp.Error = proto.String(err.Error())
+		return resp
+	}
+	binggoImport := defaultBinggoImport
+	if v, ok := params["binggo_import"]; ok {
+		binggoImport = v
+	}
+
+	files := make(map[string]*fileDesc)
+	for _, f := range req.GetProtoFile() {
+		files[f.GetName()] = &fileDesc{FileDescriptorProto: f}
+	}
+	for _, name := range req.GetFileToGenerate() {
+		f := files[name]
+		svc, err := newService(f)
+		if err != nil {
+			resp.Error = proto.String(fmt.Sprintf("%s: %v", name, err))
+			return resp
+		}
+		if svc == nil && !hasErrorCode(f) {
+			// 既没有定义消息类型和消息体扩展，也没有定义错误码的文件
+			continue
+		}
+		content, err := render(f, svc, binggoImport)
+		if err != nil {
+			resp.Error = proto.String(fmt.Sprintf("%s: %v", name, err))
+			return resp
+		}
+		resp.File = append(resp.File, &plugin.CodeGeneratorResponse_File{
+			Name:    proto.String(strings.TrimSuffix(name, ".proto") + ".bg.go"),
+			Content: proto.String(content),
+		})
+	}
+	return resp
+}
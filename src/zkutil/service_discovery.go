@@ -5,38 +5,18 @@ import (
 	"errors"
 	"math/rand"
 	"github.com/golang/protobuf/proto"
+
+	"bgserver/common"
 )
 
 const (
 	zkservers = "172.16.130.1:2181,172.16.130.2:2181,172.16.130.3:2181,172.16.181.1:2181,172.16.181.2:2181"
 )
 
-type ServiceNode struct {
-	Ip		*string
-	Port	*uint32
-}
-
-func (s *ServiceNode) Reset()			{ *s = ServiceNode{} }
-func (s *ServiceNode) String() string	{ return proto.CompactTextString(s)}
-func (*ServiceNode) ProtoMessage()		{}
-
-func (s *ServiceNode) GetIp() string {
-	if s != nil && s.Ip != nil {
-		return *s.Ip
-	}
-	return ""
-}
-
-func (s *ServiceNode) GetPort() uint32 {
-	if s != nil && s.Port != nil {
-		return *s.Port
-	}
-	return 0
-}
-
-
+// Register 在zkpath上注册一个服务实例，节点数据为序列化的common.ServiceNode，
+// 与bgserver/discovery读取的格式一致
 func Register(zkpath string, ip string, port uint32) (err error) {
-	service_node := &ServiceNode{
+	service_node := &common.ServiceNode{
 		Ip:		proto.String(ip),
 		Port:	proto.Uint32(port),
 	}
@@ -76,7 +56,7 @@ func Discovery(zkpath string) (ip string, port uint32, err error) {
 	}
 
 	// 对数据解码
-	service_node := &ServiceNode{}
+	service_node := &common.ServiceNode{}
 	err = proto.Unmarshal(buffer, service_node)
 	if err != nil {
 		return